@@ -0,0 +1,89 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/status"
+)
+
+var abandonFlagSet = flag.NewFlagSet("abandon", flag.ExitOnError)
+
+var (
+	abandonMessage = abandonFlagSet.String("m", "", "Message explaining why the review is abandoned")
+)
+
+// changeReviewStatus records that the given review moved to the given state.
+func changeReviewStatus(repo repository.Repo, r *review.Review, state, message string) error {
+	userEmail, err := repo.GetUserEmail()
+	if err != nil {
+		return err
+	}
+	note, err := status.New(userEmail, state, message).Write()
+	if err != nil {
+		return err
+	}
+	return repo.AppendNote(status.Ref, r.Revision, note)
+}
+
+// abandonReview marks the current code review as abandoned, which removes it from the open reviews.
+func abandonReview(repo repository.Repo, args []string) error {
+	abandonFlagSet.Parse(args)
+	args = abandonFlagSet.Args()
+
+	var r *review.Review
+	var err error
+	if len(args) > 1 {
+		return errors.New("Only abandoning a single review is supported.")
+	}
+
+	if len(args) == 1 {
+		r, err = review.Resolve(repo, args[0])
+	} else {
+		r, err = review.GetCurrent(repo)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to load the review: %v\n", err)
+	}
+	if r == nil {
+		return errors.New("There is no matching review.")
+	}
+	if r.Submitted {
+		return errors.New("The review has already been submitted.")
+	}
+	if r.Abandoned {
+		return errors.New("The review has already been abandoned.")
+	}
+	return changeReviewStatus(repo, r, status.StateAbandoned, *abandonMessage)
+}
+
+// abandonCmd defines the "abandon" subcommand.
+var abandonCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s abandon [<option>...] [<review-hash>]\n\nOptions:\n", arg0)
+		abandonFlagSet.PrintDefaults()
+	},
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
+		return abandonReview(repo, args)
+	},
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -29,6 +30,7 @@ var acceptFlagSet = flag.NewFlagSet("accept", flag.ExitOnError)
 
 var (
 	acceptMessage = acceptFlagSet.String("m", "", "Message to attach to the review")
+	acceptSign    = acceptFlagSet.Bool("S", false, "Sign the approval using the configured signing key")
 )
 
 // acceptReview adds an LGTM comment to the current code review.
@@ -43,7 +45,7 @@ func acceptReview(repo repository.Repo, args []string) error {
 	}
 
 	if len(args) == 1 {
-		r, err = review.Get(repo, args[0])
+		r, err = review.Resolve(repo, args[0])
 	} else {
 		r, err = review.GetCurrent(repo)
 	}
@@ -70,6 +72,9 @@ func acceptReview(repo repository.Repo, args []string) error {
 	c := comment.New(userEmail, *acceptMessage)
 	c.Location = &location
 	c.Resolved = &resolved
+	if err := signIfRequested(repo, *acceptSign, r.Revision, &c); err != nil {
+		return err
+	}
 	return r.AddComment(c)
 }
 
@@ -79,7 +84,7 @@ var acceptCmd = &Command{
 		fmt.Printf("Usage: %s accept [<option>...] [<commit>]\n\nOptions:\n", arg0)
 		acceptFlagSet.PrintDefaults()
 	},
-	RunMethod: func(repo repository.Repo, args []string) error {
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
 		return acceptReview(repo, args)
 	},
 }
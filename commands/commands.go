@@ -18,35 +18,140 @@ limitations under the License.
 package commands
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/signing"
+	"strings"
 )
 
 const notesRefPattern = "refs/notes/devtools/*"
 const commentFilename = "APPRAISE_COMMENT_EDITMSG"
 
+const (
+	// signNotesConfig is the setting that makes signing new notes the default.
+	signNotesConfig = "appraise.signNotes"
+	// requireSignedApprovalsConfig is the setting that makes submit ignore approvals with unverified signatures.
+	requireSignedApprovalsConfig = "appraise.requireSignedApprovals"
+	// requiredApprovalsConfig is the setting for the number of approvals needed to submit a review.
+	requiredApprovalsConfig = "appraise.requiredApprovals"
+	// requireReviewerApprovalConfig is the setting that makes submit wait for every listed reviewer to approve.
+	requireReviewerApprovalConfig = "appraise.requireReviewerApproval"
+)
+
 // Command represents the definition of a single command.
 type Command struct {
 	Usage     func(string)
-	RunMethod func(repository.Repo, []string) error
+	RunMethod func(context.Context, repository.Repo, []string) error
 }
 
 // Run executes a command, given its arguments.
 //
 // The args parameter is all of the command line args that followed the
-// subcommand.
-func (cmd *Command) Run(repo repository.Repo, args []string) error {
-	return cmd.RunMethod(repo, args)
+// subcommand. The repo is bound to the given context, so cancelling that
+// context kills any git processes that the command is still waiting on.
+func (cmd *Command) Run(ctx context.Context, repo repository.Repo, args []string) error {
+	return cmd.RunMethod(ctx, repo.WithContext(ctx), args)
+}
+
+// getBoolConfig reads a boolean setting from the git config, which defaults to false.
+func getBoolConfig(repo repository.Repo, key string) (bool, error) {
+	value, err := repo.GetConfig(key)
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "", "false", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("Invalid value %q for the %q setting; expected a boolean.", value, key)
+}
+
+// signIfRequested signs the given note, which annotates the given revision, if either
+// the sign parameter is set, or signing has been made the default using the
+// "appraise.signNotes" setting.
+func signIfRequested(repo repository.Repo, sign bool, revision string, note signing.Signable) error {
+	if !sign {
+		var err error
+		if sign, err = getBoolConfig(repo, signNotesConfig); err != nil {
+			return err
+		}
+	}
+	if !sign {
+		return nil
+	}
+	return signing.Sign(repo, revision, note)
+}
+
+// getRemotes returns the remotes that a command which pushes or pulls reviews should use.
+//
+// A remote named on the command line takes precedence. Otherwise, the remotes
+// configured using the "appraise.remote" setting are used: all of them if the
+// all parameter is set, and just the first one if not. Every returned remote
+// must be one of the remotes configured in git.
+func getRemotes(repo repository.Repo, all bool, args []string) ([]string, error) {
+	remotes := args
+	if len(args) == 1 {
+		if all {
+			return nil, errors.New("A remote cannot be named when using --all.")
+		}
+	} else {
+		var err error
+		if remotes, err = repo.GetReviewRemotes(); err != nil {
+			return nil, err
+		}
+		if !all {
+			remotes = remotes[:1]
+		}
+	}
+	for _, remote := range remotes {
+		url, err := repo.GetConfig("remote." + remote + ".url")
+		if err != nil {
+			return nil, err
+		}
+		if url == "" {
+			return nil, fmt.Errorf("There is no remote named %q.", remote)
+		}
+	}
+	return remotes, nil
+}
+
+// forEachRemote runs the given function for each of the given remotes.
+//
+// A failure for one remote does not stop the others from being tried, and the
+// returned error describes the failure for every remote that failed.
+func forEachRemote(remotes []string, fn func(remote string) error) error {
+	var failures []string
+	for _, remote := range remotes {
+		if err := fn(remote); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(failures, "\n"))
 }
 
 // CommandMap defines all of the available (sub)commands.
 var CommandMap = map[string]*Command{
+	"abandon": abandonCmd,
 	"accept":  acceptCmd,
 	"comment": commentCmd,
+	"edit":    editCmd,
+	"fsck":    fsckCmd,
 	"list":    listCmd,
+	"migrate": migrateCmd,
 	"pull":    pullCmd,
 	"push":    pushCmd,
 	"reject":  rejectCmd,
+	"reopen":  reopenCmd,
 	"request": requestCmd,
+	"retract": retractCmd,
 	"show":    showCmd,
 	"submit":  submitCmd,
+	"sync":    syncCmd,
 }
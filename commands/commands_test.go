@@ -0,0 +1,83 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"errors"
+	"github.com/google/git-appraise/repository"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetRemotes(t *testing.T) {
+	cases := []struct {
+		name       string
+		configured []string
+		all        bool
+		args       []string
+		expected   []string
+		err        string
+	}{
+		{name: "default", expected: []string{"origin"}},
+		{name: "default with --all", all: true, expected: []string{"origin"}},
+		{name: "first configured", configured: []string{"upstream", "origin"}, expected: []string{"upstream"}},
+		{name: "every configured", configured: []string{"upstream", "origin"}, all: true, expected: []string{"upstream", "origin"}},
+		{name: "named", configured: []string{"origin"}, args: []string{"upstream"}, expected: []string{"upstream"}},
+		{name: "named with --all", all: true, args: []string{"upstream"}, err: "cannot be named when using --all"},
+		{name: "unknown named", args: []string{"missing"}, err: `There is no remote named "missing"`},
+		{name: "unknown configured", configured: []string{"missing", "origin"}, err: `There is no remote named "missing"`},
+		{name: "unknown configured with --all", configured: []string{"origin", "missing"}, all: true, err: `There is no remote named "missing"`},
+	}
+	for _, test := range cases {
+		repo := repository.NewMockRepoForTest()
+		repository.SetMockConfig(repo, "remote.upstream.url", "https://example.com/upstream.git")
+		if len(test.configured) > 0 {
+			repository.SetMockConfig(repo, "appraise.remote", test.configured...)
+		}
+		remotes, err := getRemotes(repo, test.all, test.args)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: unexpected result %v, %v; expected the error %q", test.name, remotes, err, test.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(remotes, test.expected) {
+			t.Errorf("%s: unexpected result %v, %v; expected %v", test.name, remotes, err, test.expected)
+		}
+	}
+}
+
+func TestForEachRemote(t *testing.T) {
+	var tried []string
+	err := forEachRemote([]string{"upstream", "origin", "backup"}, func(remote string) error {
+		tried = append(tried, remote)
+		if remote == "backup" {
+			return nil
+		}
+		return errors.New("Failed to reach " + remote)
+	})
+	if !reflect.DeepEqual(tried, []string{"upstream", "origin", "backup"}) {
+		t.Fatalf("Unexpected remotes tried after a failure: %v", tried)
+	}
+	if err == nil || err.Error() != "Failed to reach upstream\nFailed to reach origin" {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := forEachRemote([]string{"origin"}, func(string) error { return nil }); err != nil {
+		t.Fatalf("Unexpected error when every remote succeeds: %v", err)
+	}
+}
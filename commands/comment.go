@@ -17,6 +17,7 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -24,6 +25,7 @@ import (
 	"github.com/google/git-appraise/repository"
 	"github.com/google/git-appraise/review"
 	"github.com/google/git-appraise/review/comment"
+	"strconv"
 	"strings"
 )
 
@@ -33,34 +35,147 @@ var (
 	commentMessageFile = commentFlagSet.String("F", "", "Take the comment from the given file.")
 	commentMessage     = commentFlagSet.String("m", "", "Message to attach to the review")
 	commentParent      = commentFlagSet.String("p", "", "Parent comment")
+	commentEdit        = commentFlagSet.String("edit", "", "One of your earlier comments, whose message and status are replaced by this comment")
 	commentFile        = commentFlagSet.String("f", "", "File being commented upon")
-	commentLine        = commentFlagSet.Uint("l", 0, "Line being commented upon; requires that the -f flag also be set")
+	commentBase        = commentFlagSet.Bool("base", false, "Comment on the file as it was before the review, such as on deleted lines; requires that the -f flag also be set")
+	commentLine        = commentFlagSet.String("l", "", "Lines being commented upon, as <line>[,<column>][-<line>[,<column>]] (e.g. 10, 10:25, or 10,4-12,30); requires that the -f flag also be set")
 	commentLgtm        = commentFlagSet.Bool("lgtm", false, "'Looks Good To Me'. Set this to express your approval. This cannot be combined with nmw")
 	commentNmw         = commentFlagSet.Bool("nmw", false, "'Needs More Work'. Set this to express your disapproval. This cannot be combined with lgtm")
+	commentSign        = commentFlagSet.Bool("S", false, "Sign the comment using the configured signing key")
 )
 
+// findCommentThread returns the thread for the given comment hash within the given
+// comment threads, or nil if there is no such comment.
+func findCommentThread(hashToFind string, threads []review.CommentThread) *review.CommentThread {
+	for i := range threads {
+		if threads[i].Hash == hashToFind {
+			return &threads[i]
+		}
+		if thread := findCommentThread(hashToFind, threads[i].Children); thread != nil {
+			return thread
+		}
+	}
+	return nil
+}
+
 // commentHashExists checks if the given comment hash exists in the given comment threads.
 func commentHashExists(hashToFind string, threads []review.CommentThread) bool {
-	for _, thread := range threads {
-		if thread.Hash == hashToFind {
-			return true
+	return findCommentThread(hashToFind, threads) != nil
+}
+
+// findOwnComment returns the thread for the given comment hash, after checking
+// that the comment was written by the current user and has not been retracted.
+func findOwnComment(repo repository.Repo, r *review.Review, hash string) (*review.CommentThread, string, error) {
+	thread := findCommentThread(hash, r.Comments)
+	if thread == nil {
+		return nil, "", errors.New("There is no matching comment.")
+	}
+	if thread.Retracted {
+		return nil, "", errors.New("The comment has already been retracted.")
+	}
+	userEmail, err := repo.GetUserEmail()
+	if err != nil {
+		return nil, "", err
+	}
+	if thread.Comment.Author != userEmail {
+		return nil, "", fmt.Errorf("Only the author of a comment (%s) can change it.", thread.Comment.Author)
+	}
+	return thread, userEmail, nil
+}
+
+// editedResolved returns the resolved bit for an edit of the given comment thread.
+//
+// Unless the edit sets a new status with -lgtm or -nmw, it keeps the current
+// status of the comment, so that fixing the text of a vote does not withdraw it.
+func editedResolved(thread *review.CommentThread, lgtm, nmw bool) *bool {
+	if lgtm || nmw {
+		return &lgtm
+	}
+	if thread.Comment.Resolved == nil {
+		return nil
+	}
+	resolved := *thread.Comment.Resolved
+	return &resolved
+}
+
+// parsePosition parses a position of the form "<line>[,<column>]".
+func parsePosition(position string) (line, column uint32, err error) {
+	parts := strings.SplitN(position, ",", 2)
+	parsed, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil || parsed == 0 {
+		return 0, 0, fmt.Errorf("Invalid line number %q", parts[0])
+	}
+	line = uint32(parsed)
+	if len(parts) == 2 {
+		parsed, err = strconv.ParseUint(parts[1], 10, 32)
+		if err != nil || parsed == 0 {
+			return 0, 0, fmt.Errorf("Invalid column number %q", parts[1])
+		}
+		column = uint32(parsed)
+	}
+	return line, column, nil
+}
+
+// parseCommentRange parses the range of lines, and optionally columns, given with the -l flag.
+//
+// The start and end of the range are separated by either "-" or ":", and each
+// is of the form "<line>[,<column>]". For example, "10", "10:25", and "10,4-12,30".
+func parseCommentRange(value string) (*comment.Range, error) {
+	start := value
+	separator := strings.IndexAny(value, "-:")
+	if separator >= 0 {
+		start = value[:separator]
+	}
+	startLine, startColumn, err := parsePosition(start)
+	if err != nil {
+		return nil, err
+	}
+	r := &comment.Range{
+		StartLine:   startLine,
+		StartColumn: startColumn,
+	}
+	if separator >= 0 {
+		endLine, endColumn, err := parsePosition(value[separator+1:])
+		if err != nil {
+			return nil, err
 		}
-		if commentHashExists(hashToFind, thread.Children) {
-			return true
+		if endLine != startLine {
+			r.EndLine = endLine
 		}
+		r.EndColumn = endColumn
 	}
-	return false
+	return r, nil
 }
 
 // checkCommentLocation verifies that the given location exists at the given commit.
-func checkCommentLocation(repo repository.Repo, commit, file string, line uint) error {
+//
+// The range may be nil, in which case only the file is checked.
+func checkCommentLocation(repo repository.Repo, commit, file string, r *comment.Range) error {
 	contents, err := repo.Show(commit, file)
 	if err != nil {
 		return err
 	}
+	if r == nil {
+		return nil
+	}
 	lines := strings.Split(contents, "\n")
-	if line > uint(len(lines)) {
-		return fmt.Errorf("Line number %d does not exist in file %q", line, file)
+	lastLine := r.LastLine()
+	for _, line := range []uint32{r.StartLine, lastLine} {
+		if line > uint32(len(lines)) {
+			return fmt.Errorf("Line number %d does not exist in file %q", line, file)
+		}
+	}
+	if lastLine < r.StartLine {
+		return fmt.Errorf("The range ends on line %d, before it starts on line %d", lastLine, r.StartLine)
+	}
+	if r.StartColumn > uint32(len(lines[r.StartLine-1])) {
+		return fmt.Errorf("Column %d does not exist on line %d of file %q", r.StartColumn, r.StartLine, file)
+	}
+	if r.EndColumn > uint32(len(lines[lastLine-1])) {
+		return fmt.Errorf("Column %d does not exist on line %d of file %q", r.EndColumn, lastLine, file)
+	}
+	if lastLine == r.StartLine && r.EndColumn != 0 && r.EndColumn < r.StartColumn {
+		return fmt.Errorf("The range ends on column %d, before it starts on column %d", r.EndColumn, r.StartColumn)
 	}
 	return nil
 }
@@ -77,7 +192,7 @@ func commentOnReview(repo repository.Repo, args []string) error {
 	}
 
 	if len(args) == 1 {
-		r, err = review.Get(repo, args[0])
+		r, err = review.Resolve(repo, args[0])
 	} else {
 		r, err = review.GetCurrent(repo)
 	}
@@ -92,12 +207,25 @@ func commentOnReview(repo repository.Repo, args []string) error {
 	if *commentLgtm && *commentNmw {
 		return errors.New("You cannot combine the flags -lgtm and -nmw.")
 	}
-	if *commentLine != 0 && *commentFile == "" {
+	if *commentLine != "" && *commentFile == "" {
 		return errors.New("Specifying a line number with the -l flag requires that you also specify a file name with the -f flag.")
 	}
+	if *commentBase && *commentFile == "" {
+		return errors.New("Commenting on the base side with the -base flag requires that you also specify a file name with the -f flag.")
+	}
 	if *commentParent != "" && !commentHashExists(*commentParent, r.Comments) {
 		return errors.New("There is no matching parent comment.")
 	}
+	if *commentEdit != "" && (*commentParent != "" || *commentFile != "" || *commentLine != "" || *commentBase) {
+		return errors.New("An edit keeps the location of the original comment, so the -edit flag cannot be combined with the -p, -f, -l, or -base flags.")
+	}
+	var editedThread *review.CommentThread
+	var editor string
+	if *commentEdit != "" {
+		if editedThread, editor, err = findOwnComment(repo, r, *commentEdit); err != nil {
+			return err
+		}
+	}
 
 	if *commentMessageFile != "" && *commentMessage == "" {
 		*commentMessage, err = input.FromFile(*commentMessageFile)
@@ -112,23 +240,42 @@ func commentOnReview(repo repository.Repo, args []string) error {
 		}
 	}
 
-	commentedUponCommit, err := r.GetHeadCommit()
+	if editedThread != nil {
+		resolved := editedResolved(editedThread, *commentLgtm, *commentNmw)
+		c := comment.NewEdit(editor, editedThread.Hash, *commentMessage, resolved)
+		if err := signIfRequested(repo, *commentSign, r.Revision, &c); err != nil {
+			return err
+		}
+		return r.AddComment(c)
+	}
+
+	var commentedUponCommit string
+	if *commentBase {
+		commentedUponCommit, err = r.GetBaseCommit()
+	} else {
+		commentedUponCommit, err = r.GetHeadCommit()
+	}
 	if err != nil {
 		return err
 	}
 	location := comment.Location{
 		Commit: commentedUponCommit,
 	}
+	if *commentBase {
+		location.Side = comment.SideBase
+	}
 	if *commentFile != "" {
-		if err := checkCommentLocation(r.Repo, commentedUponCommit, *commentFile, *commentLine); err != nil {
+		var commentRange *comment.Range
+		if *commentLine != "" {
+			if commentRange, err = parseCommentRange(*commentLine); err != nil {
+				return fmt.Errorf("Unable to comment on the given location: %v", err)
+			}
+		}
+		if err := checkCommentLocation(r.Repo, commentedUponCommit, *commentFile, commentRange); err != nil {
 			return fmt.Errorf("Unable to comment on the given location: %v", err)
 		}
 		location.Path = *commentFile
-		if *commentLine != 0 {
-			location.Range = &comment.Range{
-				StartLine: uint32(*commentLine),
-			}
-		}
+		location.Range = commentRange
 	}
 
 	userEmail, err := repo.GetUserEmail()
@@ -138,10 +285,16 @@ func commentOnReview(repo repository.Repo, args []string) error {
 	c := comment.New(userEmail, *commentMessage)
 	c.Location = &location
 	c.Parent = *commentParent
+	if location.Range != nil {
+		c.Version = location.Range.RequiredVersion()
+	}
 	if *commentLgtm || *commentNmw {
 		resolved := *commentLgtm
 		c.Resolved = &resolved
 	}
+	if err := signIfRequested(repo, *commentSign, r.Revision, &c); err != nil {
+		return err
+	}
 	return r.AddComment(c)
 }
 
@@ -151,7 +304,7 @@ var commentCmd = &Command{
 		fmt.Printf("Usage: %s comment [<option>...] [<review-hash>]\n\nOptions:\n", arg0)
 		commentFlagSet.PrintDefaults()
 	},
-	RunMethod: func(repo repository.Repo, args []string) error {
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
 		return commentOnReview(repo, args)
 	},
 }
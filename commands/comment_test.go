@@ -0,0 +1,107 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"flag"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/comment"
+	"reflect"
+	"testing"
+)
+
+func TestParseCommentRange(t *testing.T) {
+	valid := map[string]comment.Range{
+		"10":         comment.Range{StartLine: 10},
+		"10,4":       comment.Range{StartLine: 10, StartColumn: 4},
+		"10:25":      comment.Range{StartLine: 10, EndLine: 25},
+		"10-25":      comment.Range{StartLine: 10, EndLine: 25},
+		"10,4-12,30": comment.Range{StartLine: 10, StartColumn: 4, EndLine: 12, EndColumn: 30},
+		"10,4-10,8":  comment.Range{StartLine: 10, StartColumn: 4, EndColumn: 8},
+	}
+	for value, expected := range valid {
+		r, err := parseCommentRange(value)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %q: %v", value, err)
+		}
+		if *r != expected {
+			t.Fatalf("Unexpected range for %q: %+v", value, *r)
+		}
+	}
+	for _, value := range []string{"", "0", "x", "10,", "10,0", "10-", "10:x", "10,4-12,y"} {
+		if r, err := parseCommentRange(value); err == nil {
+			t.Fatalf("Unexpectedly parsed %q as %+v", value, *r)
+		}
+	}
+}
+
+func TestEditedResolved(t *testing.T) {
+	accepted := true
+	approval := &review.CommentThread{Comment: comment.Comment{Resolved: &accepted}}
+	fyi := &review.CommentThread{}
+	if resolved := editedResolved(approval, false, false); resolved == nil || !*resolved {
+		t.Fatalf("Editing the text of an approval changed its status to %v", resolved)
+	}
+	if resolved := editedResolved(fyi, false, false); resolved != nil {
+		t.Fatalf("Editing the text of an FYI comment changed its status to %v", *resolved)
+	}
+	if resolved := editedResolved(approval, false, true); resolved == nil || *resolved {
+		t.Fatalf("Unexpected status after editing an approval with -nmw: %v", resolved)
+	}
+	if resolved := editedResolved(fyi, true, false); resolved == nil || !*resolved {
+		t.Fatalf("Unexpected status after editing an FYI comment with -lgtm: %v", resolved)
+	}
+}
+
+func TestCommentOnBaseSide(t *testing.T) {
+	defer commentFlagSet.VisitAll(func(f *flag.Flag) { f.Value.Set(f.DefValue) })
+	repo := repository.NewMockRepoForTest()
+	args := []string{"-base", "-f", "README", "-l", "1", "-m", "About the original file", repository.TestCommitG}
+	if err := commentOnReview(repo, args); err != nil {
+		t.Fatal(err)
+	}
+	r, err := review.Get(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var thread *review.CommentThread
+	for i := range r.Comments {
+		if r.Comments[i].Comment.Description == "About the original file" {
+			thread = &r.Comments[i]
+		}
+	}
+	if thread == nil {
+		t.Fatal("The base side comment was not written")
+	}
+	expected := comment.Location{
+		Commit: repository.TestCommitF,
+		Path:   "README",
+		Range:  &comment.Range{StartLine: 1},
+		Side:   comment.SideBase,
+	}
+	if location := thread.Comment.Location; location == nil || !reflect.DeepEqual(*location, expected) {
+		t.Fatalf("Unexpected location for the base side comment: %+v", location)
+	}
+	// The base commit is unchanged, so anchoring leaves the comment where it was.
+	if err := r.AnchorComments(); err != nil {
+		t.Fatal(err)
+	}
+	if anchor := thread.Anchor; anchor == nil || anchor.Outdated || !reflect.DeepEqual(*anchor.Location, expected) {
+		t.Fatalf("Unexpected anchor for the base side comment: %+v", anchor)
+	}
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/google/git-appraise/commands/input"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/request"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// descriptionFilename is the file used to edit the description of a review.
+const descriptionFilename = "APPRAISE_DESCRIPTION_EDITMSG"
+
+var editFlagSet = flag.NewFlagSet("edit", flag.ExitOnError)
+
+var (
+	editAddReviewers    = editFlagSet.String("add-reviewer", "", "Comma-separated list of reviewers to add")
+	editRemoveReviewers = editFlagSet.String("remove-reviewer", "", "Comma-separated list of reviewers to remove")
+	editDescription     = editFlagSet.String("description", "", "New description of the review")
+	editInEditor        = editFlagSet.Bool("e", false, "Edit the description of the review using the configured editor")
+	editRetarget        = editFlagSet.String("retarget", "", "New target ref of the review")
+	editSign            = editFlagSet.Bool("S", false, "Sign the edited request using the configured signing key")
+)
+
+// splitEmails splits a comma-separated list of email addresses.
+func splitEmails(list string) []string {
+	var emails []string
+	for _, email := range strings.Split(list, ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
+
+// editReviewers returns the given reviewers, with the given additions and removals applied.
+func editReviewers(reviewers, added, removed []string) ([]string, error) {
+	listed := make(map[string]bool)
+	for _, reviewer := range reviewers {
+		listed[reviewer] = true
+	}
+	for _, reviewer := range removed {
+		if !listed[reviewer] {
+			return nil, fmt.Errorf("%q is not a reviewer of the review.", reviewer)
+		}
+		delete(listed, reviewer)
+	}
+	var edited []string
+	included := make(map[string]bool)
+	for _, reviewer := range reviewers {
+		if listed[reviewer] && !included[reviewer] {
+			edited = append(edited, reviewer)
+			included[reviewer] = true
+		}
+	}
+	for _, reviewer := range added {
+		if !included[reviewer] {
+			edited = append(edited, reviewer)
+			included[reviewer] = true
+		}
+	}
+	return edited, nil
+}
+
+// editReview writes a new version of the request for the current code review,
+// derived from the latest one.
+//
+// The "args" parameter is all of the command line arguments that followed the subcommand.
+func editReview(repo repository.Repo, args []string) error {
+	editFlagSet.Parse(args)
+	args = editFlagSet.Args()
+
+	if *editDescription != "" && *editInEditor {
+		return errors.New("Only one of --description or -e is allowed.")
+	}
+
+	var r *review.Review
+	var err error
+	if len(args) > 1 {
+		return errors.New("Only editing a single review is supported.")
+	}
+
+	if len(args) == 1 {
+		r, err = review.Resolve(repo, args[0])
+	} else {
+		r, err = review.GetCurrent(repo)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to load the review: %v\n", err)
+	}
+	if r == nil {
+		return errors.New("There is no matching review.")
+	}
+	if r.Submitted {
+		return errors.New("The review has already been submitted.")
+	}
+
+	userEmail, err := repo.GetUserEmail()
+	if err != nil {
+		return err
+	}
+	edited := r.Request
+	edited.Timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	edited.Signature = ""
+	edited.Editor = ""
+	if userEmail != edited.Requester {
+		edited.Editor = userEmail
+	}
+
+	edited.Reviewers, err = editReviewers(r.Request.Reviewers, splitEmails(*editAddReviewers), splitEmails(*editRemoveReviewers))
+	if err != nil {
+		return err
+	}
+	if *editDescription != "" {
+		edited.Description = *editDescription
+	}
+	if *editInEditor {
+		description, err := input.EditText(repo, descriptionFilename, edited.Description)
+		if err != nil {
+			return err
+		}
+		edited.Description = strings.TrimSpace(description)
+		if edited.Description == "" {
+			return errors.New("Refusing to clear the description of the review.")
+		}
+	}
+	if *editRetarget != "" && *editRetarget != edited.TargetRef {
+		if err := repo.VerifyGitRef(*editRetarget); err != nil {
+			return err
+		}
+		head, err := r.GetHeadCommit()
+		if err != nil {
+			return err
+		}
+		edited.TargetRef = *editRetarget
+		if edited.BaseCommit, err = repo.MergeBase(edited.TargetRef, head); err != nil {
+			return err
+		}
+	}
+
+	if reflect.DeepEqual(edited.Reviewers, r.Request.Reviewers) && edited.Description == r.Request.Description &&
+		edited.TargetRef == r.Request.TargetRef {
+		return errors.New("Nothing to edit; the review already matches the requested changes.")
+	}
+	if err := signIfRequested(repo, *editSign, r.Revision, &edited); err != nil {
+		return err
+	}
+	note, err := edited.Write()
+	if err != nil {
+		return err
+	}
+	if err := repo.AppendNote(request.Ref, r.Revision, note); err != nil {
+		return err
+	}
+	if edited.TargetRef != r.Request.TargetRef {
+		// Retargeting changes the base of the review, which makes it a new revision.
+		return recordRevision(repo, r.Revision, userEmail)
+	}
+	return nil
+}
+
+// editCmd defines the "edit" subcommand.
+var editCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s edit [<option>...] [<review-hash>]\n\nOptions:\n", arg0)
+		editFlagSet.PrintDefaults()
+	},
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
+		return editReview(repo, args)
+	},
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEditReviewers(t *testing.T) {
+	reviewers := []string{"alice", "bob", "carol"}
+	edited, err := editReviewers(reviewers, splitEmails("dave, bob,"), splitEmails(" carol"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(edited, []string{"alice", "bob", "dave"}) {
+		t.Fatalf("Unexpected reviewers list: '%v'", edited)
+	}
+	if !reflect.DeepEqual(reviewers, []string{"alice", "bob", "carol"}) {
+		t.Fatalf("The original reviewers list was modified: '%v'", reviewers)
+	}
+	if _, err := editReviewers(reviewers, nil, []string{"dave"}); err == nil {
+		t.Fatal("Unexpected success removing someone who is not a reviewer")
+	}
+}
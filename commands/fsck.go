@@ -0,0 +1,80 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+)
+
+var fsckFlagSet = flag.NewFlagSet("fsck", flag.ExitOnError)
+
+var (
+	fsckJSONOutput = fsckFlagSet.Bool("json", false, "Format the output as JSON")
+)
+
+// fsckNotes checks the review notes for problems.
+//
+// The command fails if any problems are found, so that it can be used in CI.
+func fsckNotes(repo repository.Repo, args []string) error {
+	fsckFlagSet.Parse(args)
+	if len(fsckFlagSet.Args()) > 0 {
+		return errors.New("The fsck command does not take any arguments.")
+	}
+
+	problems, err := review.Fsck(repo)
+	if err != nil {
+		return fmt.Errorf("Failed to check the review notes: %v", err)
+	}
+	if *fsckJSONOutput {
+		if problems == nil {
+			problems = []review.Problem{}
+		}
+		b, err := json.MarshalIndent(problems, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+	} else {
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Found %d problem(s) with the review notes.", len(problems))
+	}
+	if !*fsckJSONOutput {
+		fmt.Println("No problems found with the review notes.")
+	}
+	return nil
+}
+
+// fsckCmd defines the "fsck" subcommand.
+var fsckCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s fsck [<option>...]\n\nOptions:\n", arg0)
+		fsckFlagSet.PrintDefaults()
+	},
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
+		return fsckNotes(repo, args)
+	},
+}
@@ -70,6 +70,16 @@ func LaunchEditor(repo repository.Repo, fileName string) (string, error) {
 	return string(output), err
 }
 
+// EditText launches the default editor on the given text, in the same way as
+// LaunchEditor, and returns the edited text.
+func EditText(repo repository.Repo, fileName, text string) (string, error) {
+	path := fmt.Sprintf("%s/.git/%s", repo.GetPath(), fileName)
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		return "", fmt.Errorf("Error writing the file to edit: %v\n", err)
+	}
+	return LaunchEditor(repo, fileName)
+}
+
 // FromFile loads and returns the contents of a given file.
 func FromFile(fileName string) (string, error) {
 	output, err := ioutil.ReadFile(fileName)
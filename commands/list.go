@@ -17,6 +17,7 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -29,21 +30,40 @@ var listFlagSet = flag.NewFlagSet("list", flag.ExitOnError)
 
 var (
 	listAll        = listFlagSet.Bool("a", false, "List all reviews (not just the open ones).")
+	listAbandoned  = listFlagSet.Bool("abandoned", false, "List only the abandoned reviews.")
 	listJSONOutput = listFlagSet.Bool("json", false, "Format the output as JSON")
+	listRebuild    = listFlagSet.Bool("rebuild-index", false, "Discard the cached review index and rebuild it from scratch.")
 )
 
 // listReviews lists all extant reviews.
 // TODO(ojarjur): Add more flags for filtering the output (e.g. filtering by reviewer or status).
 func listReviews(repo repository.Repo, args []string) error {
 	listFlagSet.Parse(args)
+	if *listRebuild {
+		if err := review.RebuildIndex(repo); err != nil {
+			return fmt.Errorf("Failed to rebuild the review index: %v", err)
+		}
+	}
 	var reviews []review.Summary
-	if *listAll {
-		reviews = review.ListAll(repo)
+	var loadErr error
+	if *listAbandoned {
+		var allReviews []review.Summary
+		allReviews, loadErr = review.ListAll(repo)
+		for _, r := range allReviews {
+			if r.Abandoned && !r.Submitted {
+				reviews = append(reviews, r)
+			}
+		}
+		if !*listJSONOutput {
+			fmt.Printf("Loaded %d abandoned reviews:\n", len(reviews))
+		}
+	} else if *listAll {
+		reviews, loadErr = review.ListAll(repo)
 		if !*listJSONOutput {
 			fmt.Printf("Loaded %d reviews:\n", len(reviews))
 		}
 	} else {
-		reviews = review.ListOpen(repo)
+		reviews, loadErr = review.ListOpen(repo)
 		if !*listJSONOutput {
 			fmt.Printf("Loaded %d open reviews:\n", len(reviews))
 		}
@@ -54,12 +74,10 @@ func listReviews(repo repository.Repo, args []string) error {
 			return err
 		}
 		fmt.Println(string(b))
-		return nil
-	}
-	for _, r := range reviews {
-		output.PrintSummary(&r)
+		return loadErr
 	}
-	return nil
+	output.PrintStacks(reviews)
+	return loadErr
 }
 
 // listCmd defines the "list" subcommand.
@@ -68,7 +86,7 @@ var listCmd = &Command{
 		fmt.Printf("Usage: %s list [<option>...]\n\nOptions:\n", arg0)
 		listFlagSet.PrintDefaults()
 	},
-	RunMethod: func(repo repository.Repo, args []string) error {
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
 		return listReviews(repo, args)
 	},
 }
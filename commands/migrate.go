@@ -0,0 +1,83 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+)
+
+var migrateFlagSet = flag.NewFlagSet("migrate", flag.ExitOnError)
+
+var (
+	migrateDryRun = migrateFlagSet.Bool("n", false, "Only report the notes that would be rewritten, without changing anything")
+)
+
+// migrateNotes rewrites the review notes in the latest version of their formats.
+func migrateNotes(repo repository.Repo, args []string) error {
+	migrateFlagSet.Parse(args)
+	if len(migrateFlagSet.Args()) > 0 {
+		return errors.New("The migrate command does not take any arguments.")
+	}
+
+	migrations := review.PlanMigrations(repo)
+	rewritten := 0
+	for _, m := range migrations {
+		if m.Upgraded > 0 && !*migrateDryRun {
+			if err := m.Apply(repo); err != nil {
+				return fmt.Errorf("Failed to rewrite the notes in %q: %v", m.Ref, err)
+			}
+		}
+		rewritten += m.Upgraded
+		switch {
+		case m.Commit != "":
+			fmt.Printf("%s: rewrote %d note(s) in commit %s\n", m.Ref, m.Upgraded, m.Commit)
+		case m.Upgraded > 0:
+			fmt.Printf("%s: %d note(s) would be rewritten\n", m.Ref, m.Upgraded)
+		}
+		if m.Signed > 0 {
+			fmt.Printf("%s: left %d signed note(s) as-is, since rewriting them would invalidate their signatures\n", m.Ref, m.Signed)
+		}
+		if m.Referenced > 0 {
+			fmt.Printf("%s: left %d comment(s) as-is, since signed notes refer to them by their current hashes\n", m.Ref, m.Referenced)
+		}
+		if m.Unsupported > 0 {
+			fmt.Printf("%s: left %d note(s) as-is, since they use a newer format than this version of git-appraise supports\n", m.Ref, m.Unsupported)
+		}
+	}
+	if rewritten == 0 {
+		fmt.Println("All of the review notes are already in the latest format.")
+	} else if !*migrateDryRun {
+		fmt.Println("Review each rewrite using \"git show <commit>\" before pushing the notes.")
+	}
+	return nil
+}
+
+// migrateCmd defines the "migrate" subcommand.
+var migrateCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s migrate [<option>...]\n\nOptions:\n", arg0)
+		migrateFlagSet.PrintDefaults()
+	},
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
+		return migrateNotes(repo, args)
+	},
+}
@@ -20,9 +20,13 @@ package output
 import (
 	"fmt"
 	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -30,31 +34,80 @@ const (
 	reviewSummaryTemplate = `[%s] %.12s
   %s
 `
+	// Marker for the summary of a review that depends on the review above it.
+	stackedReviewMarker = "└── "
 	// Template for printing the summary of a code review.
 	reviewDetailsTemplate = `  %q -> %q
   reviewers: %q
   requester: %q
   build status: %s
+`
+	// Template for displaying the review that a review depends on
+	dependsOnTemplate = `  depends on: %.12s
+`
+	// Template for displaying the heading of the history of the review request
+	requestHistoryTemplate = `  history:
+`
+	// Template for displaying a single change to the review request
+	requestChangeTemplate = `    %s %s %s
+`
+	// Template for displaying the heading of the reviewers' votes
+	votesSummaryTemplate = `  votes:
+`
+	// Template for displaying the vote of a single reviewer
+	voteTemplate = `    %s: %s
+`
+	// Template for displaying the heading of the paths still awaiting an owner's approval
+	uncoveredPathsTemplate = `  awaiting owner approval:
+`
+	// Template for displaying a path awaiting approval, and its owners
+	uncoveredPathTemplate = `    %s (owners: %s)
+`
+	// Template for warning about notes that this version of the tool cannot read.
+	unsupportedTemplate = `  unsupported: %d note(s) use a newer format than this version of git-appraise supports
+`
+	// Template for printing who abandoned a review, and why.
+	abandonedTemplate = `  abandoned by %s at %s: %q
+`
+	// Template for printing the result of verifying the signature on the review request.
+	requestSignatureTemplate = `  signature: %s
 `
 	// Template for printing the location of an inline comment
-	commentLocationTemplate = `%s%q@%.12s
+	commentLocationTemplate = `%s%q@%.12s%s
 `
 	// Template for printing a single comment.
 	commentTemplate = `comment: %s
 author: %s
 time:   %s
 status: %s
-%s`
+%s%s`
+	// Template for marking a reply whose parent comment is missing.
+	commentOrphanedTemplate = `parent: %.12s (parent missing)
+`
+	// Template for printing the result of verifying the signature on a comment.
+	commentSignatureTemplate = `signature: %s
+`
 	// Template for displaying the summary of the comment threads for a review
 	commentSummaryTemplate = `  comments (%d threads):
 `
-	// Number of lines of context to print for inline comments
+	// Template for displaying the number of recorded revisions of a review
+	revisionsSummaryTemplate = `revisions (%d):
+`
+	// Template for displaying a single revision of a review
+	revisionTemplate = `  %d: %.12s (base %.12s)
+     author: %s
+     time:   %s
+`
+	// Number of lines to print for inline comments, including the first line commented upon
 	contextLineCount = 5
 )
 
 // getStatusString returns a human friendly string encapsulating both the review's
 // resolved status, and its submitted status.
 func getStatusString(r *review.Summary) string {
+	if r.Abandoned && !r.Submitted {
+		return "abandoned"
+	}
 	if r.Resolved == nil && r.Submitted {
 		return "tbr"
 	}
@@ -80,6 +133,27 @@ func PrintSummary(r *review.Summary) {
 	fmt.Printf(reviewSummaryTemplate, statusString, r.Revision, indentedDescription)
 }
 
+// PrintStacks prints a summary of each of the given reviews, showing the reviews
+// that depend on another review as a tree beneath that review.
+func PrintStacks(reviews []review.Summary) {
+	sorted, depths := review.SortIntoStacks(reviews)
+	for i := range sorted {
+		r := &sorted[i]
+		if depths[i] == 0 {
+			PrintSummary(r)
+			continue
+		}
+		indent := strings.Repeat("    ", depths[i]-1)
+		statusString := getStatusString(r)
+		summary := fmt.Sprintf(reviewSummaryTemplate, statusString, r.Revision, r.Request.Description)
+		lines := strings.Split(strings.TrimSuffix(summary, "\n"), "\n")
+		fmt.Println(indent + stackedReviewMarker + lines[0])
+		for _, line := range lines[1:] {
+			fmt.Println(indent + "    " + line)
+		}
+	}
+}
+
 // reformatTimestamp takes a timestamp string of the form "0123456789" and changes it
 // to the form "Mon Jan _2 13:04:05 UTC 2006".
 //
@@ -95,28 +169,108 @@ func reformatTimestamp(timestamp string) string {
 }
 
 // showThread prints the detailed output for an entire comment thread.
+//
+// If the comment has been anchored in the head commit of the review, then the
+// code is shown as of that commit. Otherwise, it is shown as of the commented
+// upon commit.
 func showThread(r *review.Review, thread review.CommentThread) error {
-	comment := thread.Comment
 	indent := "    "
-	if comment.Location != nil && comment.Location.Path != "" && comment.Location.Range != nil && comment.Location.Range.StartLine > 0 {
-		contents, err := r.Repo.Show(comment.Location.Commit, comment.Location.Path)
+	location, note := getDisplayLocation(thread)
+	if location != nil && location.Side == comment.SideBase {
+		note = " (base)" + note
+	}
+	if location != nil && location.Path != "" && location.Range != nil && location.Range.StartLine > 0 {
+		contents, err := r.Repo.Show(location.Commit, location.Path)
 		if err != nil {
 			return err
 		}
 		lines := strings.Split(contents, "\n")
-		if comment.Location.Range.StartLine <= uint32(len(lines)) {
-			var firstLine uint32
-			lastLine := comment.Location.Range.StartLine
-			if lastLine > contextLineCount {
-				firstLine = lastLine - contextLineCount
-			}
-			fmt.Printf(commentLocationTemplate, indent, comment.Location.Path, comment.Location.Commit)
-			fmt.Println(indent + "|" + strings.Join(lines[firstLine:lastLine], "\n"+indent+"|"))
+		if location.Range.StartLine <= uint32(len(lines)) {
+			fmt.Printf(commentLocationTemplate, indent, location.Path, location.Commit, note)
+			showRange(lines, *location.Range, indent)
 		}
 	}
 	return showSubThread(r, thread, indent)
 }
 
+// describeLines returns a human friendly description of the lines in the given range, such as "lines 10-12".
+func describeLines(commentRange *comment.Range) string {
+	if commentRange.LastLine() == commentRange.StartLine {
+		return fmt.Sprintf("line %d", commentRange.StartLine)
+	}
+	return fmt.Sprintf("lines %d-%d", commentRange.StartLine, commentRange.LastLine())
+}
+
+// getDisplayLocation returns the location at which to show the code discussed
+// by the given thread, along with a note describing how that location relates
+// to the one originally commented upon.
+func getDisplayLocation(thread review.CommentThread) (*comment.Location, string) {
+	original := thread.Comment.Location
+	anchor := thread.Anchor
+	if anchor == nil || original == nil {
+		return original, ""
+	}
+	if anchor.Outdated {
+		return original, " (outdated)"
+	}
+	current := anchor.Location
+	if current.Path != original.Path {
+		if original.Range == nil || original.Range.StartLine == 0 {
+			return current, fmt.Sprintf(" (moved from %q)", original.Path)
+		}
+		return current, fmt.Sprintf(" (moved from %s of %q)", describeLines(original.Range), original.Path)
+	}
+	if original.Range != nil && current.Range != nil && original.Range.StartLine > 0 && original.Range.StartLine != current.Range.StartLine {
+		return current, fmt.Sprintf(" (moved from %s)", describeLines(original.Range))
+	}
+	return current, ""
+}
+
+// showRange prints the lines within the given range, preceded by a few lines of context.
+//
+// Context lines are prefixed with "|", and lines within the range with ">". If
+// the range starts or ends part way through a line, then the part of each line
+// that is within the range is underlined with "^" characters.
+func showRange(lines []string, commentRange comment.Range, indent string) {
+	lastLine := commentRange.LastLine()
+	if lastLine > uint32(len(lines)) {
+		lastLine = uint32(len(lines))
+	}
+	var firstLine uint32
+	if commentRange.StartLine > contextLineCount {
+		firstLine = commentRange.StartLine - contextLineCount
+	}
+	for _, line := range lines[firstLine : commentRange.StartLine-1] {
+		fmt.Println(indent + "|" + line)
+	}
+	underline := commentRange.StartColumn != 0 || commentRange.EndColumn != 0
+	for lineNumber := commentRange.StartLine; lineNumber <= lastLine; lineNumber++ {
+		line := lines[lineNumber-1]
+		fmt.Println(indent + ">" + line)
+		if !underline {
+			continue
+		}
+		start, end := 0, len(line)
+		if lineNumber == commentRange.StartLine && commentRange.StartColumn > 0 {
+			start = int(commentRange.StartColumn) - 1
+		}
+		if lineNumber == lastLine && commentRange.EndColumn > 0 && int(commentRange.EndColumn) < end {
+			end = int(commentRange.EndColumn)
+		}
+		if start >= end {
+			continue
+		}
+		// Keep any tabs in the padding, so that the underline lines up with the text above it.
+		padding := strings.Map(func(r rune) rune {
+			if r == '\t' {
+				return r
+			}
+			return ' '
+		}, line[:start])
+		fmt.Println(indent + " " + padding + strings.Repeat("^", utf8.RuneCountInString(line[start:end])))
+	}
+}
+
 // showSubThread prints the given comment (sub)thread, indented by the given prefix string.
 func showSubThread(r *review.Review, thread review.CommentThread, indent string) error {
 	statusString := "fyi"
@@ -128,13 +282,31 @@ func showSubThread(r *review.Review, thread review.CommentThread, indent string)
 		}
 	}
 	comment := thread.Comment
-	threadHash, err := comment.Hash()
-	if err != nil {
-		return err
+	threadHash := thread.Hash
+	if threadHash == "" {
+		var err error
+		if threadHash, err = comment.Hash(); err != nil {
+			return err
+		}
+	}
+	description := comment.Description
+	if thread.Edit != nil {
+		threadHash += " (edited)"
+	}
+	if thread.Retracted {
+		description = "(retracted)"
 	}
 
 	timestamp := reformatTimestamp(comment.Timestamp)
-	commentSummary := fmt.Sprintf(indent+commentTemplate, threadHash, comment.Author, timestamp, statusString, comment.Description)
+	var annotations string
+	if thread.Orphaned {
+		annotations = fmt.Sprintf(commentOrphanedTemplate, comment.Parent)
+	}
+	// Signatures are only checked for reviews that contain signed notes.
+	if thread.Verification != "" {
+		annotations += fmt.Sprintf(commentSignatureTemplate, thread.Verification)
+	}
+	commentSummary := fmt.Sprintf(indent+commentTemplate, threadHash, comment.Author, timestamp, statusString, annotations, description)
 	indent = indent + "  "
 	indentedSummary := strings.Replace(commentSummary, "\n", "\n"+indent, -1)
 	fmt.Println(indentedSummary)
@@ -147,6 +319,97 @@ func showSubThread(r *review.Review, thread review.CommentThread, indent string)
 	return nil
 }
 
+// describeRequestChanges lists the ways in which a review request differs from the previous version.
+func describeRequestChanges(previous, current request.Request) []string {
+	var changes []string
+	var added, removed []string
+	for _, reviewer := range current.Reviewers {
+		if !containsString(previous.Reviewers, reviewer) {
+			added = append(added, reviewer)
+		}
+	}
+	for _, reviewer := range previous.Reviewers {
+		if !containsString(current.Reviewers, reviewer) {
+			removed = append(removed, reviewer)
+		}
+	}
+	if len(added) > 0 {
+		changes = append(changes, "added reviewers "+strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		changes = append(changes, "removed reviewers "+strings.Join(removed, ", "))
+	}
+	if current.Description != previous.Description {
+		changes = append(changes, "changed the description")
+	}
+	if current.TargetRef != previous.TargetRef {
+		changes = append(changes, fmt.Sprintf("retargeted from %q to %q", previous.TargetRef, current.TargetRef))
+	}
+	if len(changes) == 0 {
+		changes = append(changes, "updated the request")
+	}
+	return changes
+}
+
+// containsString determines if the given list contains the given string.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// printRequestHistory prints how the review request changed over time, if it was ever edited.
+func printRequestHistory(requests []request.Request) {
+	if len(requests) < 2 {
+		return
+	}
+	fmt.Print(requestHistoryTemplate)
+	fmt.Printf(requestChangeTemplate, reformatTimestamp(requests[0].Timestamp), requests[0].Author(), "requested the review")
+	for i := 1; i < len(requests); i++ {
+		changes := describeRequestChanges(requests[i-1], requests[i])
+		fmt.Printf(requestChangeTemplate, reformatTimestamp(requests[i].Timestamp), requests[i].Author(), strings.Join(changes, "; "))
+	}
+}
+
+// getVoteString returns a human friendly description of the given vote.
+func getVoteString(approved, voted bool) string {
+	if !voted {
+		return "pending"
+	}
+	if approved {
+		return "lgtm"
+	}
+	return "needs work"
+}
+
+// printVotes prints the vote of each reviewer listed in the request, followed
+// by the votes of anyone else who approved or rejected the review.
+func printVotes(r *review.Review) {
+	if len(r.Request.Reviewers) == 0 && len(r.Votes) == 0 {
+		return
+	}
+	fmt.Print(votesSummaryTemplate)
+	listed := make(map[string]bool)
+	for _, reviewer := range r.Request.Reviewers {
+		listed[reviewer] = true
+		approved, voted := r.Votes[reviewer]
+		fmt.Printf(voteTemplate, reviewer, getVoteString(approved, voted))
+	}
+	var others []string
+	for author := range r.Votes {
+		if !listed[author] {
+			others = append(others, author)
+		}
+	}
+	sort.Strings(others)
+	for _, author := range others {
+		fmt.Printf(voteTemplate, author, getVoteString(r.Votes[author], true))
+	}
+}
+
 // printAnalyses prints the static analysis results for the latest commit in the review.
 func printAnalyses(r *review.Review) {
 	fmt.Println("  analyses: ", r.GetAnalysesMessage())
@@ -170,6 +433,27 @@ func PrintDetails(r *review.Review) error {
 	fmt.Printf(reviewDetailsTemplate, r.Request.ReviewRef, r.Request.TargetRef,
 		strings.Join(r.Request.Reviewers, ", "),
 		r.Request.Requester, r.GetBuildStatusMessage())
+	if r.RequestVerification != "" {
+		fmt.Printf(requestSignatureTemplate, r.RequestVerification)
+	}
+	if r.Request.DependsOn != "" {
+		fmt.Printf(dependsOnTemplate, r.Request.DependsOn)
+	}
+	printRequestHistory(r.AllRequests)
+	printVotes(r)
+	if uncovered := r.GetUncoveredPaths(r.Votes); len(uncovered) > 0 {
+		fmt.Print(uncoveredPathsTemplate)
+		for _, filePath := range uncovered {
+			fmt.Printf(uncoveredPathTemplate, filePath, strings.Join(r.Owners[filePath], ", "))
+		}
+	}
+	if r.Unsupported > 0 {
+		fmt.Printf(unsupportedTemplate, r.Unsupported)
+	}
+	if r.Abandoned && len(r.StatusChanges) > 0 {
+		change := r.StatusChanges[len(r.StatusChanges)-1]
+		fmt.Printf(abandonedTemplate, change.Author, reformatTimestamp(change.Timestamp), change.Description)
+	}
 	printAnalyses(r)
 	if err := printComments(r); err != nil {
 		return err
@@ -187,6 +471,24 @@ func PrintJSON(r *review.Review) error {
 	return nil
 }
 
+// PrintRevisions prints the recorded revisions of the review.
+func PrintRevisions(r *review.Review) {
+	fmt.Printf(revisionsSummaryTemplate, len(r.Revisions))
+	for i, revision := range r.Revisions {
+		fmt.Printf(revisionTemplate, i+1, revision.Commit, revision.BaseCommit, revision.Author, reformatTimestamp(revision.Timestamp))
+	}
+}
+
+// PrintInterdiff prints the changes made between two revisions of the review.
+func PrintInterdiff(r *review.Review, from, to int, diffArgs ...string) error {
+	diff, err := r.GetInterdiff(from, to, diffArgs...)
+	if err != nil {
+		return err
+	}
+	fmt.Println(diff)
+	return nil
+}
+
 // PrintDiff prints the diff of the review.
 func PrintDiff(r *review.Review, diffArgs ...string) error {
 	diff, err := r.GetDiff(diffArgs...)
@@ -17,31 +17,123 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"os"
 )
 
-// pull updates the local git-notes used for reviews with those from a remote repo.
+var pullFlagSet = flag.NewFlagSet("pull", flag.ExitOnError)
+
+var (
+	pullAll             = pullFlagSet.Bool("all", false, "Pull from every remote configured using the \"appraise.remote\" setting")
+	pullRecordRevisions = pullFlagSet.Bool("record-revisions", false, "Record the latest commits of every open review as a new revision, if they changed")
+	pullAllowMalformed  = pullFlagSet.Bool("allow-malformed", false, "Keep pulled notes that contain malformed lines, rather than failing")
+)
+
+// pull updates the local git-notes used for reviews with those from one or more remote repos.
 func pull(repo repository.Repo, args []string) error {
+	pullFlagSet.Parse(args)
+	args = pullFlagSet.Args()
+
 	if len(args) > 1 {
-		return errors.New("Only pulling from one remote at a time is supported.")
+		return errors.New("Only pulling from one named remote at a time is supported.")
+	}
+	remotes, err := getRemotes(repo, *pullAll, args)
+	if err != nil {
+		return err
 	}
+	err = forEachRemote(remotes, func(remote string) error {
+		if err := pullNotes(repo, remote, *pullAllowMalformed); err != nil {
+			return err
+		}
+		return fetchReviewRefs(repo, remote)
+	})
+	if err != nil || !*pullRecordRevisions {
+		return err
+	}
+	return recordOpenRevisions(repo)
+}
 
-	remote := "origin"
-	if len(args) == 1 {
-		remote = args[0]
+// recordOpenRevisions records a new revision for every open review whose commits changed.
+func recordOpenRevisions(repo repository.Repo) error {
+	userEmail, err := repo.GetUserEmail()
+	if err != nil {
+		return err
+	}
+	reviews, err := review.ListOpen(repo)
+	if err != nil {
+		return err
+	}
+	for _, summary := range reviews {
+		r, err := summary.Details()
+		if err != nil {
+			return err
+		}
+		recorded, err := r.RecordRevision(userEmail)
+		if err != nil {
+			return fmt.Errorf("Failed to record a revision of the review %.12s: %v", r.Revision, err)
+		}
+		if recorded {
+			fmt.Printf("Recorded revision %d of the review %.12s\n", len(r.Revisions), r.Revision)
+		}
 	}
+	return nil
+}
 
-	repo.PullNotes(remote, notesRefPattern)
+// pullNotes pulls the review notes from the given remote repo, and merges them with the local ones.
+//
+// If any of the merged notes contain malformed lines, then the local notes are
+// left unchanged and an error is returned, unless allowMalformed is set. In that
+// case the malformed lines are kept, and a warning is printed for each of them.
+func pullNotes(repo repository.Repo, remote string, allowMalformed bool) error {
+	merge := &review.NotesMerge{AllowMalformed: allowMalformed}
+	if err := repo.PullNotes(remote, notesRefPattern, merge.Merge); err != nil {
+		if len(merge.Malformed) > 0 && !allowMalformed {
+			return fmt.Errorf("Failed to pull the reviews from the remote '%s':\n%v\nRerun with --allow-malformed to keep the malformed lines.", remote, err)
+		}
+		return fmt.Errorf("Failed to pull the reviews from the remote '%s':\n%v", remote, err)
+	}
+	for _, malformed := range merge.Malformed {
+		fmt.Fprintf(os.Stderr, "Warning: kept a malformed line in %s\n", malformed)
+	}
 	return nil
 }
 
+// fetchReviewRefs fetches the review refs of every open review from the given remote repo.
+//
+// This lets reviewers see the latest changes in a review without having to know
+// which branch they are on, or to fetch that branch themselves. The previously
+// fetched review refs of reviews that are no longer open are deleted, unless
+// some reviews failed to load, since those might still be open.
+func fetchReviewRefs(repo repository.Repo, remote string) error {
+	reviews, loadErr := review.ListOpen(repo)
+	reviewRefs := make(map[string]string)
+	var openReviews []string
+	for _, r := range reviews {
+		openReviews = append(openReviews, r.Revision)
+		if r.Request.ReviewRef != "" {
+			reviewRefs[r.Revision] = r.Request.ReviewRef
+		}
+	}
+	if err := repo.FetchReviewRefs(remote, reviewRefs); err != nil {
+		return err
+	}
+	if loadErr != nil {
+		return loadErr
+	}
+	return repo.PruneFetchedReviewRefs(openReviews)
+}
+
 var pullCmd = &Command{
 	Usage: func(arg0 string) {
-		fmt.Printf("Usage: %s pull [<remote>]\n", arg0)
+		fmt.Printf("Usage: %s pull [<option>...] [<remote>]\n\nOptions:\n", arg0)
+		pullFlagSet.PrintDefaults()
 	},
-	RunMethod: func(repo repository.Repo, args []string) error {
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
 		return pull(repo, args)
 	},
 }
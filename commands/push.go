@@ -17,30 +17,42 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/google/git-appraise/repository"
 )
 
-// push pushes the local git-notes used for reviews to a remote repo.
+var pushFlagSet = flag.NewFlagSet("push", flag.ExitOnError)
+
+var (
+	pushAll = pushFlagSet.Bool("all", false, "Push to every remote configured using the \"appraise.remote\" setting")
+)
+
+// push pushes the local git-notes used for reviews to one or more remote repos.
 func push(repo repository.Repo, args []string) error {
+	pushFlagSet.Parse(args)
+	args = pushFlagSet.Args()
+
 	if len(args) > 1 {
-		return errors.New("Only pushing to one remote at a time is supported.")
+		return errors.New("Only pushing to one named remote at a time is supported.")
 	}
-
-	remote := "origin"
-	if len(args) == 1 {
-		remote = args[0]
+	remotes, err := getRemotes(repo, *pushAll, args)
+	if err != nil {
+		return err
 	}
-
-	return repo.PushNotes(remote, notesRefPattern)
+	return forEachRemote(remotes, func(remote string) error {
+		return repo.PushNotes(remote, notesRefPattern)
+	})
 }
 
 var pushCmd = &Command{
 	Usage: func(arg0 string) {
-		fmt.Printf("Usage: %s push [<remote>]\n", arg0)
+		fmt.Printf("Usage: %s push [<option>...] [<remote>]\n\nOptions:\n", arg0)
+		pushFlagSet.PrintDefaults()
 	},
-	RunMethod: func(repo repository.Repo, args []string) error {
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
 		return push(repo, args)
 	},
 }
@@ -17,6 +17,7 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
@@ -30,6 +31,7 @@ var rejectFlagSet = flag.NewFlagSet("reject", flag.ExitOnError)
 
 var (
 	rejectMessage = rejectFlagSet.String("m", "", "Message to attach to the review")
+	rejectSign    = rejectFlagSet.Bool("S", false, "Sign the rejection using the configured signing key")
 )
 
 // rejectReview adds an NMW comment to the current code review.
@@ -44,7 +46,7 @@ func rejectReview(repo repository.Repo, args []string) error {
 	}
 
 	if len(args) == 1 {
-		r, err = review.Get(repo, args[0])
+		r, err = review.Resolve(repo, args[0])
 	} else {
 		r, err = review.GetCurrent(repo)
 	}
@@ -78,6 +80,9 @@ func rejectReview(repo repository.Repo, args []string) error {
 	c := comment.New(userEmail, *rejectMessage)
 	c.Location = &location
 	c.Resolved = &resolved
+	if err := signIfRequested(repo, *rejectSign, r.Revision, &c); err != nil {
+		return err
+	}
 	return r.AddComment(c)
 }
 
@@ -87,7 +92,7 @@ var rejectCmd = &Command{
 		fmt.Printf("Usage: %s reject [<option>...] [<commit>]\n\nOptions:\n", arg0)
 		rejectFlagSet.PrintDefaults()
 	},
-	RunMethod: func(repo repository.Repo, args []string) error {
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
 		return rejectReview(repo, args)
 	},
 }
@@ -0,0 +1,100 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/status"
+)
+
+var reopenFlagSet = flag.NewFlagSet("reopen", flag.ExitOnError)
+
+var (
+	reopenMessage = reopenFlagSet.String("m", "", "Message explaining why the review is reopened")
+)
+
+// getAbandonedForHead returns the abandoned review for the currently checked out ref.
+//
+// Abandoned reviews are not open, so they are never returned by review.GetCurrent.
+func getAbandonedForHead(repo repository.Repo) (*review.Review, error) {
+	reviewRef, err := repo.GetHeadRef()
+	if err != nil {
+		return nil, err
+	}
+	reviews, err := review.ListAll(repo)
+	if err != nil {
+		return nil, err
+	}
+	var matchingReviews []review.Summary
+	for _, summary := range reviews {
+		if summary.Abandoned && !summary.Submitted && summary.Request.ReviewRef == reviewRef {
+			matchingReviews = append(matchingReviews, summary)
+		}
+	}
+	if matchingReviews == nil {
+		return nil, nil
+	}
+	if len(matchingReviews) != 1 {
+		return nil, fmt.Errorf("There are %d abandoned reviews for the ref \"%s\"", len(matchingReviews), reviewRef)
+	}
+	return matchingReviews[0].Details()
+}
+
+// reopenReview reopens an abandoned code review.
+func reopenReview(repo repository.Repo, args []string) error {
+	reopenFlagSet.Parse(args)
+	args = reopenFlagSet.Args()
+
+	var r *review.Review
+	var err error
+	if len(args) > 1 {
+		return errors.New("Only reopening a single review is supported.")
+	}
+
+	if len(args) == 1 {
+		r, err = review.Resolve(repo, args[0])
+	} else {
+		r, err = getAbandonedForHead(repo)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to load the review: %v\n", err)
+	}
+	if r == nil {
+		return errors.New("There is no matching review.")
+	}
+	if !r.Abandoned {
+		return errors.New("The review has not been abandoned.")
+	}
+	return changeReviewStatus(repo, r, status.StateOpen, *reopenMessage)
+}
+
+// reopenCmd defines the "reopen" subcommand.
+var reopenCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s reopen [<option>...] [<review-hash>]\n\nOptions:\n", arg0)
+		reopenFlagSet.PrintDefaults()
+	},
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
+		return reopenReview(repo, args)
+	},
+}
@@ -17,10 +17,12 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
 	"github.com/google/git-appraise/review/request"
 	"strings"
 )
@@ -42,8 +44,55 @@ var (
 	requestTarget           = requestFlagSet.String("target", "refs/heads/master", "Revision against which to review")
 	requestQuiet            = requestFlagSet.Bool("quiet", false, "Suppress review summary output")
 	requestAllowUncommitted = requestFlagSet.Bool("allow-uncommitted", false, "Allow uncommitted local changes.")
+	requestSign             = requestFlagSet.Bool("S", false, "Sign the request using the configured signing key")
+	requestDependsOn        = requestFlagSet.String("depends-on", "", "Review that this review is stacked on top of; defaults to the open review of the target ref, if any")
 )
 
+// isFlagSet determines if the given flag was explicitly passed on the command line.
+func isFlagSet(flagSet *flag.FlagSet, name string) bool {
+	found := false
+	flagSet.Visit(func(f *flag.Flag) {
+		found = found || f.Name == name
+	})
+	return found
+}
+
+// findParentReview returns the review that a new review request should depend on, if any.
+//
+// This is the review given by the "depends-on" flag, if set, and otherwise the
+// open review whose review ref is the target of the request, if there is exactly one.
+func findParentReview(repo repository.Repo, targetRef string) (*review.Summary, error) {
+	if *requestDependsOn != "" {
+		parent, err := review.Resolve(repo, *requestDependsOn)
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil {
+			return nil, fmt.Errorf("There is no review matching %q.", *requestDependsOn)
+		}
+		if parent.Submitted {
+			return nil, errors.New("The review to depend on has already been submitted.")
+		}
+		return parent.Summary, nil
+	}
+	openReviews, err := review.ListOpen(repo)
+	if err != nil {
+		return nil, err
+	}
+	var parent *review.Summary
+	for i, r := range openReviews {
+		if r.Request.ReviewRef != targetRef {
+			continue
+		}
+		if parent != nil {
+			// It is ambiguous which review the new review depends on.
+			return nil, nil
+		}
+		parent = &openReviews[i]
+	}
+	return parent, nil
+}
+
 // Build the template review request based solely on the parsed flag values.
 func buildRequestFromFlags(requester string) request.Request {
 	var reviewers []string
@@ -56,6 +105,19 @@ func buildRequestFromFlags(requester string) request.Request {
 	return request.New(requester, reviewers, *requestSource, *requestTarget, *requestMessage)
 }
 
+// recordRevision records the current state of the given review as a new revision, if it changed.
+func recordRevision(repo repository.Repo, revision, author string) error {
+	r, err := review.Get(repo, revision)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return fmt.Errorf("Unable to find the review for %q", revision)
+	}
+	_, err = r.RecordRevision(author)
+	return err
+}
+
 // Create a new code review request.
 //
 // The "args" parameter is all of the command line arguments that followed the subcommand.
@@ -86,6 +148,19 @@ func requestReview(repo repository.Repo, args []string) error {
 		}
 		r.ReviewRef = headRef
 	}
+	if *requestDependsOn != "" || isFlagSet(requestFlagSet, "target") {
+		parent, err := findParentReview(repo, r.TargetRef)
+		if err != nil {
+			return err
+		}
+		if parent != nil {
+			r.DependsOn = parent.Revision
+			if !isFlagSet(requestFlagSet, "target") && parent.Request.ReviewRef != "" {
+				// Stacked reviews target the branch of the review they depend on.
+				r.TargetRef = parent.Request.ReviewRef
+			}
+		}
+	}
 	if err := repo.VerifyGitRef(r.TargetRef); err != nil {
 		return err
 	}
@@ -114,11 +189,31 @@ func requestReview(repo repository.Repo, args []string) error {
 		r.Description = description
 	}
 
+	// Suggesting reviewers is best-effort, so failing to look up the owners is not an error.
+	if owners, err := review.GetOwners(repo, r.TargetRef, base, r.ReviewRef); err == nil {
+		if suggested := review.SuggestReviewers(owners, r.Requester, r.Reviewers); len(suggested) > 0 {
+			if len(r.Reviewers) == 0 {
+				r.Reviewers = suggested
+				if !*requestQuiet {
+					fmt.Printf("Adding reviewers from the OWNERS files: %s\n", strings.Join(suggested, ", "))
+				}
+			} else if !*requestQuiet {
+				fmt.Printf("Suggested owners to add as reviewers: %s\n", strings.Join(suggested, ", "))
+			}
+		}
+	}
+
+	if err := signIfRequested(repo, *requestSign, reviewCommits[0], &r); err != nil {
+		return err
+	}
 	note, err := r.Write()
 	if err != nil {
 		return err
 	}
 	repo.AppendNote(request.Ref, reviewCommits[0], note)
+	if err := recordRevision(repo, reviewCommits[0], userEmail); err != nil {
+		return err
+	}
 	if !*requestQuiet {
 		fmt.Printf(requestSummaryTemplate, reviewCommits[0], r.TargetRef, r.ReviewRef, r.Description)
 	}
@@ -131,7 +226,7 @@ var requestCmd = &Command{
 		fmt.Printf("Usage: %s request [<option>...]\n\nOptions:\n", arg0)
 		requestFlagSet.PrintDefaults()
 	},
-	RunMethod: func(repo repository.Repo, args []string) error {
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
 		return requestReview(repo, args)
 	},
 }
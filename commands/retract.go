@@ -0,0 +1,82 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/comment"
+)
+
+var retractFlagSet = flag.NewFlagSet("retract", flag.ExitOnError)
+
+var (
+	retractSign = retractFlagSet.Bool("S", false, "Sign the retraction using the configured signing key")
+)
+
+// retractComment withdraws one of the current user's comments on the current code review.
+func retractComment(repo repository.Repo, args []string) error {
+	retractFlagSet.Parse(args)
+	args = retractFlagSet.Args()
+
+	var r *review.Review
+	var err error
+	if len(args) < 1 {
+		return errors.New("The hash of the comment to retract is required.")
+	}
+	if len(args) > 2 {
+		return errors.New("Only retracting a comment on a single review is supported.")
+	}
+
+	if len(args) == 2 {
+		r, err = review.Resolve(repo, args[1])
+	} else {
+		r, err = review.GetCurrent(repo)
+	}
+
+	if err != nil {
+		return fmt.Errorf("Failed to load the review: %v\n", err)
+	}
+	if r == nil {
+		return errors.New("There is no matching review.")
+	}
+
+	thread, userEmail, err := findOwnComment(repo, r, args[0])
+	if err != nil {
+		return err
+	}
+	c := comment.NewRetraction(userEmail, thread.Hash)
+	if err := signIfRequested(repo, *retractSign, r.Revision, &c); err != nil {
+		return err
+	}
+	return r.AddComment(c)
+}
+
+// retractCmd defines the "retract" subcommand.
+var retractCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s retract [<option>...] <comment-hash> [<review-hash>]\n\nOptions:\n", arg0)
+		retractFlagSet.PrintDefaults()
+	},
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
+		return retractComment(repo, args)
+	},
+}
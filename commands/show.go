@@ -17,12 +17,15 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/google/git-appraise/commands/output"
 	"github.com/google/git-appraise/repository"
 	"github.com/google/git-appraise/review"
+	"io"
+	"os"
 	"strings"
 )
 
@@ -32,6 +35,9 @@ var (
 	showJSONOutput  = showFlagSet.Bool("json", false, "Format the output as JSON")
 	showDiffOutput  = showFlagSet.Bool("diff", false, "Show the current diff for the review")
 	showDiffOptions = showFlagSet.String("diff-opts", "", "Options to pass to the diff tool; can only be used with the --diff option")
+	showRevisions   = showFlagSet.Bool("revisions", false, "List the recorded revisions of the review")
+	showDiffFrom    = showFlagSet.Int("from", -1, "Revision to diff from, where 0 is the base of the --to revision; can only be used with the --diff option")
+	showDiffTo      = showFlagSet.Int("to", -1, "Revision to diff to, which defaults to the latest revision; can only be used with the --diff option")
 )
 
 // showReview prints the current code review.
@@ -41,6 +47,10 @@ func showReview(repo repository.Repo, args []string) error {
 	if *showDiffOptions != "" && !*showDiffOutput {
 		return errors.New("The --diff-opts flag can only be used if the --diff flag is set.")
 	}
+	interdiff := *showDiffFrom >= 0 || *showDiffTo >= 0
+	if interdiff && !*showDiffOutput {
+		return errors.New("The --from and --to flags can only be used if the --diff flag is set.")
+	}
 
 	var r *review.Review
 	var err error
@@ -49,7 +59,7 @@ func showReview(repo repository.Repo, args []string) error {
 	}
 
 	if len(args) == 1 {
-		r, err = review.Get(repo, args[0])
+		r, err = review.Resolve(repo, args[0])
 	} else {
 		r, err = review.GetCurrent(repo)
 	}
@@ -60,26 +70,62 @@ func showReview(repo repository.Repo, args []string) error {
 	if r == nil {
 		return errors.New("There is no matching review.")
 	}
+	if r.HasSignatures() {
+		r.VerifySignatures()
+	}
 	if *showJSONOutput {
+		loadDetails(r, os.Stderr)
 		return output.PrintJSON(r)
 	}
+	if *showRevisions {
+		output.PrintRevisions(r)
+		return nil
+	}
 	if *showDiffOutput {
 		var diffArgs []string
 		if *showDiffOptions != "" {
 			diffArgs = strings.Split(*showDiffOptions, ",")
 		}
+		if interdiff {
+			to := *showDiffTo
+			if to < 0 {
+				to = len(r.Revisions)
+			}
+			from := *showDiffFrom
+			if from < 0 {
+				from = to - 1
+			}
+			return output.PrintInterdiff(r, from, to, diffArgs...)
+		}
 		return output.PrintDiff(r, diffArgs...)
 	}
+	loadDetails(r, os.Stderr)
 	return output.PrintDetails(r)
 }
 
+// loadDetails locates the comments of the review in its current commits, and
+// looks up the owners of the paths that it changes.
+//
+// Neither is needed to show the review, so failures are written to the given
+// writer as warnings: comments that cannot be located (for instance, because the
+// repo does not support computing diffs) are shown at their original locations,
+// and the owners are not shown if they cannot be looked up.
+func loadDetails(r *review.Review, w io.Writer) {
+	if err := r.AnchorComments(); err != nil {
+		fmt.Fprintf(w, "Warning: unable to locate the comments in the current commits of the review: %v\n", err)
+	}
+	if err := r.LoadOwners(); err != nil {
+		fmt.Fprintf(w, "Warning: unable to look up the owners of the paths changed by the review: %v\n", err)
+	}
+}
+
 // showCmd defines the "show" subcommand.
 var showCmd = &Command{
 	Usage: func(arg0 string) {
 		fmt.Printf("Usage: %s show [<option>...] [<commit>]\n\nOptions:\n", arg0)
 		showFlagSet.PrintDefaults()
 	},
-	RunMethod: func(repo repository.Repo, args []string) error {
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
 		return showReview(repo, args)
 	},
 }
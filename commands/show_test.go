@@ -0,0 +1,44 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"strings"
+	"testing"
+)
+
+func TestLoadDetails(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	r, err := review.Get(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var warnings bytes.Buffer
+	loadDetails(r, &warnings)
+	if warnings.Len() != 0 {
+		t.Fatalf("Unexpected warnings: %q", warnings.String())
+	}
+
+	r.Request.TargetRef = "refs/heads/missing"
+	loadDetails(r, &warnings)
+	if !strings.Contains(warnings.String(), "unable to look up the owners") {
+		t.Fatalf("Failed to report the missing target ref: %q", warnings.String())
+	}
+}
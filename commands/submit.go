@@ -17,11 +17,14 @@ limitations under the License.
 package commands
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/google/git-appraise/repository"
 	"github.com/google/git-appraise/review"
+	"strconv"
+	"strings"
 )
 
 var submitFlagSet = flag.NewFlagSet("submit", flag.ExitOnError)
@@ -33,6 +36,24 @@ var (
 	submitTBR         = submitFlagSet.Bool("tbr", false, "(To be reviewed) Force the submission of a review that has not been accepted.")
 )
 
+// loadApprovalPolicy reads the approvals needed to submit a review from the git config.
+func loadApprovalPolicy(repo repository.Repo) (review.Policy, error) {
+	var policy review.Policy
+	if value, err := repo.GetConfig(requiredApprovalsConfig); err != nil {
+		return policy, err
+	} else if value != "" {
+		if policy.RequiredApprovals, err = strconv.Atoi(value); err != nil || policy.RequiredApprovals < 0 {
+			return policy, fmt.Errorf("Invalid value %q for the %q setting; expected a non-negative number.", value, requiredApprovalsConfig)
+		}
+	}
+	requireReviewers, err := getBoolConfig(repo, requireReviewerApprovalConfig)
+	if err != nil {
+		return policy, err
+	}
+	policy.RequireReviewers = requireReviewers
+	return policy, nil
+}
+
 // Submit the current code review request.
 //
 // The "args" parameter contains all of the command line arguments that followed the subcommand.
@@ -50,7 +71,7 @@ func submitReview(repo repository.Repo, args []string) error {
 		return errors.New("Only accepting a single review is supported.")
 	}
 	if len(args) == 1 {
-		r, err = review.Get(repo, args[0])
+		r, err = review.Resolve(repo, args[0])
 	} else {
 		r, err = review.GetCurrent(repo)
 	}
@@ -65,10 +86,59 @@ func submitReview(repo repository.Repo, args []string) error {
 	if r.Submitted {
 		return errors.New("The review has already been submitted.")
 	}
+	if r.Abandoned {
+		return errors.New("The review has been abandoned. Reopen it before submitting it.")
+	}
+
+	ancestors, err := r.GetUnsubmittedAncestors()
+	if err != nil {
+		return err
+	}
+	if len(ancestors) > 0 {
+		var hashes []string
+		for _, ancestor := range ancestors {
+			hashes = append(hashes, ancestor.Revision[:12])
+		}
+		return fmt.Errorf("Not submitting as the review depends on unsubmitted reviews. Submit them first, in this order: %s", strings.Join(hashes, ", "))
+	}
+	if parent, err := r.GetParent(); err == nil && parent != nil && parent.Request.ReviewRef == r.Request.TargetRef {
+		outcome := "was submitted to"
+		if !parent.Submitted {
+			outcome = "was abandoned, so it will not be submitted to"
+		}
+		return fmt.Errorf("The review that this review depends on %s %q. Use \"edit -retarget %s\" to target the same ref.", outcome, parent.Request.TargetRef, parent.Request.TargetRef)
+	}
 
 	if !*submitTBR && (r.Resolved == nil || !*r.Resolved) {
 		return errors.New("Not submitting as the review has not yet been accepted.")
 	}
+	requireSigned, err := getBoolConfig(repo, requireSignedApprovalsConfig)
+	if err != nil {
+		return err
+	}
+	votes := r.Votes
+	if !*submitTBR && requireSigned {
+		r.VerifySignatures()
+		if resolved := r.GetVerifiedResolved(); resolved == nil || !*resolved {
+			return errors.New("Not submitting as the review has not been accepted by any approvals with verified signatures.")
+		}
+		votes = r.GetVerifiedVotes()
+	}
+	if !*submitTBR {
+		policy, err := loadApprovalPolicy(repo)
+		if err != nil {
+			return err
+		}
+		if err := policy.Check(r.Summary, votes); err != nil {
+			return err
+		}
+		if err := r.LoadOwners(); err != nil {
+			return fmt.Errorf("Failed to look up the owners of the changed paths: %v", err)
+		}
+		if uncovered := r.GetUncoveredPaths(votes); len(uncovered) > 0 {
+			return fmt.Errorf("Not submitting as these paths have not been approved by any of their owners:\n  %s", strings.Join(uncovered, "\n  "))
+		}
+	}
 
 	target := r.Request.TargetRef
 	if err := repo.VerifyGitRef(target); err != nil {
@@ -123,7 +193,7 @@ var submitCmd = &Command{
 		fmt.Printf("Usage: %s submit [<option>...]\n\nOptions:\n", arg0)
 		submitFlagSet.PrintDefaults()
 	},
-	RunMethod: func(repo repository.Repo, args []string) error {
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
 		return submitReview(repo, args)
 	},
 }
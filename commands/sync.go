@@ -0,0 +1,179 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/analyses"
+	"github.com/google/git-appraise/review/ci"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-appraise/review/revision"
+	"github.com/google/git-appraise/review/status"
+	"strings"
+)
+
+var syncFlagSet = flag.NewFlagSet("sync", flag.ExitOnError)
+
+var (
+	syncAll            = syncFlagSet.Bool("all", false, "Sync with every remote configured using the \"appraise.remote\" setting")
+	syncAttempts       = syncFlagSet.Int("attempts", 3, "Maximum number of times to try pushing before giving up")
+	syncAllowMalformed = syncFlagSet.Bool("allow-malformed", false, "Keep pulled notes that contain malformed lines, rather than failing")
+)
+
+// syncedNotes describes each of the kinds of notes that sync reports on.
+//
+// Reviews are counted by the revisions that they annotate, so that updates to
+// an existing review request are not reported as new reviews. Everything else
+// is counted by the individual notes.
+var syncedNotes = []struct {
+	ref         string
+	noun        string
+	perRevision bool
+}{
+	{request.Ref, "review", true},
+	{comment.Ref, "comment", false},
+	{ci.Ref, "CI report", false},
+	{analyses.Ref, "analysis report", false},
+	{revision.Ref, "revision", false},
+	{status.Ref, "status change", false},
+}
+
+// readNoteKeys returns the set of keys identifying the notes in the given ref.
+func readNoteKeys(repo repository.Repo, notesRef string, perRevision bool) map[string]bool {
+	keys := make(map[string]bool)
+	for _, revision := range repo.ListNotedRevisions(notesRef) {
+		if perRevision {
+			keys[revision] = true
+			continue
+		}
+		for _, note := range repo.GetNotes(notesRef, revision) {
+			note = repository.Note(strings.TrimSpace(string(note)))
+			if len(note) > 0 {
+				keys[fmt.Sprintf("%s:%x", revision, sha1.Sum(note))] = true
+			}
+		}
+	}
+	return keys
+}
+
+// countNew returns the number of keys in the first set that are missing from the second.
+func countNew(keys, existing map[string]bool) int {
+	count := 0
+	for key := range keys {
+		if !existing[key] {
+			count++
+		}
+	}
+	return count
+}
+
+// describeCounts formats the given numbers of new notes, such as "3 new comments, 1 new review".
+func describeCounts(counts []int) string {
+	var descriptions []string
+	for i, count := range counts {
+		if count == 0 {
+			continue
+		}
+		noun := syncedNotes[i].noun
+		if count > 1 {
+			noun += "s"
+		}
+		descriptions = append(descriptions, fmt.Sprintf("%d new %s", count, noun))
+	}
+	if len(descriptions) == 0 {
+		return "nothing new"
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// syncReviews syncs the review notes with one or more remote repos.
+func syncReviews(ctx context.Context, repo repository.Repo, args []string) error {
+	syncFlagSet.Parse(args)
+	args = syncFlagSet.Args()
+
+	if len(args) > 1 {
+		return errors.New("Only syncing with one named remote at a time is supported.")
+	}
+	if *syncAttempts < 1 {
+		return errors.New("The number of attempts must be at least 1.")
+	}
+	remotes, err := getRemotes(repo, *syncAll, args)
+	if err != nil {
+		return err
+	}
+	return forEachRemote(remotes, func(remote string) error {
+		return syncWithRemote(ctx, repo, remote, *syncAttempts, *syncAllowMalformed)
+	})
+}
+
+// syncWithRemote pulls the review notes from a remote repo, merges them with the
+// local notes, and then pushes the result back to that remote.
+//
+// If someone else pushes to the remote in the meantime, then the whole process
+// is retried, up to the given number of attempts. Malformed lines in the pulled
+// notes make it fail before pushing anything, unless allowMalformed is set.
+func syncWithRemote(ctx context.Context, repo repository.Repo, remote string, attempts int, allowMalformed bool) error {
+	localBefore := make([]map[string]bool, len(syncedNotes))
+	for i, notes := range syncedNotes {
+		localBefore[i] = readNoteKeys(repo, notes.ref, notes.perRevision)
+	}
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := pullNotes(repo, remote, allowMalformed); err != nil {
+			return err
+		}
+		received := make([]int, len(syncedNotes))
+		sent := make([]int, len(syncedNotes))
+		for i, notes := range syncedNotes {
+			remoteKeys := readNoteKeys(repo, repository.GetRemoteNotesRef(remote, notes.ref), notes.perRevision)
+			localKeys := readNoteKeys(repo, notes.ref, notes.perRevision)
+			received[i] = countNew(remoteKeys, localBefore[i])
+			sent[i] = countNew(localKeys, remoteKeys)
+		}
+
+		err := repo.PushNotesWithLease(remote, notesRefPattern)
+		if err == repository.ErrNotesPushRejected {
+			fmt.Printf("The remote '%s' changed while syncing (attempt %d of %d)\n", remote, attempt, attempts)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Received from '%s': %s\n", remote, describeCounts(received))
+		fmt.Printf("Sent to '%s': %s\n", remote, describeCounts(sent))
+		return fetchReviewRefs(repo, remote)
+	}
+	return fmt.Errorf("Failed to sync with the remote '%s' after %d attempts: %v", remote, attempts, repository.ErrNotesPushRejected)
+}
+
+var syncCmd = &Command{
+	Usage: func(arg0 string) {
+		fmt.Printf("Usage: %s sync [<option>...] [<remote>]\n\nOptions:\n", arg0)
+		syncFlagSet.PrintDefaults()
+	},
+	RunMethod: func(ctx context.Context, repo repository.Repo, args []string) error {
+		return syncReviews(ctx, repo, args)
+	},
+}
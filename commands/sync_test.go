@@ -0,0 +1,198 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package commands
+
+import (
+	"bytes"
+	"context"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review"
+	"github.com/google/git-appraise/review/comment"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// runGit runs the git command line tool in the given directory, and returns its trimmed output.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// cloneTestRemote clones the given remote repo into a new directory under the given one.
+func cloneTestRemote(t *testing.T, dir, remote, name string) (string, repository.Repo) {
+	t.Helper()
+	clone := filepath.Join(dir, name)
+	runGit(t, dir, "clone", "-q", remote, clone)
+	runGit(t, clone, "config", "user.name", name)
+	runGit(t, clone, "config", "user.email", name+"@example.com")
+	repo, err := repository.NewGitRepo(clone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clone, repo
+}
+
+// addTestComment appends a comment with the given description to the notes of the given commit.
+func addTestComment(t *testing.T, repo repository.Repo, commit, author, description string) {
+	t.Helper()
+	note, err := comment.New(author, description).Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(comment.Ref, commit, note); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// commentDescriptions returns the sorted descriptions of the comments on the given commit.
+func commentDescriptions(repo repository.Repo, commit string) []string {
+	var descriptions []string
+	for _, c := range comment.ParseAllValid(repo.GetNotes(comment.Ref, commit)) {
+		descriptions = append(descriptions, c.Description)
+	}
+	sort.Strings(descriptions)
+	return descriptions
+}
+
+// captureStdout returns everything written to the standard output while running the given function.
+func captureStdout(t *testing.T, f func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	output := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		output <- buf.String()
+	}()
+	err = f()
+	os.Stdout = stdout
+	w.Close()
+	return <-output, err
+}
+
+// racingRepo runs the given function just before its first push, as if someone
+// else had pushed to the remote while it was syncing.
+type racingRepo struct {
+	repository.Repo
+	race       func()
+	pushErrors []error
+}
+
+func (r *racingRepo) PushNotesWithLease(remote, notesRefPattern string) error {
+	if r.race != nil {
+		r.race()
+		r.race = nil
+	}
+	err := r.Repo.PushNotesWithLease(remote, notesRefPattern)
+	r.pushErrors = append(r.pushErrors, err)
+	return err
+}
+
+func TestSyncWithRemoteRetriesAfterConcurrentPush(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("The git command line tool is not installed")
+	}
+	dir, err := ioutil.TempDir("", "git-appraise-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	remote := filepath.Join(dir, "remote.git")
+	runGit(t, dir, "init", "-q", "--bare", remote)
+	aliceDir, aliceRepo := cloneTestRemote(t, dir, remote, "alice")
+	if err := ioutil.WriteFile(filepath.Join(aliceDir, "README"), []byte("base\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, aliceDir, "add", "README")
+	runGit(t, aliceDir, "commit", "-q", "-m", "Base commit")
+	runGit(t, aliceDir, "push", "-q", "origin", "HEAD")
+	commit := runGit(t, aliceDir, "rev-parse", "HEAD")
+	_, bobRepo := cloneTestRemote(t, dir, remote, "bob")
+
+	// The first sync creates the remote notes, so that later leases are taken against them.
+	addTestComment(t, aliceRepo, commit, "alice", "first")
+	out, err := captureStdout(t, func() error {
+		return syncWithRemote(context.Background(), aliceRepo, "origin", 3, false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "Received from 'origin': nothing new") || !strings.Contains(out, "Sent to 'origin': 1 new comment\n") {
+		t.Fatalf("Unexpected output from the first sync:\n%s", out)
+	}
+	if err := bobRepo.PullNotes("origin", notesRefPattern, review.MergeNotes); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob pushes a comment between Alice's pull and her push, so her lease is stale.
+	addTestComment(t, aliceRepo, commit, "alice", "second")
+	addTestComment(t, bobRepo, commit, "bob", "third")
+	racing := &racingRepo{
+		Repo: aliceRepo,
+		race: func() {
+			if err := bobRepo.PushNotesWithLease("origin", notesRefPattern); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	out, err = captureStdout(t, func() error {
+		return syncWithRemote(context.Background(), racing, "origin", 3, false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(racing.pushErrors) != 2 || racing.pushErrors[0] != repository.ErrNotesPushRejected || racing.pushErrors[1] != nil {
+		t.Fatalf("Unexpected push results: %v", racing.pushErrors)
+	}
+	if !strings.Contains(out, "The remote 'origin' changed while syncing (attempt 1 of 3)") {
+		t.Fatalf("The sync did not report the retry:\n%s", out)
+	}
+	if !strings.Contains(out, "Received from 'origin': 1 new comment\n") || !strings.Contains(out, "Sent to 'origin': 1 new comment\n") {
+		t.Fatalf("Unexpected counts from the retried sync:\n%s", out)
+	}
+
+	// Both clones converge on every comment once Bob pulls again.
+	if err := bobRepo.PullNotes("origin", notesRefPattern, review.MergeNotes); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"first", "second", "third"}
+	for name, repo := range map[string]repository.Repo{"alice": aliceRepo, "bob": bobRepo} {
+		if descriptions := commentDescriptions(repo, commit); strings.Join(descriptions, ",") != strings.Join(expected, ",") {
+			t.Errorf("Unexpected comments in %s's clone: %v", name, descriptions)
+		}
+	}
+	if notes, remoteNotes := runGit(t, aliceDir, "rev-parse", comment.Ref), runGit(t, remote, "rev-parse", comment.Ref); notes != remoteNotes {
+		t.Errorf("The remote notes %s differ from the synced notes %s", remoteNotes, notes)
+	}
+}
@@ -26,10 +26,12 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/google/git-appraise/commands"
 	"github.com/google/git-appraise/repository"
 	"os"
+	"os/signal"
 	"sort"
 	"strings"
 )
@@ -77,18 +79,25 @@ func main() {
 		fmt.Printf("Unable to get the current working directory: %q\n", err)
 		return
 	}
-	repo, err := repository.NewGitRepo(cwd)
+	repo, err := repository.NewRepo(cwd)
 	if err != nil {
 		fmt.Printf("%s must be run from within a git repo.\n", os.Args[0])
 		return
 	}
+	// The first Ctrl-C cancels the command, which kills any git processes it is
+	// waiting on. After that, the default behavior of exiting immediately is restored.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 	if len(os.Args) < 2 {
 		subcommand, ok := commands.CommandMap["list"]
 		if !ok {
 			fmt.Printf("Unable to list reviews")
 			return
 		}
-		subcommand.Run(repo, []string{})
+		subcommand.Run(ctx, repo, []string{})
 		return
 	}
 	subcommand, ok := commands.CommandMap[os.Args[1]]
@@ -97,7 +106,7 @@ func main() {
 		usage()
 		return
 	}
-	if err := subcommand.Run(repo, os.Args[2:]); err != nil {
+	if err := subcommand.Run(ctx, repo, os.Args[2:]); err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
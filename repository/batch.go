@@ -0,0 +1,403 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// objectInfo represents the header that "git cat-file --batch[-check]" prints for an object.
+type objectInfo struct {
+	Hash string
+	Type string
+	Size int64
+}
+
+// catFileProcess wraps a long-lived "git cat-file" process.
+//
+// Requests are written one per line to the process' stdin, and the corresponding
+// responses are read back from its stdout. The mutex serializes those exchanges,
+// so a single process can be shared by concurrent callers.
+type catFileProcess struct {
+	mu     sync.Mutex
+	ctx    context.Context
+	path   string
+	mode   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// start launches the underlying git process if it is not already running.
+//
+// The caller must hold the mutex.
+func (p *catFileProcess) start() error {
+	if p.cmd != nil {
+		return nil
+	}
+	cmd := exec.CommandContext(p.ctx, "git", "cat-file", p.mode)
+	cmd.Dir = p.path
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd = cmd
+	p.stdin = stdin
+	p.stdout = bufio.NewReader(stdout)
+	return nil
+}
+
+// stop terminates the underlying git process, if there is one.
+//
+// The caller must hold the mutex.
+func (p *catFileProcess) stop() error {
+	if p.cmd == nil {
+		return nil
+	}
+	p.stdin.Close()
+	err := p.cmd.Wait()
+	p.cmd = nil
+	p.stdin = nil
+	p.stdout = nil
+	return err
+}
+
+// Close terminates the underlying git process.
+//
+// The process will be transparently restarted by the next request.
+func (p *catFileProcess) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stop()
+}
+
+// readHeader reads a single response header line for the requested object name.
+//
+// If the object does not exist, then the returned objectInfo is nil.
+func (p *catFileProcess) readHeader(name string) (*objectInfo, error) {
+	line, err := p.stdout.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if strings.HasSuffix(line, " missing") || strings.HasSuffix(line, " ambiguous") {
+		return nil, nil
+	}
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("Unexpected output from git cat-file for %q: %q", name, line)
+	}
+	size, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Unexpected object size from git cat-file for %q: %q", name, line)
+	}
+	return &objectInfo{
+		Hash: parts[0],
+		Type: parts[1],
+		Size: size,
+	}, nil
+}
+
+// request sends the given object names to the process and invokes the given
+// handler to read the responses. Any failure to communicate with the process causes
+// it to be stopped so that the next request starts with a clean slate.
+func (p *catFileProcess) request(names []string, handle func() error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.start(); err != nil {
+		return err
+	}
+	// The names are written from a separate goroutine so that a large batch
+	// cannot deadlock by filling up the pipe buffers in both directions.
+	writeErrs := make(chan error, 1)
+	go func() {
+		var buffer bytes.Buffer
+		for _, name := range names {
+			buffer.WriteString(name)
+			buffer.WriteByte('\n')
+		}
+		_, err := p.stdin.Write(buffer.Bytes())
+		writeErrs <- err
+	}()
+	err := handle()
+	if writeErr := <-writeErrs; err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		p.stop()
+	}
+	return err
+}
+
+// checkObjects reads the type and size of each of the named objects.
+//
+// The returned slice has one entry per name, and that entry is nil if the named object does not exist.
+func (p *catFileProcess) checkObjects(names []string) ([]*objectInfo, error) {
+	infos := make([]*objectInfo, len(names))
+	err := p.request(names, func() error {
+		for i, name := range names {
+			info, err := p.readHeader(name)
+			if err != nil {
+				return err
+			}
+			infos[i] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// readObject reads the header and contents of the named object.
+//
+// If the object does not exist, then the returned objectInfo is nil.
+func (p *catFileProcess) readObject(name string) (*objectInfo, []byte, error) {
+	var info *objectInfo
+	var contents []byte
+	err := p.request([]string{name}, func() error {
+		var err error
+		info, err = p.readHeader(name)
+		if err != nil || info == nil {
+			return err
+		}
+		// The contents are followed by a single newline character.
+		contents = make([]byte, info.Size+1)
+		if _, err := io.ReadFull(p.stdout, contents); err != nil {
+			return err
+		}
+		contents = contents[:info.Size]
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return info, contents, nil
+}
+
+// objectReader provides read access to the git object database using a pair of
+// long-lived "git cat-file" processes.
+type objectReader struct {
+	batch      *catFileProcess
+	batchCheck *catFileProcess
+
+	// notesMu guards the notes cache.
+	notesMu sync.Mutex
+	// notes caches the parsed contents of notes trees, keyed by the hash of the tree.
+	notes map[string]map[string]string
+}
+
+// newObjectReader returns a reader for the repo at the given path.
+//
+// The underlying git processes are killed if the given context is cancelled.
+func newObjectReader(ctx context.Context, path string) *objectReader {
+	return &objectReader{
+		batch:      &catFileProcess{ctx: ctx, path: path, mode: "--batch"},
+		batchCheck: &catFileProcess{ctx: ctx, path: path, mode: "--batch-check"},
+		notes:      make(map[string]map[string]string),
+	}
+}
+
+// Close terminates the git processes used by the reader.
+func (r *objectReader) Close() error {
+	err := r.batch.Close()
+	if checkErr := r.batchCheck.Close(); err == nil {
+		err = checkErr
+	}
+	return err
+}
+
+// Reset restarts the git processes used by the reader.
+//
+// This should be called after the repository is modified, so that subsequent
+// reads are guaranteed to observe the newly written refs and objects.
+func (r *objectReader) Reset() {
+	r.Close()
+}
+
+// checkObjects returns the type and size of each of the named objects.
+//
+// The returned slice has one entry per name, and that entry is nil if the named object does not exist.
+func (r *objectReader) checkObjects(names []string) ([]*objectInfo, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	return r.batchCheck.checkObjects(names)
+}
+
+// checkObject returns the type and size of the named object, or nil if it does not exist.
+func (r *objectReader) checkObject(name string) (*objectInfo, error) {
+	infos, err := r.checkObjects([]string{name})
+	if err != nil {
+		return nil, err
+	}
+	return infos[0], nil
+}
+
+// readObject returns the contents of the named object, which must be of the given type.
+func (r *objectReader) readObject(name, objType string) ([]byte, error) {
+	info, contents, err := r.batch.readObject(name)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, fmt.Errorf("Unknown object %q", name)
+	}
+	if info.Type != objType {
+		return nil, fmt.Errorf("Object %q is a %s rather than a %s", name, info.Type, objType)
+	}
+	return contents, nil
+}
+
+// readCommitHeader returns the value of the given header field from the named commit.
+func (r *objectReader) readCommitHeader(name, field string) (string, error) {
+	contents, err := r.readObject(name+"^{commit}", "commit")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line == "" {
+			// We have reached the end of the headers.
+			break
+		}
+		if strings.HasPrefix(line, field+" ") {
+			return strings.TrimPrefix(line, field+" "), nil
+		}
+	}
+	return "", fmt.Errorf("Commit %q has no %q header", name, field)
+}
+
+// treeEntry represents a single entry in a git tree object.
+type treeEntry struct {
+	Mode string
+	Name string
+	Hash string
+}
+
+// parseTree parses the binary representation of a git tree object.
+func parseTree(contents []byte) ([]treeEntry, error) {
+	var entries []treeEntry
+	for len(contents) > 0 {
+		space := bytes.IndexByte(contents, ' ')
+		if space < 0 {
+			return nil, fmt.Errorf("Malformed tree entry: missing mode")
+		}
+		mode := string(contents[:space])
+		contents = contents[space+1:]
+		nul := bytes.IndexByte(contents, 0)
+		if nul < 0 || len(contents) < nul+21 {
+			return nil, fmt.Errorf("Malformed tree entry: missing name or hash")
+		}
+		name := string(contents[:nul])
+		hash := hex.EncodeToString(contents[nul+1 : nul+21])
+		contents = contents[nul+21:]
+		entries = append(entries, treeEntry{
+			Mode: mode,
+			Name: name,
+			Hash: hash,
+		})
+	}
+	return entries, nil
+}
+
+// readNotesTree builds the map from annotated object to note blob for the given notes tree,
+// using readTree to read the contents of each tree object.
+//
+// Notes trees may be "fanned out" into subdirectories named after the leading
+// characters of the annotated object's hash, so this recurses into any such
+// subdirectories, accumulating the hash prefix as it goes.
+func readNotesTree(readTree func(hash string) ([]byte, error), treeHash, prefix string, notes map[string]string) error {
+	contents, err := readTree(treeHash)
+	if err != nil {
+		return err
+	}
+	entries, err := parseTree(contents)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := prefix + entry.Name
+		if !isHexHash(name, len(name)) {
+			// Notes trees may contain non-note entries, which we ignore.
+			continue
+		}
+		if entry.Mode == "40000" && len(name) < 40 {
+			if err := readNotesTree(readTree, entry.Hash, name, notes); err != nil {
+				return err
+			}
+		} else if len(name) == 40 {
+			notes[name] = entry.Hash
+		}
+	}
+	return nil
+}
+
+// readTree reads the contents of the given tree object.
+func (r *objectReader) readTree(hash string) ([]byte, error) {
+	return r.readObject(hash, "tree")
+}
+
+// readNotes returns the map from annotated object to note blob for the given notes ref.
+//
+// If the notes ref does not exist, then the returned map is nil.
+func (r *objectReader) readNotes(notesRef string) (map[string]string, error) {
+	info, err := r.checkObject(notesRef + "^{tree}")
+	if err != nil || info == nil {
+		return nil, err
+	}
+	r.notesMu.Lock()
+	defer r.notesMu.Unlock()
+	if notes, ok := r.notes[info.Hash]; ok {
+		return notes, nil
+	}
+	notes := make(map[string]string)
+	if err := readNotesTree(r.readTree, info.Hash, "", notes); err != nil {
+		return nil, err
+	}
+	r.notes[info.Hash] = notes
+	return notes, nil
+}
+
+// isHexHash returns true if the given string consists of exactly length hexadecimal characters.
+func isHexHash(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
@@ -19,53 +19,206 @@ package repository
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const branchRefPrefix = "refs/heads/"
 
+// Config settings for the timeouts applied to git commands.
+//
+// Each value is either a duration such as "30s" or "5m", or a whole number of
+// seconds. Missing, invalid, and non-positive values mean there is no timeout.
+const (
+	// commandTimeoutConfig limits each local git command that does not wait on the user.
+	commandTimeoutConfig = "appraise.timeout"
+	// remoteTimeoutConfig limits each git command that talks to a remote repo, such as a fetch or push.
+	remoteTimeoutConfig = "appraise.remoteTimeout"
+)
+
 // GitRepo represents an instance of a (local) git repository.
 type GitRepo struct {
 	Path string
+
+	// ctx bounds the lifetime of every git process started for the repo.
+	ctx context.Context
+
+	readerOnce sync.Once
+	reader     *objectReader
+
+	timeoutsOnce   sync.Once
+	commandTimeout time.Duration
+	remoteTimeout  time.Duration
 }
 
-// Run the given git command and return its stdout, or an error if the command fails.
-func (repo *GitRepo) runGitCommandRaw(args ...string) (string, string, error) {
-	cmd := exec.Command("git", args...)
+// context returns the context that bounds the repo's git processes.
+func (repo *GitRepo) context() context.Context {
+	if repo.ctx == nil {
+		return context.Background()
+	}
+	return repo.ctx
+}
+
+// objects returns the reader used for reading objects out of the repo's object database.
+func (repo *GitRepo) objects() *objectReader {
+	repo.readerOnce.Do(func() {
+		repo.reader = newObjectReader(repo.context(), repo.Path)
+	})
+	return repo.reader
+}
+
+// Close releases any long-lived git processes held by the repo.
+//
+// The repo remains usable afterwards, and will restart those processes as needed.
+func (repo *GitRepo) Close() error {
+	return repo.objects().Close()
+}
+
+// WithContext returns a copy of the repo whose operations are bound to the given context.
+//
+// Cancelling the context kills any git processes started by the returned repo.
+func (repo *GitRepo) WithContext(ctx context.Context) Repo {
+	return &GitRepo{Path: repo.Path, ctx: ctx}
+}
+
+// parseTimeout parses the value of one of the timeout config settings.
+func parseTimeout(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if timeout, err := time.ParseDuration(value); err == nil {
+		return timeout
+	}
+	return 0
+}
+
+// loadTimeouts reads the timeout config settings, the first time it is called.
+func (repo *GitRepo) loadTimeouts() {
+	repo.timeoutsOnce.Do(func() {
+		readTimeout := func(key string) time.Duration {
+			var stdout bytes.Buffer
+			if err := repo.runGit(0, nil, &stdout, nil, "config", key); err != nil {
+				return 0
+			}
+			return parseTimeout(strings.TrimSpace(stdout.String()))
+		}
+		repo.commandTimeout = readTimeout(commandTimeoutConfig)
+		repo.remoteTimeout = readTimeout(remoteTimeoutConfig)
+	})
+}
+
+// getCommandTimeout returns the timeout for local git commands.
+func (repo *GitRepo) getCommandTimeout() time.Duration {
+	repo.loadTimeouts()
+	return repo.commandTimeout
+}
+
+// getRemoteTimeout returns the timeout for git commands that talk to a remote.
+func (repo *GitRepo) getRemoteTimeout() time.Duration {
+	repo.loadTimeouts()
+	return repo.remoteTimeout
+}
+
+// interruptedError reports a git command that was killed before it completed.
+type interruptedError struct {
+	args []string
+	err  error
+}
+
+func (e *interruptedError) Error() string {
+	return fmt.Sprintf("Git command %q was interrupted: %v", strings.Join(e.args, " "), e.err)
+}
+
+// runGit runs the given git command with the given stdin, stdout, and stderr.
+//
+// The command is killed if the repo's context is cancelled, or if it runs for
+// longer than the given timeout. A timeout of zero means there is no timeout.
+func (repo *GitRepo) runGit(timeout time.Duration, stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
+	ctx := repo.context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "git", args...)
 	cmd.Dir = repo.Path
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err != nil && ctx.Err() != nil {
+		return &interruptedError{args: args, err: ctx.Err()}
+	}
+	return err
+}
+
+// Run the given git command and return its stdout, or an error if the command fails.
+func (repo *GitRepo) runGitCommandRawWithTimeout(timeout time.Duration, args ...string) (string, string, error) {
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+	err := repo.runGit(timeout, nil, &stdout, &stderr, args...)
 	return strings.TrimSpace(stdout.String()), strings.TrimSpace(stderr.String()), err
 }
 
 // Run the given git command and return its stdout, or an error if the command fails.
-func (repo *GitRepo) runGitCommand(args ...string) (string, error) {
-	stdout, stderr, err := repo.runGitCommandRaw(args...)
-	if err != nil {
-		if stderr == "" {
-			stderr = "Error running git command: " + strings.Join(args, " ")
-		}
-		err = fmt.Errorf(stderr)
+func (repo *GitRepo) runGitCommandRaw(args ...string) (string, string, error) {
+	return repo.runGitCommandRawWithTimeout(repo.getCommandTimeout(), args...)
+}
+
+// gitCommandError converts the error from a failed git command into one that describes the failure.
+func gitCommandError(args []string, stderr string, err error) error {
+	if _, ok := err.(*interruptedError); err == nil || ok {
+		return err
+	}
+	if stderr == "" {
+		stderr = "Error running git command: " + strings.Join(args, " ")
 	}
-	return stdout, err
+	return errors.New(stderr)
+}
+
+// Run the given git command and return its stdout, or an error if the command fails.
+func (repo *GitRepo) runGitCommandWithTimeout(timeout time.Duration, args ...string) (string, error) {
+	stdout, stderr, err := repo.runGitCommandRawWithTimeout(timeout, args...)
+	return stdout, gitCommandError(args, stderr, err)
+}
+
+// Run the given git command with the given input as its stdin, and return its stdout,
+// or an error if the command fails.
+func (repo *GitRepo) runGitCommandWithInput(input string, args ...string) (string, error) {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	err := repo.runGit(repo.getCommandTimeout(), strings.NewReader(input), &stdout, &stderr, args...)
+	return strings.TrimSpace(stdout.String()), gitCommandError(args, strings.TrimSpace(stderr.String()), err)
+}
+
+// Run the given git command and return its stdout, or an error if the command fails.
+func (repo *GitRepo) runGitCommand(args ...string) (string, error) {
+	return repo.runGitCommandWithTimeout(repo.getCommandTimeout(), args...)
+}
+
+// Run the given git command using the same stdin, stdout, and stderr as the review tool.
+func (repo *GitRepo) runGitCommandInlineWithTimeout(timeout time.Duration, args ...string) error {
+	return repo.runGit(timeout, os.Stdin, os.Stdout, os.Stderr, args...)
 }
 
 // Run the given git command using the same stdin, stdout, and stderr as the review tool.
+//
+// Such commands may wait on the user, so they are only bounded by the repo's context.
 func (repo *GitRepo) runGitCommandInline(args ...string) error {
-	cmd := exec.Command("git", args...)
-	cmd.Dir = repo.Path
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	return repo.runGitCommandInlineWithTimeout(0, args...)
 }
 
 // NewGitRepo determines if the given working directory is inside of a git repository,
@@ -87,12 +240,38 @@ func (repo *GitRepo) GetPath() string {
 	return repo.Path
 }
 
+// GetGitDir returns the path to the git directory that holds the repo's objects and refs.
+//
+// This is also where the tool stores any local state, such as its caches.
+func (repo *GitRepo) GetGitDir() (string, error) {
+	gitDir, err := repo.runGitCommand("rev-parse", "--git-common-dir")
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(repo.Path, gitDir)
+	}
+	return gitDir, nil
+}
+
 // GetRepoStateHash returns a hash which embodies the entire current state of a repository.
 func (repo *GitRepo) GetRepoStateHash() (string, error) {
 	stateSummary, error := repo.runGitCommand("show-ref")
 	return fmt.Sprintf("%x", sha1.Sum([]byte(stateSummary))), error
 }
 
+// GetConfig returns the value of the given git config setting.
+//
+// The returned value is empty if the setting is not set.
+func (repo *GitRepo) GetConfig(key string) (string, error) {
+	value, _, err := repo.runGitCommandRaw("config", key)
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		// The setting is missing.
+		return "", nil
+	}
+	return value, err
+}
+
 // GetUserEmail returns the email address that the user has used to configure git.
 func (repo *GitRepo) GetUserEmail() (string, error) {
 	return repo.runGitCommand("config", "user.email")
@@ -109,6 +288,34 @@ func (repo *GitRepo) GetSubmitStrategy() (string, error) {
 	return submitStrategy, nil
 }
 
+// GetReviewRemotes returns the remotes that reviews are pushed to and pulled from.
+//
+// These are configured using the multi-valued "appraise.remote" git config
+// setting, and default to just "origin".
+func (repo *GitRepo) GetReviewRemotes() ([]string, error) {
+	out, _, err := repo.runGitCommandRaw("config", "--get-all", "appraise.remote")
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			// The setting is missing.
+			return []string{"origin"}, nil
+		}
+		return nil, err
+	}
+	return strings.Split(out, "\n"), nil
+}
+
+// GetParallelism returns the maximum number of operations that should be run concurrently.
+//
+// This is configured using the "appraise.jobs" git config setting, and
+// defaults to the number of available CPUs.
+func (repo *GitRepo) GetParallelism() (int, error) {
+	jobs, _ := repo.runGitCommand("config", "appraise.jobs")
+	if jobs == "" {
+		return runtime.NumCPU(), nil
+	}
+	return strconv.Atoi(jobs)
+}
+
 // HasUncommittedChanges returns true if there are local, uncommitted changes.
 func (repo *GitRepo) HasUncommittedChanges() (bool, error) {
 	out, err := repo.runGitCommand("status", "--porcelain")
@@ -123,11 +330,14 @@ func (repo *GitRepo) HasUncommittedChanges() (bool, error) {
 
 // VerifyCommit verifies that the supplied hash points to a known commit.
 func (repo *GitRepo) VerifyCommit(hash string) error {
-	out, err := repo.runGitCommand("cat-file", "-t", hash)
+	info, err := repo.objects().checkObject(hash)
 	if err != nil {
 		return err
 	}
-	objectType := strings.TrimSpace(string(out))
+	if info == nil {
+		return fmt.Errorf("Hash %q does not point to a known object", hash)
+	}
+	objectType := info.Type
 	if objectType != "commit" {
 		return fmt.Errorf("Hash %q points to a non-commit object of type %q", hash, objectType)
 	}
@@ -180,6 +390,15 @@ func (repo *GitRepo) ResolveRefCommit(ref string) (string, error) {
 	return "", fmt.Errorf("Unknown git ref %q", ref)
 }
 
+// ResolveReviewRefCommit returns the commit pointed to by the review ref of the given review.
+//
+// This is like ResolveRefCommit, except that if the review ref does not exist
+// locally, then the copy of it that was fetched for the review by FetchReviewRefs
+// takes precedence over any remote refs.
+func (repo *GitRepo) ResolveReviewRefCommit(review, ref string) (string, error) {
+	return resolveReviewRefCommit(repo, review, ref)
+}
+
 // GetCommitMessage returns the message stored in the commit pointed to by the given ref.
 func (repo *GitRepo) GetCommitMessage(ref string) (string, error) {
 	return repo.runGitCommand("show", "-s", "--format=%B", ref)
@@ -187,7 +406,16 @@ func (repo *GitRepo) GetCommitMessage(ref string) (string, error) {
 
 // GetCommitTime returns the commit time of the commit pointed to by the given ref.
 func (repo *GitRepo) GetCommitTime(ref string) (string, error) {
-	return repo.runGitCommand("show", "-s", "--format=%ct", ref)
+	committer, err := repo.objects().readCommitHeader(ref, "committer")
+	if err != nil {
+		return "", err
+	}
+	// The committer header has the form "<name> <<email>> <timestamp> <timezone>".
+	fields := strings.Fields(committer)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("Malformed committer for %q: %q", ref, committer)
+	}
+	return fields[len(fields)-2], nil
 }
 
 // GetLastParent returns the last parent of the given commit (as ordered by git).
@@ -196,7 +424,7 @@ func (repo *GitRepo) GetLastParent(ref string) (string, error) {
 }
 
 // GetCommitDetails returns the details of a commit's metadata.
-func (repo GitRepo) GetCommitDetails(ref string) (*CommitDetails, error) {
+func (repo *GitRepo) GetCommitDetails(ref string) (*CommitDetails, error) {
 	var err error
 	show := func(formatString string) (result string) {
 		if err != nil {
@@ -244,6 +472,40 @@ func (repo *GitRepo) IsAncestor(ancestor, descendant string) (bool, error) {
 	return false, fmt.Errorf("Error while trying to determine commit ancestry: %v", err)
 }
 
+// AreAncestors determines which of the commits in the first argument are ancestors of the second.
+//
+// The returned slice has one entry for each of the given commits. This is
+// equivalent to calling IsAncestor for each commit, but only has to walk the
+// history of the descendant once.
+func (repo *GitRepo) AreAncestors(ancestors []string, descendant string) ([]bool, error) {
+	result := make([]bool, len(ancestors))
+	if len(ancestors) == 0 {
+		return result, nil
+	}
+	// Resolve the candidate ancestors to full hashes, so that they can be compared
+	// against the output of rev-list.
+	infos, err := repo.objects().checkObjects(ancestors)
+	if err != nil {
+		return nil, fmt.Errorf("Error while trying to determine commit ancestry: %v", err)
+	}
+	out, _, err := repo.runGitCommandRaw("rev-list", descendant)
+	if _, ok := err.(*exec.ExitError); ok {
+		// Like IsAncestor, we treat an unknown descendant as having no ancestors.
+		return result, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error while trying to determine commit ancestry: %v", err)
+	}
+	reachable := make(map[string]bool)
+	for _, commit := range strings.Split(out, "\n") {
+		reachable[commit] = true
+	}
+	for i, info := range infos {
+		result[i] = info != nil && reachable[info.Hash]
+	}
+	return result, nil
+}
+
 // Diff computes the diff between two given commits.
 func (repo *GitRepo) Diff(left, right string, diffArgs ...string) (string, error) {
 	args := []string{"diff"}
@@ -252,6 +514,17 @@ func (repo *GitRepo) Diff(left, right string, diffArgs ...string) (string, error
 	return repo.runGitCommand(args...)
 }
 
+// RangeDiff compares two versions of a series of commits, each given by its base and head commits.
+//
+// This shows the differences between the changes made by each series, even
+// when the two series were based on different commits.
+func (repo *GitRepo) RangeDiff(oldBase, oldHead, newBase, newHead string, diffArgs ...string) (string, error) {
+	args := []string{"range-diff"}
+	args = append(args, diffArgs...)
+	args = append(args, fmt.Sprintf("%s..%s", oldBase, oldHead), fmt.Sprintf("%s..%s", newBase, newHead))
+	return repo.runGitCommand(args...)
+}
+
 // Show returns the contents of the given file at the given commit.
 func (repo *GitRepo) Show(commit, path string) (string, error) {
 	return repo.runGitCommand("show", fmt.Sprintf("%s:%s", commit, path))
@@ -319,92 +592,433 @@ func (repo *GitRepo) ListCommitsBetween(from, to string) ([]string, error) {
 	return strings.Split(out, "\n"), nil
 }
 
-// GetNotes uses the "git" command-line tool to read the notes from the given ref for a given revision.
+// GetNotes reads the notes from the given ref that annotate the given revision.
+//
+// The notes are read through the repo's long-lived "git cat-file" processes,
+// rather than by running a separate "git notes show" command for each revision.
 func (repo *GitRepo) GetNotes(notesRef, revision string) []Note {
-	var notes []Note
-	rawNotes, err := repo.runGitCommand("notes", "--ref", notesRef, "show", revision)
-	if err != nil {
+	notesMap, err := repo.objects().readNotes(notesRef)
+	if err != nil || notesMap == nil {
 		// We just assume that this means there are no notes
 		return nil
 	}
-	for _, line := range strings.Split(rawNotes, "\n") {
-		notes = append(notes, Note([]byte(line)))
+	if !isHexHash(revision, 40) {
+		info, err := repo.objects().checkObject(revision)
+		if err != nil || info == nil {
+			return nil
+		}
+		revision = info.Hash
+	}
+	blobHash, ok := notesMap[revision]
+	if !ok {
+		return nil
+	}
+	notes, err := repo.readNoteBlob(blobHash)
+	if err != nil {
+		return nil
 	}
 	return notes
 }
 
+// readNoteBlob reads the lines of the given note blob.
+func (repo *GitRepo) readNoteBlob(blobHash string) ([]Note, error) {
+	contents, err := repo.objects().readObject(blobHash, "blob")
+	if err != nil {
+		return nil, err
+	}
+	var notes []Note
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		notes = append(notes, Note([]byte(line)))
+	}
+	return notes, nil
+}
+
+// writeNoteBlob writes the given lines as a note blob, and returns the hash of that blob.
+//
+// The lines are separated by blank lines, just as "git notes append" does.
+func (repo *GitRepo) writeNoteBlob(notes []Note) (string, error) {
+	var contents bytes.Buffer
+	for i, note := range notes {
+		if i > 0 {
+			contents.WriteByte('\n')
+		}
+		contents.Write(note)
+		contents.WriteByte('\n')
+	}
+	return repo.runGitCommandWithInput(contents.String(), "hash-object", "-w", "--stdin")
+}
+
 // AppendNote appends a note to a revision under the given ref.
 func (repo *GitRepo) AppendNote(notesRef, revision string, note Note) error {
 	_, err := repo.runGitCommand("notes", "--ref", notesRef, "append", "-m", string(note), revision)
+	repo.objects().Reset()
 	return err
 }
 
 // ListNotedRevisions returns the collection of revisions that are annotated by notes in the given ref.
 func (repo *GitRepo) ListNotedRevisions(notesRef string) []string {
-	var revisions []string
-	notesListOut, err := repo.runGitCommand("notes", "--ref", notesRef, "list")
+	notesMap, err := repo.objects().readNotes(notesRef)
 	if err != nil {
 		return nil
 	}
-	notesList := strings.Split(notesListOut, "\n")
-	for _, notePair := range notesList {
-		noteParts := strings.SplitN(notePair, " ", 2)
-		if len(noteParts) == 2 {
-			objHash := noteParts[1]
-			objType, err := repo.runGitCommand("cat-file", "-t", objHash)
-			// If a note points to an object that we do not know about (yet), then err will not
-			// be nil. We can safely just ignore those notes.
-			if err == nil && objType == "commit" {
-				revisions = append(revisions, objHash)
-			}
+	var objHashes []string
+	for objHash := range notesMap {
+		objHashes = append(objHashes, objHash)
+	}
+	sort.Strings(objHashes)
+	// The types of all of the annotated objects are resolved in a single batch.
+	infos, err := repo.objects().checkObjects(objHashes)
+	if err != nil {
+		return nil
+	}
+	var revisions []string
+	for i, info := range infos {
+		// If a note points to an object that we do not know about (yet), then info will
+		// be nil. We can safely just ignore those notes.
+		if info != nil && info.Type == "commit" {
+			revisions = append(revisions, objHashes[i])
 		}
 	}
 	return revisions
 }
 
+// ListNotedObjects returns the hashes of all of the objects that are annotated by notes in the given ref.
+func (repo *GitRepo) ListNotedObjects(notesRef string) []string {
+	notesMap, err := repo.objects().readNotes(notesRef)
+	if err != nil {
+		return nil
+	}
+	var objHashes []string
+	for objHash := range notesMap {
+		objHashes = append(objHashes, objHash)
+	}
+	sort.Strings(objHashes)
+	return objHashes
+}
+
 // PushNotes pushes git notes to a remote repo.
 func (repo *GitRepo) PushNotes(remote, notesRefPattern string) error {
 	refspec := fmt.Sprintf("%s:%s", notesRefPattern, notesRefPattern)
 
 	// The push is liable to fail if the user forgot to do a pull first, so
 	// we treat errors as user errors rather than fatal errors.
-	err := repo.runGitCommandInline("push", remote, refspec)
+	err := repo.runGitCommandInlineWithTimeout(repo.getRemoteTimeout(), "push", remote, refspec)
 	if err != nil {
 		return fmt.Errorf("Failed to push to the remote '%s': %v", remote, err)
 	}
 	return nil
 }
 
-func getRemoteNotesRef(remote, localNotesRef string) string {
+// GetRemoteNotesRef returns the local ref that tracks the given notes ref in the given remote.
+func GetRemoteNotesRef(remote, localNotesRef string) string {
 	relativeNotesRef := strings.TrimPrefix(localNotesRef, "refs/notes/")
 	return "refs/notes/" + remote + "/" + relativeNotesRef
 }
 
-// PullNotes fetches the contents of the given notes ref from a remote repo,
-// and then merges them with the corresponding local notes using the
-// "cat_sort_uniq" strategy.
-func (repo *GitRepo) PullNotes(remote, notesRefPattern string) error {
-	remoteNotesRefPattern := getRemoteNotesRef(remote, notesRefPattern)
-	fetchRefSpec := fmt.Sprintf("+%s:%s", notesRefPattern, remoteNotesRefPattern)
-	err := repo.runGitCommandInline("fetch", remote, fetchRefSpec)
+// PushNotesWithLease pushes git notes to a remote repo, but only if none of the
+// corresponding notes refs in the remote have changed since they were last fetched.
+//
+// If the push is rejected because the remote notes have changed, then the returned
+// error is ErrNotesPushRejected.
+func (repo *GitRepo) PushNotesWithLease(remote, notesRefPattern string) error {
+	out, err := repo.runGitCommand("for-each-ref", "--format=%(refname)", notesRefPattern)
+	if err != nil || out == "" {
+		return err
+	}
+	refs := strings.Split(out, "\n")
+	args := []string{"push", "--porcelain"}
+	var refspecs []string
+	for _, ref := range refs {
+		// An empty lease means that the remote ref must not exist yet.
+		expected, err := repo.getNotesTip(GetRemoteNotesRef(remote, ref))
+		if err != nil {
+			return err
+		}
+		args = append(args, fmt.Sprintf("--force-with-lease=%s:%s", ref, expected))
+		refspecs = append(refspecs, ref+":"+ref)
+	}
+	args = append(append(args, remote), refspecs...)
+	stdout, stderr, err := repo.runGitCommandRawWithTimeout(repo.getRemoteTimeout(), args...)
+	if err != nil {
+		for _, line := range strings.Split(stdout, "\n") {
+			if strings.HasPrefix(line, "!") && (strings.Contains(line, "stale info") ||
+				strings.Contains(line, "fetch first") || strings.Contains(line, "non-fast-forward")) {
+				return ErrNotesPushRejected
+			}
+		}
+		return fmt.Errorf("Failed to push to the remote '%s': %v", remote, gitCommandError(args, stderr, err))
+	}
+	// Record what we pushed, so that the next lease is taken against it.
+	for _, ref := range refs {
+		if _, err := repo.runGitCommand("update-ref", GetRemoteNotesRef(remote, ref), ref); err != nil {
+			return err
+		}
+	}
+	repo.objects().Reset()
+	return nil
+}
+
+// getNotesTip returns the commit at the tip of the given notes ref, or an empty string if there is no such ref.
+func (repo *GitRepo) getNotesTip(notesRef string) (string, error) {
+	info, err := repo.objects().checkObject(notesRef + "^{commit}")
+	if err != nil || info == nil {
+		return "", err
+	}
+	return info.Hash, nil
+}
+
+// writeNotesTree writes a notes tree holding the given map from annotated object to note blob.
+//
+// The tree is written without any fanout. Git reads such trees just as well, and
+// restores the fanout the next time that it writes to the notes ref.
+func (repo *GitRepo) writeNotesTree(notes map[string]string) (string, error) {
+	var objects []string
+	for object := range notes {
+		objects = append(objects, object)
+	}
+	sort.Strings(objects)
+	var entries bytes.Buffer
+	for _, object := range objects {
+		fmt.Fprintf(&entries, "100644 blob %s\t%s\n", notes[object], object)
+	}
+	return repo.runGitCommandWithInput(entries.String(), "mktree")
+}
+
+// MergeNotes merges the notes from the second ref into those of the first.
+//
+// The contents of any note that differs between the two refs are combined
+// using the given merger. If that fails for any note, then the first ref is
+// left unchanged, and the returned error describes every failure.
+func (repo *GitRepo) MergeNotes(notesRef, otherRef string, merge NotesMerger) error {
+	otherTip, err := repo.getNotesTip(otherRef)
+	if err != nil || otherTip == "" {
+		return err
+	}
+	localTip, err := repo.getNotesTip(notesRef)
 	if err != nil {
 		return err
 	}
+	fastForward := localTip == ""
+	if localTip != "" {
+		if merged, err := repo.IsAncestor(otherTip, localTip); err != nil || merged {
+			return err
+		}
+		if fastForward, err = repo.IsAncestor(localTip, otherTip); err != nil {
+			return err
+		}
+	}
 
-	remoteRefs, err := repo.runGitCommand("ls-remote", remote, notesRefPattern)
+	otherNotes, err := repo.objects().readNotes(otherTip)
 	if err != nil {
 		return err
 	}
+	mergedNotes := make(map[string]string)
+	if localTip != "" {
+		localNotes, err := repo.objects().readNotes(localTip)
+		if err != nil {
+			return err
+		}
+		for object, blobHash := range localNotes {
+			mergedNotes[object] = blobHash
+		}
+	}
+	var objects []string
+	for object := range otherNotes {
+		objects = append(objects, object)
+	}
+	sort.Strings(objects)
+	var failures []string
+	for _, object := range objects {
+		localBlob, ok := mergedNotes[object]
+		otherBlob := otherNotes[object]
+		if ok && localBlob == otherBlob {
+			continue
+		}
+		var local []Note
+		if ok {
+			if local, err = repo.readNoteBlob(localBlob); err != nil {
+				return err
+			}
+		}
+		remote, err := repo.readNoteBlob(otherBlob)
+		if err != nil {
+			return err
+		}
+		notes, err := merge(notesRef, object, local, remote)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("  %s: %v", object, err))
+			continue
+		}
+		if mergedNotes[object], err = repo.writeNoteBlob(notes); err != nil {
+			return err
+		}
+		fastForward = fastForward && mergedNotes[object] == otherBlob
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("Unable to merge the notes for %d object(s):\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+
+	newTip := otherTip
+	if !fastForward || len(mergedNotes) != len(otherNotes) {
+		tree, err := repo.writeNotesTree(mergedNotes)
+		if err != nil {
+			return err
+		}
+		args := []string{"commit-tree", "-m", "Notes merged from " + otherRef, "-p", localTip, "-p", otherTip, tree}
+		if localTip == "" {
+			args = []string{"commit-tree", "-m", "Notes merged from " + otherRef, "-p", otherTip, tree}
+		}
+		if newTip, err = repo.runGitCommand(args...); err != nil {
+			return err
+		}
+	}
+	// Passing the previous tip makes this fail if the ref was changed while we were merging.
+	_, err = repo.runGitCommand("update-ref", "-m", "notes: merged from "+otherRef, notesRef, newTip, localTip)
+	repo.objects().Reset()
+	return err
+}
+
+// RewriteNotes replaces the notes that annotate the given objects under the given ref.
+//
+// Every replacement is recorded in a single new commit on the notes ref, which
+// has the given message, and the hash of that commit is returned. Objects that
+// are not given keep their existing notes.
+func (repo *GitRepo) RewriteNotes(notesRef string, notes map[string][]Note, message string) (string, error) {
+	tip, err := repo.getNotesTip(notesRef)
+	if err != nil {
+		return "", err
+	}
+	if tip == "" {
+		return "", fmt.Errorf("There are no notes in %q to rewrite", notesRef)
+	}
+	existing, err := repo.objects().readNotes(tip)
+	if err != nil {
+		return "", err
+	}
+	rewritten := make(map[string]string)
+	for object, blobHash := range existing {
+		rewritten[object] = blobHash
+	}
+	for object, lines := range notes {
+		if rewritten[object], err = repo.writeNoteBlob(lines); err != nil {
+			return "", err
+		}
+	}
+	tree, err := repo.writeNotesTree(rewritten)
+	if err != nil {
+		return "", err
+	}
+	commit, err := repo.runGitCommand("commit-tree", "-m", message, "-p", tip, tree)
+	if err != nil {
+		return "", err
+	}
+	// Passing the previous tip makes this fail if the ref was changed while we were rewriting it.
+	_, err = repo.runGitCommand("update-ref", "-m", "notes: "+message, notesRef, commit, tip)
+	repo.objects().Reset()
+	return commit, err
+}
+
+// PullNotes fetches the contents of the given notes ref from a remote repo,
+// and then merges them with the corresponding local notes using the given merger.
+//
+// Each local notes ref is merged independently, and is left unchanged if its merge fails.
+func (repo *GitRepo) PullNotes(remote, notesRefPattern string, merge NotesMerger) error {
+	remoteNotesRefPattern := GetRemoteNotesRef(remote, notesRefPattern)
+	fetchRefSpec := fmt.Sprintf("+%s:%s", notesRefPattern, remoteNotesRefPattern)
+	err := repo.runGitCommandInlineWithTimeout(repo.getRemoteTimeout(), "fetch", remote, fetchRefSpec)
+	if err != nil {
+		return fmt.Errorf("Failed to fetch from the remote '%s': %v", remote, err)
+	}
+	repo.objects().Reset()
+
+	remoteRefs, err := repo.runGitCommandWithTimeout(repo.getRemoteTimeout(), "ls-remote", remote, notesRefPattern)
+	if err != nil {
+		return fmt.Errorf("Failed to list the notes in the remote '%s': %v", remote, err)
+	}
+	var failures []string
 	for _, line := range strings.Split(remoteRefs, "\n") {
 		lineParts := strings.Split(line, "\t")
 		if len(lineParts) == 2 {
 			ref := lineParts[1]
-			remoteRef := getRemoteNotesRef(remote, ref)
-			_, err := repo.runGitCommand("notes", "--ref", ref, "merge", remoteRef, "-s", "cat_sort_uniq")
-			if err != nil {
-				return err
+			remoteRef := GetRemoteNotesRef(remote, ref)
+			if err := repo.MergeNotes(ref, remoteRef, merge); err != nil {
+				failures = append(failures, fmt.Sprintf("Failed to merge the notes from %s into %s: %v", remoteRef, ref, err))
 			}
 		}
 	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// FetchReviewRefs fetches the review refs of the given reviews from a remote repo.
+//
+// The reviewRefs argument maps the hash of each review to its review ref. Each
+// review ref that exists in the remote is stored locally in the ref returned by
+// GetFetchedReviewRef, while those that do not exist there are skipped.
+func (repo *GitRepo) FetchReviewRefs(remote string, reviewRefs map[string]string) error {
+	if len(reviewRefs) == 0 {
+		return nil
+	}
+	// A single missing ref would make the entire fetch fail, so we first check which ones exist.
+	lsRemoteArgs := []string{"ls-remote", remote}
+	var reviews []string
+	for review, ref := range reviewRefs {
+		reviews = append(reviews, review)
+		lsRemoteArgs = append(lsRemoteArgs, ref)
+	}
+	sort.Strings(reviews)
+	remoteRefs, err := repo.runGitCommandWithTimeout(repo.getRemoteTimeout(), lsRemoteArgs...)
+	if err != nil {
+		return fmt.Errorf("Failed to list the review refs in the remote '%s': %v", remote, err)
+	}
+	existingRefs := make(map[string]bool)
+	for _, line := range strings.Split(remoteRefs, "\n") {
+		lineParts := strings.Split(line, "\t")
+		if len(lineParts) == 2 {
+			existingRefs[lineParts[1]] = true
+		}
+	}
+	fetchArgs := []string{"fetch", remote}
+	for _, review := range reviews {
+		if ref := reviewRefs[review]; existingRefs[ref] {
+			// Review refs may be rebased, so the fetch is forced.
+			fetchArgs = append(fetchArgs, fmt.Sprintf("+%s:%s", ref, GetFetchedReviewRef(review)))
+		}
+	}
+	if len(fetchArgs) == 2 {
+		return nil
+	}
+	err = repo.runGitCommandInlineWithTimeout(repo.getRemoteTimeout(), fetchArgs...)
+	repo.objects().Reset()
+	if err != nil {
+		return fmt.Errorf("Failed to fetch the review refs from the remote '%s': %v", remote, err)
+	}
 	return nil
 }
+
+// PruneFetchedReviewRefs deletes the review refs fetched by FetchReviewRefs
+// for every review other than the given ones, such as those of closed reviews.
+func (repo *GitRepo) PruneFetchedReviewRefs(reviews []string) error {
+	fetchedRefs, err := repo.runGitCommand("for-each-ref", "--format=%(refname)", fetchedReviewRefPrefix)
+	if err != nil {
+		return err
+	}
+	keep := make(map[string]bool)
+	for _, review := range reviews {
+		keep[GetFetchedReviewRef(review)] = true
+	}
+	var deletions bytes.Buffer
+	for _, ref := range strings.Split(fetchedRefs, "\n") {
+		if ref != "" && !keep[ref] {
+			fmt.Fprintf(&deletions, "delete %s\n", ref)
+		}
+	}
+	if deletions.Len() == 0 {
+		return nil
+	}
+	_, err = repo.runGitCommandWithInput(deletions.String(), "update-ref", "--stdin")
+	repo.objects().Reset()
+	return err
+}
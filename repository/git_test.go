@@ -0,0 +1,138 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTimeout(t *testing.T) {
+	cases := map[string]time.Duration{
+		"":      0,
+		"30":    30 * time.Second,
+		"90s":   90 * time.Second,
+		"2m":    2 * time.Minute,
+		"bogus": 0,
+	}
+	for value, expected := range cases {
+		if timeout := parseTimeout(value); timeout != expected {
+			t.Errorf("Unexpected timeout for %q: %v", value, timeout)
+		}
+	}
+}
+
+func TestPruneFetchedReviewRefs(t *testing.T) {
+	dir, commits := newTestRepo(t)
+	defer os.RemoveAll(dir)
+	for _, review := range []string{commits.master, commits.feature} {
+		runGit(t, dir, "update-ref", GetFetchedReviewRef(review), review)
+	}
+	repo, err := NewGitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.PruneFetchedReviewRefs([]string{commits.feature, commits.base}); err != nil {
+		t.Fatal(err)
+	}
+	if refs := runGit(t, dir, "for-each-ref", "--format=%(refname)", fetchedReviewRefPrefix); refs != GetFetchedReviewRef(commits.feature) {
+		t.Fatalf("Unexpected fetched review refs after pruning: %q", refs)
+	}
+	if err := repo.PruneFetchedReviewRefs(nil); err != nil {
+		t.Fatal(err)
+	}
+	if refs := runGit(t, dir, "for-each-ref", "--format=%(refname)", fetchedReviewRefPrefix); refs != "" {
+		t.Fatalf("Unexpected fetched review refs after pruning: %q", refs)
+	}
+}
+
+func TestPushNotesWithLease(t *testing.T) {
+	remote, commits := newTestRepo(t)
+	defer os.RemoveAll(remote)
+	dir, err := ioutil.TempDir("", "git-appraise-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runGit(t, dir, "clone", "-q", remote, ".")
+	runGit(t, dir, "config", "user.name", "Test User")
+	runGit(t, dir, "config", "user.email", "test@example.com")
+	repo, err := NewGitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(testNotesRef, commits.master, Note(`{"note":"pushed"}`)); err != nil {
+		t.Fatal(err)
+	}
+	// The remote notes have not been fetched, so the lease expects them not to exist.
+	if err := repo.PushNotesWithLease("origin", testNotesRef); err != ErrNotesPushRejected {
+		t.Fatalf("Unexpected result of pushing with a stale lease: %v", err)
+	}
+	merge := func(notesRef, object string, local, remote []Note) ([]Note, error) {
+		return append(local, remote...), nil
+	}
+	if err := repo.PullNotes("origin", testNotesRef, merge); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.PushNotesWithLease("origin", testNotesRef); err != nil {
+		t.Fatal(err)
+	}
+	tip := runGit(t, dir, "rev-parse", testNotesRef)
+	if remoteTip := runGit(t, remote, "rev-parse", testNotesRef); remoteTip != tip {
+		t.Fatalf("The remote notes %s differ from the pushed notes %s", remoteTip, tip)
+	}
+	if leased := runGit(t, dir, "rev-parse", GetRemoteNotesRef("origin", testNotesRef)); leased != tip {
+		t.Fatalf("The next lease would be taken against %s rather than %s", leased, tip)
+	}
+}
+
+func TestGetReviewRemotes(t *testing.T) {
+	dir, _ := newTestRepo(t)
+	defer os.RemoveAll(dir)
+	cases := []struct {
+		configured []string
+		expected   []string
+	}{
+		{nil, []string{"origin"}},
+		{[]string{"upstream"}, []string{"upstream"}},
+		{[]string{"upstream", "origin", "backup"}, []string{"upstream", "origin", "backup"}},
+	}
+	for _, test := range cases {
+		for _, remote := range test.configured {
+			runGit(t, dir, "config", "--add", "appraise.remote", remote)
+		}
+		gitRepo, err := NewGitRepo(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		goRepo, err := NewGoRepo(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, repo := range []Repo{gitRepo, goRepo} {
+			if remotes, err := repo.GetReviewRemotes(); err != nil || !reflect.DeepEqual(remotes, test.expected) {
+				t.Errorf("%T: unexpected remotes %v, %v for the setting %v", repo, remotes, err, test.configured)
+			}
+		}
+		if len(test.configured) > 0 {
+			runGit(t, dir, "config", "--unset-all", "appraise.remote")
+		}
+	}
+}
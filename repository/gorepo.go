@@ -0,0 +1,1223 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackendEnvVar names the environment variable used by NewRepo to select a Repo implementation.
+//
+// Setting it to "go" selects GoRepo, while any other value selects GitRepo.
+const BackendEnvVar = "GIT_APPRAISE_BACKEND"
+
+// errNotSupported is returned by GoRepo methods that require the git binary.
+func errNotSupported(operation string) error {
+	return fmt.Errorf("%s is not supported without the git command line tool; unset %s to use it", operation, BackendEnvVar)
+}
+
+// NewRepo returns the Repo implementation selected by the GIT_APPRAISE_BACKEND
+// environment variable for the given working directory.
+func NewRepo(path string) (Repo, error) {
+	if os.Getenv(BackendEnvVar) == "go" {
+		return NewGoRepo(path)
+	}
+	return NewGitRepo(path)
+}
+
+// GoRepo represents an instance of a (local) git repository that is read
+// and written directly, without running the git command line tool.
+//
+// Only the operations needed to read reviews and to write notes are supported.
+// The remaining methods (such as Diff, MergeRef, and PushNotes) return an error.
+type GoRepo struct {
+	Path string
+	// GitDir is the path to the repo's ".git" directory.
+	GitDir string
+	// CommonDir is the path to the directory holding the objects and refs,
+	// which differs from GitDir for linked worktrees.
+	CommonDir string
+
+	objects *objectStore
+
+	mu      sync.Mutex
+	commits map[string]*commitObject
+	notes   map[string]map[string]string
+}
+
+// findGitDir walks up from the given path looking for a git directory.
+func findGitDir(path string) (string, error) {
+	dir, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	for {
+		dotGit := filepath.Join(dir, ".git")
+		if info, err := os.Stat(dotGit); err == nil {
+			if info.IsDir() {
+				return dotGit, nil
+			}
+			// The ".git" file in a linked worktree or submodule points to the real git directory.
+			contents, err := ioutil.ReadFile(dotGit)
+			if err != nil {
+				return "", err
+			}
+			gitDir := strings.TrimSpace(strings.TrimPrefix(string(contents), "gitdir:"))
+			if !filepath.IsAbs(gitDir) {
+				gitDir = filepath.Join(dir, gitDir)
+			}
+			return gitDir, nil
+		}
+		if isBareGitDir(dir) {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", fmt.Errorf("%q is not inside of a git repository", path)
+		}
+		dir = parent
+	}
+}
+
+// isBareGitDir returns true if the given directory looks like a git directory.
+func isBareGitDir(dir string) bool {
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// NewGoRepo determines if the given working directory is inside of a git repository,
+// and returns the corresponding GoRepo instance if it is.
+func NewGoRepo(path string) (*GoRepo, error) {
+	gitDir, err := findGitDir(path)
+	if err != nil {
+		return nil, err
+	}
+	commonDir := gitDir
+	if contents, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		commonDir = strings.TrimSpace(string(contents))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(gitDir, commonDir)
+		}
+	}
+	return &GoRepo{
+		Path:      path,
+		GitDir:    gitDir,
+		CommonDir: commonDir,
+		objects:   newObjectStore(filepath.Join(commonDir, "objects")),
+		commits:   make(map[string]*commitObject),
+		notes:     make(map[string]map[string]string),
+	}, nil
+}
+
+// refPath returns the path of the file that stores the given (loose) ref.
+func (repo *GoRepo) refPath(ref string) string {
+	if strings.HasPrefix(ref, "refs/") {
+		return filepath.Join(repo.CommonDir, filepath.FromSlash(ref))
+	}
+	// Pseudo-refs such as HEAD are specific to a worktree.
+	return filepath.Join(repo.GitDir, ref)
+}
+
+// readPackedRefs reads the map from ref name to hash stored in the "packed-refs" file.
+func (repo *GoRepo) readPackedRefs() (map[string]string, error) {
+	refs := make(map[string]string)
+	file, err := os.Open(filepath.Join(repo.CommonDir, "packed-refs"))
+	if os.IsNotExist(err) {
+		return refs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || strings.HasPrefix(line, "^") {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) == 2 {
+			refs[parts[1]] = parts[0]
+		}
+	}
+	return refs, scanner.Err()
+}
+
+// readRef returns the hash the given fully-qualified ref points to, following symbolic refs.
+//
+// If the ref does not exist, then the returned hash is empty.
+func (repo *GoRepo) readRef(ref string) (string, error) {
+	for depth := 0; depth < 10; depth++ {
+		refPath := repo.refPath(ref)
+		contents, err := ioutil.ReadFile(refPath)
+		if info, statErr := os.Stat(refPath); os.IsNotExist(err) || (statErr == nil && info.IsDir()) {
+			packedRefs, err := repo.readPackedRefs()
+			if err != nil {
+				return "", err
+			}
+			return packedRefs[ref], nil
+		}
+		if err != nil {
+			return "", err
+		}
+		value := strings.TrimSpace(string(contents))
+		if !strings.HasPrefix(value, "ref: ") {
+			return value, nil
+		}
+		ref = strings.TrimPrefix(value, "ref: ")
+	}
+	return "", fmt.Errorf("Too many levels of symbolic refs for %q", ref)
+}
+
+// listRefs returns the map from ref name to hash for every ref under "refs/".
+func (repo *GoRepo) listRefs() (map[string]string, error) {
+	refs, err := repo.readPackedRefs()
+	if err != nil {
+		return nil, err
+	}
+	refsDir := filepath.Join(repo.CommonDir, "refs")
+	err = filepath.Walk(refsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(path, ".lock") {
+			return err
+		}
+		relativePath, err := filepath.Rel(repo.CommonDir, path)
+		if err != nil {
+			return err
+		}
+		ref := filepath.ToSlash(relativePath)
+		hash, err := repo.readRef(ref)
+		if err != nil {
+			return err
+		}
+		if hash != "" {
+			refs[ref] = hash
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return refs, nil
+}
+
+// resolve returns the hash of the object named by the given revision.
+//
+// The revision can either be a full hash, or a ref name that is resolved
+// using the same rules that git uses for abbreviated ref names.
+func (repo *GoRepo) resolve(revision string) (string, error) {
+	if isHexHash(revision, 40) {
+		return revision, nil
+	}
+	candidates := []string{
+		revision,
+		"refs/" + revision,
+		"refs/tags/" + revision,
+		"refs/heads/" + revision,
+		"refs/remotes/" + revision,
+		"refs/remotes/" + revision + "/HEAD",
+	}
+	for _, candidate := range candidates {
+		if candidate != "HEAD" && !strings.HasPrefix(candidate, "refs/") {
+			continue
+		}
+		hash, err := repo.readRef(candidate)
+		if err != nil {
+			return "", err
+		}
+		if hash != "" {
+			return hash, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown revision %q", revision)
+}
+
+// resolveCommit returns the hash of the commit named by the given revision, peeling any tags.
+func (repo *GoRepo) resolveCommit(revision string) (string, error) {
+	hash, err := repo.resolve(revision)
+	if err != nil {
+		return "", err
+	}
+	for depth := 0; depth < 10; depth++ {
+		objType, data, err := repo.objects.read(hash)
+		if err != nil {
+			return "", err
+		}
+		if objType == "commit" {
+			return hash, nil
+		}
+		if objType != "tag" {
+			return "", fmt.Errorf("%q points to a non-commit object of type %q", revision, objType)
+		}
+		// Annotated tags start with an "object" header naming the tagged object.
+		if !strings.HasPrefix(string(data), "object ") {
+			return "", fmt.Errorf("Malformed tag %q", hash)
+		}
+		hash = strings.SplitN(strings.TrimPrefix(string(data), "object "), "\n", 2)[0]
+	}
+	return "", fmt.Errorf("Too many levels of tags for %q", revision)
+}
+
+// getCommit returns the parsed commit named by the given revision.
+func (repo *GoRepo) getCommit(revision string) (string, *commitObject, error) {
+	hash, err := repo.resolveCommit(revision)
+	if err != nil {
+		return "", nil, err
+	}
+	repo.mu.Lock()
+	commit, ok := repo.commits[hash]
+	repo.mu.Unlock()
+	if ok {
+		return hash, commit, nil
+	}
+	data, err := repo.objects.readType(hash, "commit")
+	if err != nil {
+		return "", nil, err
+	}
+	commit, err = parseCommit(data)
+	if err != nil {
+		return "", nil, err
+	}
+	repo.mu.Lock()
+	repo.commits[hash] = commit
+	repo.mu.Unlock()
+	return hash, commit, nil
+}
+
+// readConfigFile reads the value of the given key from a git config file.
+//
+// The key is of the form "section.name" or "section.subsection.name". Later
+// values override earlier ones, and the returned value is empty if the key is not set.
+func readConfigFile(path, key string) string {
+	values := readConfigValues(path, key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+// readConfigValues reads every value of the given (possibly multi-valued) key from a git config file.
+//
+// Only the common subset of the config file syntax is supported: "include" and
+// "includeIf" sections are not followed, comments must be on lines of their own,
+// and escape sequences and line continuations within values are not interpreted.
+func readConfigValues(path, key string) []string {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	lastDot := strings.LastIndex(key, ".")
+	wantSection := strings.ToLower(key[:lastDot])
+	wantName := strings.ToLower(key[lastDot+1:])
+	if firstDot := strings.Index(key, "."); firstDot != lastDot {
+		// Subsection names are case sensitive, unlike section and variable names.
+		wantSection = strings.ToLower(key[:firstDot]) + key[firstDot:lastDot]
+	}
+
+	var section string
+	var values []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			header := strings.TrimSuffix(strings.TrimPrefix(line, "["), "]")
+			parts := strings.SplitN(header, " ", 2)
+			section = strings.ToLower(parts[0])
+			if len(parts) == 2 {
+				section += "." + strings.Trim(strings.TrimSpace(parts[1]), "\"")
+			}
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if section != wantSection || strings.ToLower(strings.TrimSpace(parts[0])) != wantName {
+			continue
+		}
+		if len(parts) == 1 {
+			// A variable with no value is a boolean true.
+			values = append(values, "true")
+			continue
+		}
+		values = append(values, strings.Trim(strings.TrimSpace(parts[1]), "\""))
+	}
+	return values
+}
+
+// getConfigPaths returns the repo, global, and system git config files, from highest to lowest precedence.
+func (repo *GoRepo) getConfigPaths() []string {
+	paths := []string{filepath.Join(repo.CommonDir, "config")}
+	home := os.Getenv("HOME")
+	if xdgHome := os.Getenv("XDG_CONFIG_HOME"); xdgHome != "" {
+		paths = append(paths, filepath.Join(xdgHome, "git", "config"))
+	} else if home != "" {
+		paths = append(paths, filepath.Join(home, ".config", "git", "config"))
+	}
+	if home != "" {
+		paths = append(paths, filepath.Join(home, ".gitconfig"))
+	}
+	return append(paths, "/etc/gitconfig")
+}
+
+// getConfig reads the value of the given key from the repo, global, and system git config files.
+func (repo *GoRepo) getConfig(key string) string {
+	for _, path := range repo.getConfigPaths() {
+		if value := readConfigFile(path, key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// getConfigAll reads every value of the given multi-valued key from the repo, global,
+// and system git config files, in the same order as "git config --get-all".
+func (repo *GoRepo) getConfigAll(key string) []string {
+	paths := repo.getConfigPaths()
+	var values []string
+	for i := len(paths) - 1; i >= 0; i-- {
+		values = append(values, readConfigValues(paths[i], key)...)
+	}
+	return values
+}
+
+// WithContext returns a copy of the repo whose operations are bound to the given context.
+//
+// The GoRepo reads and writes the repository directly rather than running git,
+// so there are no processes to kill and the repo itself is returned.
+func (repo *GoRepo) WithContext(ctx context.Context) Repo {
+	return repo
+}
+
+// GetPath returns the path to the repo.
+func (repo *GoRepo) GetPath() string {
+	return repo.Path
+}
+
+// GetGitDir returns the path to the git directory that holds the repo's objects and refs.
+//
+// This is also where the tool stores any local state, such as its caches.
+func (repo *GoRepo) GetGitDir() (string, error) {
+	return repo.CommonDir, nil
+}
+
+// GetRepoStateHash returns a hash which embodies the entire current state of a repository.
+//
+// The hash is computed over the same summary that "git show-ref" prints, so
+// it matches the value computed by GitRepo for the same repository.
+func (repo *GoRepo) GetRepoStateHash() (string, error) {
+	refs, err := repo.listRefs()
+	if err != nil {
+		return "", err
+	}
+	var refNames []string
+	for ref := range refs {
+		refNames = append(refNames, ref)
+	}
+	sort.Strings(refNames)
+	var lines []string
+	for _, ref := range refNames {
+		lines = append(lines, refs[ref]+" "+ref)
+	}
+	stateSummary := strings.Join(lines, "\n")
+	return fmt.Sprintf("%x", sha1.Sum([]byte(stateSummary))), nil
+}
+
+// GetConfig returns the value of the given git config setting.
+//
+// The returned value is empty if the setting is not set.
+func (repo *GoRepo) GetConfig(key string) (string, error) {
+	return repo.getConfig(key), nil
+}
+
+// GetUserEmail returns the email address that the user has used to configure git.
+func (repo *GoRepo) GetUserEmail() (string, error) {
+	email := repo.getConfig("user.email")
+	if email == "" {
+		return "", fmt.Errorf("The user.email git config value is not set")
+	}
+	return email, nil
+}
+
+// GetCoreEditor returns the name of the editor that the user has used to configure git.
+//
+// This follows the same precedence rules as "git var GIT_EDITOR".
+func (repo *GoRepo) GetCoreEditor() (string, error) {
+	if editor := os.Getenv("GIT_EDITOR"); editor != "" {
+		return editor, nil
+	}
+	if editor := repo.getConfig("core.editor"); editor != "" {
+		return editor, nil
+	}
+	for _, envVar := range []string{"VISUAL", "EDITOR"} {
+		if editor := os.Getenv(envVar); editor != "" {
+			return editor, nil
+		}
+	}
+	return "vi", nil
+}
+
+// GetSubmitStrategy returns the way in which a review is submitted
+func (repo *GoRepo) GetSubmitStrategy() (string, error) {
+	return repo.getConfig("appraise.submit"), nil
+}
+
+// GetReviewRemotes returns the remotes that reviews are pushed to and pulled from.
+//
+// These are configured using the multi-valued "appraise.remote" git config
+// setting, and default to just "origin".
+func (repo *GoRepo) GetReviewRemotes() ([]string, error) {
+	if remotes := repo.getConfigAll("appraise.remote"); len(remotes) > 0 {
+		return remotes, nil
+	}
+	return []string{"origin"}, nil
+}
+
+// GetParallelism returns the maximum number of operations that should be run concurrently.
+//
+// This is configured using the "appraise.jobs" git config setting, and
+// defaults to the number of available CPUs.
+func (repo *GoRepo) GetParallelism() (int, error) {
+	jobs := repo.getConfig("appraise.jobs")
+	if jobs == "" {
+		return runtime.NumCPU(), nil
+	}
+	return strconv.Atoi(jobs)
+}
+
+// HasUncommittedChanges returns true if there are local, uncommitted changes.
+func (repo *GoRepo) HasUncommittedChanges() (bool, error) {
+	return false, errNotSupported("Checking for uncommitted changes")
+}
+
+// VerifyCommit verifies that the supplied hash points to a known commit.
+func (repo *GoRepo) VerifyCommit(hash string) error {
+	objType, _, err := repo.objects.read(hash)
+	if err != nil {
+		return err
+	}
+	if objType != "commit" {
+		return fmt.Errorf("Hash %q points to a non-commit object of type %q", hash, objType)
+	}
+	return nil
+}
+
+// VerifyGitRef verifies that the supplied ref points to a known commit.
+func (repo *GoRepo) VerifyGitRef(ref string) error {
+	hash := ""
+	var err error
+	if strings.HasPrefix(ref, "refs/") {
+		hash, err = repo.readRef(ref)
+		if err != nil {
+			return err
+		}
+	}
+	if hash == "" {
+		return fmt.Errorf("fatal: '%s' - not a valid ref", ref)
+	}
+	return nil
+}
+
+// GetHeadRef returns the ref that is the current HEAD.
+func (repo *GoRepo) GetHeadRef() (string, error) {
+	contents, err := ioutil.ReadFile(repo.refPath("HEAD"))
+	if err != nil {
+		return "", err
+	}
+	value := strings.TrimSpace(string(contents))
+	if !strings.HasPrefix(value, "ref: ") {
+		return "", fmt.Errorf("fatal: ref HEAD is not a symbolic ref")
+	}
+	return strings.TrimPrefix(value, "ref: "), nil
+}
+
+// GetCommitHash returns the hash of the commit pointed to by the given ref.
+func (repo *GoRepo) GetCommitHash(ref string) (string, error) {
+	return repo.resolveCommit(ref)
+}
+
+// ResolveRefCommit returns the commit pointed to by the given ref, which may be a remote ref.
+//
+// This differs from GetCommitHash which only works on exact matches, in that it will try to
+// intelligently handle the scenario of a ref not existing locally, but being known to exist
+// in a remote repo.
+//
+// This method should be used when a command may be performed by either the reviewer or the
+// reviewee, while GetCommitHash should be used when the encompassing command should only be
+// performed by the reviewee.
+func (repo *GoRepo) ResolveRefCommit(ref string) (string, error) {
+	if err := repo.VerifyGitRef(ref); err == nil {
+		return repo.GetCommitHash(ref)
+	}
+	if strings.HasPrefix(ref, "refs/heads/") {
+		// The ref is a branch. Check if it exists in exactly one remote
+		suffix := strings.TrimPrefix(ref, "refs/heads")
+		refs, err := repo.listRefs()
+		if err != nil {
+			return "", err
+		}
+		var matchingRefs []string
+		for candidate := range refs {
+			if strings.HasSuffix(candidate, suffix) {
+				matchingRefs = append(matchingRefs, candidate)
+			}
+		}
+		if len(matchingRefs) == 1 {
+			// There is exactly one match
+			return repo.GetCommitHash(matchingRefs[0])
+		}
+		return "", fmt.Errorf("Unable to find a git ref matching the pattern %q", "**"+suffix)
+	}
+	return "", fmt.Errorf("Unknown git ref %q", ref)
+}
+
+// ResolveReviewRefCommit returns the commit pointed to by the review ref of the given review.
+//
+// This is like ResolveRefCommit, except that if the review ref does not exist
+// locally, then the copy of it that was fetched for the review by FetchReviewRefs
+// takes precedence over any remote refs.
+func (repo *GoRepo) ResolveReviewRefCommit(review, ref string) (string, error) {
+	return resolveReviewRefCommit(repo, review, ref)
+}
+
+// GetCommitMessage returns the message stored in the commit pointed to by the given ref.
+func (repo *GoRepo) GetCommitMessage(ref string) (string, error) {
+	_, commit, err := repo.getCommit(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(commit.Message), nil
+}
+
+// GetCommitTime returns the commit time of the commit pointed to by the given ref.
+func (repo *GoRepo) GetCommitTime(ref string) (string, error) {
+	_, commit, err := repo.getCommit(ref)
+	if err != nil {
+		return "", err
+	}
+	return parseIdentity(commit.Committer).Timestamp, nil
+}
+
+// GetLastParent returns the last parent of the given commit (as ordered by git).
+func (repo *GoRepo) GetLastParent(ref string) (string, error) {
+	_, commit, err := repo.getCommit(ref)
+	if err != nil {
+		return "", err
+	}
+	if len(commit.Parents) == 0 {
+		return "", nil
+	}
+	return commit.Parents[len(commit.Parents)-1], nil
+}
+
+// GetCommitDetails returns the details of a commit's metadata.
+func (repo *GoRepo) GetCommitDetails(ref string) (*CommitDetails, error) {
+	_, commit, err := repo.getCommit(ref)
+	if err != nil {
+		return nil, err
+	}
+	author := parseIdentity(commit.Author)
+	// The summary is the first paragraph of the message, joined into a single line.
+	paragraph := strings.SplitN(strings.TrimSpace(commit.Message), "\n\n", 2)[0]
+	return &CommitDetails{
+		Author:      author.Name,
+		AuthorEmail: author.Email,
+		Tree:        commit.Tree,
+		Time:        author.Timestamp,
+		Parents:     commit.Parents,
+		Summary:     strings.Join(strings.Fields(paragraph), " "),
+	}, nil
+}
+
+// datedCommit is a commit hash along with its commit time, used for date-ordered traversals.
+type datedCommit struct {
+	Hash string
+	Time int64
+}
+
+// commitQueue is a priority queue of commits which yields the most recent commit first.
+type commitQueue []datedCommit
+
+func (q commitQueue) Len() int            { return len(q) }
+func (q commitQueue) Less(i, j int) bool  { return q[i].Time > q[j].Time }
+func (q commitQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x interface{}) { *q = append(*q, x.(datedCommit)) }
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	last := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return last
+}
+
+// walkAncestors visits the given commit and all of its ancestors, newest first.
+//
+// The traversal stops early if the visit function returns false.
+func (repo *GoRepo) walkAncestors(start string, visit func(hash string, commit *commitObject) bool) error {
+	hash, _, err := repo.getCommit(start)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{hash: true}
+	queue := &commitQueue{{Hash: hash}}
+	for queue.Len() > 0 {
+		next := heap.Pop(queue).(datedCommit)
+		_, commit, err := repo.getCommit(next.Hash)
+		if err != nil {
+			return err
+		}
+		if !visit(next.Hash, commit) {
+			return nil
+		}
+		for _, parent := range commit.Parents {
+			if seen[parent] {
+				continue
+			}
+			seen[parent] = true
+			_, parentCommit, err := repo.getCommit(parent)
+			if err != nil {
+				return err
+			}
+			timestamp, _ := strconv.ParseInt(parseIdentity(parentCommit.Committer).Timestamp, 10, 64)
+			heap.Push(queue, datedCommit{Hash: parent, Time: timestamp})
+		}
+	}
+	return nil
+}
+
+// ancestorSet returns the set of the given commit and all of its ancestors.
+func (repo *GoRepo) ancestorSet(revision string) (map[string]bool, error) {
+	ancestors := make(map[string]bool)
+	err := repo.walkAncestors(revision, func(hash string, commit *commitObject) bool {
+		ancestors[hash] = true
+		return true
+	})
+	return ancestors, err
+}
+
+// MergeBase determines if the first commit that is an ancestor of the two arguments.
+//
+// When there are multiple candidates, this returns the most recent one.
+func (repo *GoRepo) MergeBase(a, b string) (string, error) {
+	ancestors, err := repo.ancestorSet(a)
+	if err != nil {
+		return "", err
+	}
+	mergeBase := ""
+	err = repo.walkAncestors(b, func(hash string, commit *commitObject) bool {
+		if ancestors[hash] {
+			mergeBase = hash
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	if mergeBase == "" {
+		return "", fmt.Errorf("No merge base found for %q and %q", a, b)
+	}
+	return mergeBase, nil
+}
+
+// IsAncestor determines if the first argument points to a commit that is an ancestor of the second.
+func (repo *GoRepo) IsAncestor(ancestor, descendant string) (bool, error) {
+	ancestorHash, err := repo.resolveCommit(ancestor)
+	if err != nil {
+		return false, fmt.Errorf("Error while trying to determine commit ancestry: %v", err)
+	}
+	found := false
+	err = repo.walkAncestors(descendant, func(hash string, commit *commitObject) bool {
+		found = hash == ancestorHash
+		return !found
+	})
+	if err != nil {
+		return false, fmt.Errorf("Error while trying to determine commit ancestry: %v", err)
+	}
+	return found, nil
+}
+
+// AreAncestors determines which of the commits in the first argument are ancestors of the second.
+//
+// The returned slice has one entry for each of the given commits. This is
+// equivalent to calling IsAncestor for each commit, but only has to walk the
+// history of the descendant once.
+func (repo *GoRepo) AreAncestors(ancestors []string, descendant string) ([]bool, error) {
+	result := make([]bool, len(ancestors))
+	if len(ancestors) == 0 {
+		return result, nil
+	}
+	reachable, err := repo.ancestorSet(descendant)
+	if err != nil {
+		return nil, fmt.Errorf("Error while trying to determine commit ancestry: %v", err)
+	}
+	for i, ancestor := range ancestors {
+		if hash, err := repo.resolveCommit(ancestor); err == nil {
+			result[i] = reachable[hash]
+		}
+	}
+	return result, nil
+}
+
+// Diff computes the diff between two given commits.
+func (repo *GoRepo) Diff(left, right string, diffArgs ...string) (string, error) {
+	return "", errNotSupported("Computing diffs")
+}
+
+// RangeDiff compares two versions of a series of commits, each given by its base and head commits.
+//
+// This shows the differences between the changes made by each series, even
+// when the two series were based on different commits.
+func (repo *GoRepo) RangeDiff(oldBase, oldHead, newBase, newHead string, diffArgs ...string) (string, error) {
+	return "", errNotSupported("Computing diffs")
+}
+
+// readTreePath returns the hash and mode of the entry at the given path within the given tree.
+func (repo *GoRepo) readTreePath(treeHash, path string) (treeEntry, error) {
+	entry := treeEntry{Mode: "40000", Hash: treeHash}
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if entry.Mode != "40000" {
+			return treeEntry{}, fmt.Errorf("fatal: path '%s' does not exist", path)
+		}
+		contents, err := repo.objects.readType(entry.Hash, "tree")
+		if err != nil {
+			return treeEntry{}, err
+		}
+		entries, err := parseTree(contents)
+		if err != nil {
+			return treeEntry{}, err
+		}
+		found := false
+		for _, child := range entries {
+			if child.Name == name {
+				entry = child
+				found = true
+				break
+			}
+		}
+		if !found {
+			return treeEntry{}, fmt.Errorf("fatal: path '%s' does not exist", path)
+		}
+	}
+	return entry, nil
+}
+
+// Show returns the contents of the given file at the given commit.
+func (repo *GoRepo) Show(commit, path string) (string, error) {
+	_, commitObj, err := repo.getCommit(commit)
+	if err != nil {
+		return "", err
+	}
+	entry, err := repo.readTreePath(commitObj.Tree, path)
+	if err != nil {
+		return "", err
+	}
+	contents, err := repo.objects.readType(entry.Hash, "blob")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// SwitchToRef changes the currently-checked-out ref.
+func (repo *GoRepo) SwitchToRef(ref string) error {
+	return errNotSupported("Switching refs")
+}
+
+// MergeRef merges the given ref into the current one.
+//
+// The ref argument is the ref to merge, and fastForward indicates that the
+// current ref should only move forward, as opposed to creating a bubble merge.
+// The messages argument(s) provide text that should be included in the default
+// merge commit message (separated by blank lines).
+func (repo *GoRepo) MergeRef(ref string, fastForward bool, messages ...string) error {
+	return errNotSupported("Merging refs")
+}
+
+// RebaseRef rebases the given ref into the current one.
+func (repo *GoRepo) RebaseRef(ref string) error {
+	return errNotSupported("Rebasing refs")
+}
+
+// ListCommitsBetween returns the list of commits between the two given revisions.
+//
+// The "from" parameter is the starting point (exclusive), and the "to"
+// parameter is the ending point (inclusive).
+//
+// The "from" commit does not need to be an ancestor of the "to" commit. If it
+// is not, then the merge base of the two is used as the starting point.
+// Admittedly, this makes calling these the "between" commits is a bit of a
+// misnomer, but it also makes the method easier to use when you want to
+// generate the list of changes in a feature branch, as it eliminates the need
+// to explicitly calculate the merge base. This also makes the semantics of the
+// method compatible with git's built-in "rev-list" command.
+//
+// The generated list is in chronological order (with the oldest commit first).
+func (repo *GoRepo) ListCommitsBetween(from, to string) ([]string, error) {
+	excluded, err := repo.ancestorSet(from)
+	if err != nil {
+		return nil, err
+	}
+	bottom, err := repo.MergeBase(from, to)
+	if err != nil {
+		return nil, err
+	}
+	var included []string
+	err = repo.walkAncestors(to, func(hash string, commit *commitObject) bool {
+		if !excluded[hash] {
+			included = append(included, hash)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Only keep the commits that descend from the bottom of the range, which
+	// mirrors the "--ancestry-path" behavior of "git rev-list".
+	descends := map[string]bool{bottom: true}
+	var commits []string
+	for i := len(included) - 1; i >= 0; i-- {
+		hash := included[i]
+		_, commit, err := repo.getCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		for _, parent := range commit.Parents {
+			if descends[parent] {
+				descends[hash] = true
+				commits = append(commits, hash)
+				break
+			}
+		}
+	}
+	return commits, nil
+}
+
+// readTree reads the contents of the given tree object.
+func (repo *GoRepo) readTree(hash string) ([]byte, error) {
+	return repo.objects.readType(hash, "tree")
+}
+
+// readNotes returns the map from annotated object to note blob for the given notes ref,
+// along with the hash of the notes commit.
+//
+// If the notes ref does not exist, then the returned map is nil.
+func (repo *GoRepo) readNotes(notesRef string) (map[string]string, string, error) {
+	notesCommit, err := repo.readRef(notesRef)
+	if err != nil || notesCommit == "" {
+		return nil, "", err
+	}
+	repo.mu.Lock()
+	notes, ok := repo.notes[notesCommit]
+	repo.mu.Unlock()
+	if ok {
+		return notes, notesCommit, nil
+	}
+	_, commit, err := repo.getCommit(notesCommit)
+	if err != nil {
+		return nil, "", err
+	}
+	notes = make(map[string]string)
+	if err := readNotesTree(repo.readTree, commit.Tree, "", notes); err != nil {
+		return nil, "", err
+	}
+	repo.mu.Lock()
+	repo.notes[notesCommit] = notes
+	repo.mu.Unlock()
+	return notes, notesCommit, nil
+}
+
+// GetNotes reads the notes from the given ref that annotate the given revision.
+func (repo *GoRepo) GetNotes(notesRef, revision string) []Note {
+	notesMap, _, err := repo.readNotes(notesRef)
+	if err != nil || notesMap == nil {
+		// We just assume that this means there are no notes
+		return nil
+	}
+	hash, err := repo.resolve(revision)
+	if err != nil {
+		return nil
+	}
+	blobHash, ok := notesMap[hash]
+	if !ok {
+		return nil
+	}
+	contents, err := repo.objects.readType(blobHash, "blob")
+	if err != nil {
+		return nil
+	}
+	var notes []Note
+	for _, line := range strings.Split(strings.TrimSpace(string(contents)), "\n") {
+		notes = append(notes, Note([]byte(line)))
+	}
+	return notes
+}
+
+// writeNoteToTree returns the hash of a copy of the given notes tree, with the note for
+// the given object replaced by the given blob.
+//
+// This preserves the fanout of the existing tree: if the note already exists, or
+// there is already a subtree matching the next two characters of the object hash,
+// then the note is written at that location.
+func (repo *GoRepo) writeNoteToTree(treeHash, prefix, objHash, blobHash string) (string, error) {
+	var entries []treeEntry
+	if treeHash != "" {
+		contents, err := repo.objects.readType(treeHash, "tree")
+		if err != nil {
+			return "", err
+		}
+		if entries, err = parseTree(contents); err != nil {
+			return "", err
+		}
+	}
+	remainder := objHash[len(prefix):]
+	fanout := false
+	for i, entry := range entries {
+		if entry.Name == remainder {
+			entries[i].Hash = blobHash
+			return repo.writeTree(entries)
+		}
+		if entry.Mode == "40000" && len(entry.Name) == 2 && isHexHash(entry.Name, 2) {
+			fanout = true
+			if strings.HasPrefix(remainder, entry.Name) {
+				subtree, err := repo.writeNoteToTree(entry.Hash, prefix+entry.Name, objHash, blobHash)
+				if err != nil {
+					return "", err
+				}
+				entries[i].Hash = subtree
+				return repo.writeTree(entries)
+			}
+		}
+	}
+	if fanout && len(remainder) > 2 {
+		subtree, err := repo.writeNoteToTree("", prefix+remainder[:2], objHash, blobHash)
+		if err != nil {
+			return "", err
+		}
+		entries = append(entries, treeEntry{Mode: "40000", Name: remainder[:2], Hash: subtree})
+		return repo.writeTree(entries)
+	}
+	entries = append(entries, treeEntry{Mode: "100644", Name: remainder, Hash: blobHash})
+	return repo.writeTree(entries)
+}
+
+func (repo *GoRepo) writeTree(entries []treeEntry) (string, error) {
+	contents, err := encodeTree(entries)
+	if err != nil {
+		return "", err
+	}
+	return repo.objects.write("tree", contents)
+}
+
+// getIdentity returns the identity to record for new commits, in the same format used by git.
+func (repo *GoRepo) getIdentity() (string, error) {
+	name := os.Getenv("GIT_COMMITTER_NAME")
+	if name == "" {
+		name = repo.getConfig("user.name")
+	}
+	email := os.Getenv("GIT_COMMITTER_EMAIL")
+	if email == "" {
+		email = repo.getConfig("user.email")
+	}
+	if name == "" || email == "" {
+		return "", fmt.Errorf("The user.name and user.email git config values must be set")
+	}
+	now := time.Now()
+	return fmt.Sprintf("%s <%s> %d %s", name, email, now.Unix(), now.Format("-0700")), nil
+}
+
+// updateRef atomically changes the given ref from the old hash to the new one.
+//
+// An empty old hash means that the ref must not already exist.
+func (repo *GoRepo) updateRef(ref, oldHash, newHash string) error {
+	refPath := repo.refPath(ref)
+	if err := os.MkdirAll(filepath.Dir(refPath), 0755); err != nil {
+		return err
+	}
+	lockPath := refPath + ".lock"
+	lock, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to lock the ref %q: %v", ref, err)
+	}
+	defer os.Remove(lockPath)
+	currentHash, err := repo.readRef(ref)
+	if err == nil && currentHash != oldHash {
+		err = fmt.Errorf("The ref %q was concurrently modified", ref)
+	}
+	if err == nil {
+		_, err = lock.WriteString(newHash + "\n")
+	}
+	if closeErr := lock.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(lockPath, refPath)
+}
+
+// AppendNote appends a note to a revision under the given ref.
+//
+// Like "git notes append", the new note is separated from any existing note
+// by a blank line, and the change is recorded as a new commit on the notes ref.
+func (repo *GoRepo) AppendNote(notesRef, revision string, note Note) error {
+	objHash, err := repo.resolve(revision)
+	if err != nil {
+		return err
+	}
+	notesMap, notesCommit, err := repo.readNotes(notesRef)
+	if err != nil {
+		return err
+	}
+	var contents []byte
+	var treeHash string
+	if notesCommit != "" {
+		_, commit, err := repo.getCommit(notesCommit)
+		if err != nil {
+			return err
+		}
+		treeHash = commit.Tree
+		if existingBlob, ok := notesMap[objHash]; ok {
+			existing, err := repo.objects.readType(existingBlob, "blob")
+			if err != nil {
+				return err
+			}
+			contents = append([]byte(strings.TrimRight(string(existing), "\n")), '\n', '\n')
+		}
+	}
+	contents = append(contents, note...)
+	contents = append(contents, '\n')
+	blobHash, err := repo.objects.write("blob", contents)
+	if err != nil {
+		return err
+	}
+	newTree, err := repo.writeNoteToTree(treeHash, "", objHash, blobHash)
+	if err != nil {
+		return err
+	}
+	ident, err := repo.getIdentity()
+	if err != nil {
+		return err
+	}
+	commitText := "tree " + newTree + "\n"
+	if notesCommit != "" {
+		commitText += "parent " + notesCommit + "\n"
+	}
+	commitText += "author " + ident + "\ncommitter " + ident + "\n\nNotes added by 'git notes append'\n"
+	newCommit, err := repo.objects.write("commit", []byte(commitText))
+	if err != nil {
+		return err
+	}
+	return repo.updateRef(notesRef, notesCommit, newCommit)
+}
+
+// ListNotedRevisions returns the collection of revisions that are annotated by notes in the given ref.
+func (repo *GoRepo) ListNotedRevisions(notesRef string) []string {
+	notesMap, _, err := repo.readNotes(notesRef)
+	if err != nil {
+		return nil
+	}
+	var revisions []string
+	for objHash := range notesMap {
+		// If a note points to an object that we do not know about (yet), then reading
+		// it will fail. We can safely just ignore those notes.
+		if objType, _, err := repo.objects.read(objHash); err == nil && objType == "commit" {
+			revisions = append(revisions, objHash)
+		}
+	}
+	sort.Strings(revisions)
+	return revisions
+}
+
+// ListNotedObjects returns the hashes of all of the objects that are annotated by notes in the given ref.
+func (repo *GoRepo) ListNotedObjects(notesRef string) []string {
+	notesMap, _, err := repo.readNotes(notesRef)
+	if err != nil {
+		return nil
+	}
+	var objHashes []string
+	for objHash := range notesMap {
+		objHashes = append(objHashes, objHash)
+	}
+	sort.Strings(objHashes)
+	return objHashes
+}
+
+// PushNotes pushes git notes to a remote repo.
+func (repo *GoRepo) PushNotes(remote, notesRefPattern string) error {
+	return errNotSupported("Pushing notes")
+}
+
+// PushNotesWithLease pushes git notes to a remote repo, but only if none of the
+// corresponding notes refs in the remote have changed since they were last fetched.
+//
+// If the push is rejected because the remote notes have changed, then the returned
+// error is ErrNotesPushRejected.
+func (repo *GoRepo) PushNotesWithLease(remote, notesRefPattern string) error {
+	return errNotSupported("Pushing notes")
+}
+
+// MergeNotes merges the notes from the second ref into those of the first.
+//
+// The contents of any note that differs between the two refs are combined
+// using the given merger. If that fails for any note, then the first ref is
+// left unchanged, and the returned error describes every failure.
+func (repo *GoRepo) MergeNotes(notesRef, otherRef string, merge NotesMerger) error {
+	return errNotSupported("Merging notes")
+}
+
+// RewriteNotes replaces the notes that annotate the given objects under the given ref.
+func (repo *GoRepo) RewriteNotes(notesRef string, notes map[string][]Note, message string) (string, error) {
+	return "", errNotSupported("Rewriting notes")
+}
+
+// PullNotes fetches the contents of the given notes ref from a remote repo,
+// and then merges them with the corresponding local notes using the given merger.
+func (repo *GoRepo) PullNotes(remote, notesRefPattern string, merge NotesMerger) error {
+	return errNotSupported("Pulling notes")
+}
+
+// FetchReviewRefs fetches the review refs of the given reviews from a remote repo.
+//
+// The reviewRefs argument maps the hash of each review to its review ref. Each
+// review ref that exists in the remote is stored locally in the ref returned by
+// GetFetchedReviewRef, while those that do not exist there are skipped.
+func (repo *GoRepo) FetchReviewRefs(remote string, reviewRefs map[string]string) error {
+	return errNotSupported("Fetching review refs")
+}
+
+// PruneFetchedReviewRefs deletes the review refs fetched by FetchReviewRefs
+// for every review other than the given ones, such as those of closed reviews.
+func (repo *GoRepo) PruneFetchedReviewRefs(reviews []string) error {
+	return errNotSupported("Pruning review refs")
+}
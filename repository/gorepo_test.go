@@ -0,0 +1,259 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testNotesRef = "refs/notes/devtools/test"
+
+// runGit runs the git command line tool in the given directory, and returns its trimmed output.
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"HOME="+dir,
+		"XDG_CONFIG_HOME="+filepath.Join(dir, ".config"),
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=Test User",
+		"GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=Test User",
+		"GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commitFile writes the given file, and commits it with the given message.
+func commitFile(t *testing.T, dir, path, contents, message string) string {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, path), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "add", path)
+	runGit(t, dir, "commit", "-q", "-m", message)
+	return runGit(t, dir, "rev-parse", "HEAD")
+}
+
+// testRepoCommits holds the commits of the repository created by newTestRepo.
+type testRepoCommits struct {
+	base, master, feature string
+}
+
+// newTestRepo creates a repository with a "master" branch and a "feature" branch
+// that each have two commits on top of a shared base commit, along with a note
+// on each of the commits.
+//
+// The test is skipped if the git command line tool is not installed.
+func newTestRepo(t *testing.T) (string, testRepoCommits) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("The git command line tool is not installed")
+	}
+	dir, err := ioutil.TempDir("", "git-appraise-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "init", "-q")
+	runGit(t, dir, "config", "user.name", "Test User")
+	runGit(t, dir, "config", "user.email", "test@example.com")
+	runGit(t, dir, "checkout", "-q", "-b", "master")
+
+	var commits testRepoCommits
+	commits.base = commitFile(t, dir, "README", "base\n", "Base commit")
+	commitFile(t, dir, "README", "base\nmaster\n", "First master commit")
+	commits.master = commitFile(t, dir, "master.txt", "master\n", "Second master commit")
+	runGit(t, dir, "checkout", "-q", "-b", "feature", commits.base)
+	commitFile(t, dir, "feature.txt", "feature\n", "First feature commit")
+	commits.feature = commitFile(t, dir, "feature.txt", "feature\nmore\n", "Second feature commit")
+	for _, commit := range []string{commits.base, commits.master, commits.feature} {
+		runGit(t, dir, "notes", "--ref", testNotesRef, "add", "-m", `{"note":"`+commit+`"}`, commit)
+	}
+	runGit(t, dir, "notes", "--ref", testNotesRef, "append", "-m", `{"note":"second"}`, commits.base)
+	return dir, commits
+}
+
+// checkParity checks that the GoRepo returns the same results as the GitRepo for the given repository.
+func checkParity(t *testing.T, dir string, commits testRepoCommits) {
+	t.Helper()
+	gitRepo, err := NewGitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goRepo, err := NewGoRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, repo := range []Repo{gitRepo, goRepo} {
+		mergeBase, err := repo.MergeBase("master", "feature")
+		if err != nil || mergeBase != commits.base {
+			t.Errorf("%T: unexpected merge base %q, %v", repo, mergeBase, err)
+		}
+		between, err := repo.ListCommitsBetween(commits.base, "master")
+		if err != nil || len(between) != 2 || between[1] != commits.master {
+			t.Errorf("%T: unexpected commits between the base and master: %v, %v", repo, between, err)
+		}
+		if isAncestor, err := repo.IsAncestor(commits.base, commits.feature); err != nil || !isAncestor {
+			t.Errorf("%T: the base commit is not an ancestor of the feature branch: %v", repo, err)
+		}
+		if isAncestor, err := repo.IsAncestor(commits.master, commits.feature); err != nil || isAncestor {
+			t.Errorf("%T: the master branch is an ancestor of the feature branch: %v", repo, err)
+		}
+	}
+
+	expectedDetails, err := gitRepo.GetCommitDetails(commits.feature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details, err := goRepo.GetCommitDetails(commits.feature); err != nil || !reflect.DeepEqual(details, expectedDetails) {
+		t.Errorf("Unexpected commit details %+v, %v; expected %+v", details, err, expectedDetails)
+	}
+	expectedContents, err := gitRepo.Show("feature", "feature.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := goRepo.Show("feature", "feature.txt"); err != nil || contents != expectedContents {
+		t.Errorf("Unexpected file contents %q, %v; expected %q", contents, err, expectedContents)
+	}
+	if revisions, expected := goRepo.ListNotedRevisions(testNotesRef), gitRepo.ListNotedRevisions(testNotesRef); !reflect.DeepEqual(revisions, expected) {
+		t.Errorf("Unexpected noted revisions %v; expected %v", revisions, expected)
+	}
+	for _, commit := range []string{commits.base, commits.master, commits.feature} {
+		if notes, expected := goRepo.GetNotes(testNotesRef, commit), gitRepo.GetNotes(testNotesRef, commit); len(expected) == 0 || !reflect.DeepEqual(notes, expected) {
+			t.Errorf("Unexpected notes for %s: %q; expected %q", commit, notes, expected)
+		}
+	}
+}
+
+func TestGoRepoParityWithLooseObjects(t *testing.T) {
+	dir, commits := newTestRepo(t)
+	defer os.RemoveAll(dir)
+	checkParity(t, dir, commits)
+}
+
+func TestGoRepoParityWithPackedObjects(t *testing.T) {
+	dir, commits := newTestRepo(t)
+	defer os.RemoveAll(dir)
+	runGit(t, dir, "gc", "-q")
+	if loose := runGit(t, dir, "count-objects"); !strings.HasPrefix(loose, "0 objects") {
+		t.Fatalf("Expected every object to be packed: %s", loose)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git", "packed-refs")); err != nil {
+		t.Fatalf("Expected the refs to be packed: %v", err)
+	}
+	checkParity(t, dir, commits)
+}
+
+func TestGoRepoAppendNote(t *testing.T) {
+	dir, commits := newTestRepo(t)
+	defer os.RemoveAll(dir)
+	goRepo, err := NewGoRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := goRepo.AppendNote(testNotesRef, commits.master, Note(`{"note":"appended"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := goRepo.AppendNote("refs/notes/devtools/new", "feature", Note(`{"note":"new"}`)); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"note":"` + commits.master + `"}` + "\n\n" + `{"note":"appended"}`
+	if notes := runGit(t, dir, "notes", "--ref", testNotesRef, "show", commits.master); notes != expected {
+		t.Errorf("Unexpected notes written by the GoRepo: %q", notes)
+	}
+	if notes := runGit(t, dir, "notes", "--ref", "refs/notes/devtools/new", "show", commits.feature); notes != `{"note":"new"}` {
+		t.Errorf("Unexpected notes written by the GoRepo: %q", notes)
+	}
+	runGit(t, dir, "fsck", "--strict", "--no-dangling")
+}
+
+func TestGoRepoFanoutNotes(t *testing.T) {
+	dir, commits := newTestRepo(t)
+	defer os.RemoveAll(dir)
+	// Write a notes tree that is fanned out in the same way as the trees that git
+	// writes once there are many notes, with the note for each commit stored as
+	// "<first two characters>/<remaining characters>".
+	if commits.base[:2] == commits.master[:2] {
+		t.Skip("The test commits share a fanout directory")
+	}
+	var rootEntries []string
+	for _, commit := range []string{commits.base, commits.master} {
+		cmd := exec.Command("git", "hash-object", "-w", "--stdin")
+		cmd.Dir = dir
+		cmd.Stdin = strings.NewReader(`{"note":"fanout ` + commit + `"}` + "\n")
+		blob, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		subtree := mkTree(t, dir, "100644 blob "+strings.TrimSpace(string(blob))+"\t"+commit[2:])
+		rootEntries = append(rootEntries, "040000 tree "+subtree+"\t"+commit[:2])
+	}
+	root := mkTree(t, dir, rootEntries...)
+	notesCommit := runGit(t, dir, "commit-tree", "-m", "Fanout notes", root)
+	runGit(t, dir, "update-ref", testNotesRef, notesCommit)
+
+	goRepo, err := NewGoRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notes := goRepo.GetNotes(testNotesRef, commits.master); len(notes) != 1 || string(notes[0]) != `{"note":"fanout `+commits.master+`"}` {
+		t.Fatalf("Unexpected fanout notes read by the GoRepo: %q", notes)
+	}
+	if err := goRepo.AppendNote(testNotesRef, commits.master, Note(`{"note":"appended"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := goRepo.AppendNote(testNotesRef, commits.feature, Note(`{"note":"new"}`)); err != nil {
+		t.Fatal(err)
+	}
+	// The new notes must keep the fanout, so that git can still find them.
+	tree := runGit(t, dir, "ls-tree", "-r", "--name-only", testNotesRef)
+	for _, commit := range []string{commits.base, commits.master, commits.feature} {
+		if !strings.Contains(tree, commit[:2]+"/"+commit[2:]) {
+			t.Errorf("The note for %s was not written to its fanout directory:\n%s", commit, tree)
+		}
+	}
+	expected := `{"note":"fanout ` + commits.master + `"}` + "\n\n" + `{"note":"appended"}`
+	if notes := runGit(t, dir, "notes", "--ref", testNotesRef, "show", commits.master); notes != expected {
+		t.Errorf("Unexpected fanout notes written by the GoRepo: %q", notes)
+	}
+	if notes := runGit(t, dir, "notes", "--ref", testNotesRef, "show", commits.feature); notes != `{"note":"new"}` {
+		t.Errorf("Unexpected fanout notes written by the GoRepo: %q", notes)
+	}
+}
+
+// mkTree writes a tree with the given entries, in the format used by "git ls-tree".
+func mkTree(t *testing.T, dir string, entries ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", "mktree")
+	cmd.Dir = dir
+	cmd.Stdin = strings.NewReader(strings.Join(entries, "\n") + "\n")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(out))
+}
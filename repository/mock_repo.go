@@ -17,10 +17,13 @@ limitations under the License.
 package repository
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"sync"
 )
 
 // Constants used for testing.
@@ -71,11 +74,16 @@ type mockCommit struct {
 }
 
 // mockRepoForTest defines an instance of Repo that can be used for testing.
+//
+// The notes and the git config are the only mutable parts of the repo, and
+// access to them is guarded by a mutex so that the mock can be used concurrently.
 type mockRepoForTest struct {
+	mu      *sync.RWMutex
 	Head    string
 	Refs    map[string]string            `json:"refs,omitempty"`
 	Commits map[string]mockCommit        `json:"commits,omitempty"`
 	Notes   map[string]map[string]string `json:"notes,omitempty"`
+	Config  map[string][]string          `json:"config,omitempty"`
 }
 
 // NewMockRepoForTest returns a mocked-out instance of the Repo interface that has been pre-populated with test data.
@@ -131,7 +139,11 @@ func NewMockRepoForTest() Repo {
 		Parents: []string{TestCommitF},
 	}
 	return mockRepoForTest{
+		mu:   new(sync.RWMutex),
 		Head: TestTargetRef,
+		Config: map[string][]string{
+			"remote.origin.url": []string{"https://example.com/repo.git"},
+		},
 		Refs: map[string]string{
 			TestTargetRef: TestCommitJ,
 			TestReviewRef: TestCommitI,
@@ -162,11 +174,23 @@ func NewMockRepoForTest() Repo {
 	}
 }
 
+// WithContext returns a copy of the repo whose operations are bound to the given context.
+func (r mockRepoForTest) WithContext(ctx context.Context) Repo { return r }
+
 // GetPath returns the path to the repo.
 func (r mockRepoForTest) GetPath() string { return "~/mockRepo/" }
 
+// GetGitDir returns the path to the git directory that holds the repo's objects and refs.
+//
+// The mock repo has no such directory, so tool-specific local state is never persisted.
+func (r mockRepoForTest) GetGitDir() (string, error) {
+	return "", fmt.Errorf("The mock repo does not have a git directory")
+}
+
 // GetRepoStateHash returns a hash which embodies the entire current state of a repository.
 func (r mockRepoForTest) GetRepoStateHash() (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	repoJSON, err := json.Marshal(r)
 	if err != nil {
 		return "", err
@@ -174,6 +198,28 @@ func (r mockRepoForTest) GetRepoStateHash() (string, error) {
 	return fmt.Sprintf("%x", sha1.Sum([]byte(repoJSON))), nil
 }
 
+// GetConfig returns the value of the given git config setting.
+//
+// The returned value is empty if the setting is not set.
+func (r mockRepoForTest) GetConfig(key string) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	values := r.Config[key]
+	if len(values) == 0 {
+		return "", nil
+	}
+	return values[len(values)-1], nil
+}
+
+// SetMockConfig sets the values of the given git config setting in a repo
+// returned by NewMockRepoForTest, replacing any existing values.
+func SetMockConfig(repo Repo, key string, values ...string) {
+	r := repo.(mockRepoForTest)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Config[key] = values
+}
+
 // GetUserEmail returns the email address that the user has used to configure git.
 func (r mockRepoForTest) GetUserEmail() (string, error) { return "user@example.com", nil }
 
@@ -183,6 +229,19 @@ func (r mockRepoForTest) GetCoreEditor() (string, error) { return "vi", nil }
 // GetSubmitStrategy returns the way in which a review is submitted
 func (r mockRepoForTest) GetSubmitStrategy() (string, error) { return "merge", nil }
 
+// GetReviewRemotes returns the remotes that reviews are pushed to and pulled from.
+func (r mockRepoForTest) GetReviewRemotes() ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if remotes := r.Config["appraise.remote"]; len(remotes) > 0 {
+		return remotes, nil
+	}
+	return []string{"origin"}, nil
+}
+
+// GetParallelism returns the maximum number of operations that should be run concurrently.
+func (r mockRepoForTest) GetParallelism() (int, error) { return 4, nil }
+
 // HasUncommittedChanges returns true if there are local, uncommitted changes.
 func (r mockRepoForTest) HasUncommittedChanges() (bool, error) { return false, nil }
 
@@ -243,6 +302,15 @@ func (r mockRepoForTest) getCommit(ref string) (mockCommit, error) {
 	return r.Commits[commit], err
 }
 
+// ResolveReviewRefCommit returns the commit pointed to by the review ref of the given review.
+//
+// This is like ResolveRefCommit, except that if the review ref does not exist
+// locally, then the copy of it that was fetched for the review by FetchReviewRefs
+// takes precedence over any remote refs.
+func (r mockRepoForTest) ResolveReviewRefCommit(review, ref string) (string, error) {
+	return resolveReviewRefCommit(r, review, ref)
+}
+
 // GetCommitMessage returns the message stored in the commit pointed to by the given ref.
 func (r mockRepoForTest) GetCommitMessage(ref string) (string, error) {
 	commit, err := r.getCommit(ref)
@@ -322,6 +390,21 @@ func (r mockRepoForTest) IsAncestor(ancestor, descendant string) (bool, error) {
 	return false, nil
 }
 
+// AreAncestors determines which of the commits in the first argument are ancestors of the second.
+//
+// The returned slice has one entry for each of the given commits.
+func (r mockRepoForTest) AreAncestors(ancestors []string, descendant string) ([]bool, error) {
+	result := make([]bool, len(ancestors))
+	for i, ancestor := range ancestors {
+		isAncestor, err := r.IsAncestor(ancestor, descendant)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = isAncestor
+	}
+	return result, nil
+}
+
 // MergeBase determines if the first commit that is an ancestor of the two arguments.
 func (r mockRepoForTest) MergeBase(a, b string) (string, error) {
 	ancestors, err := r.ancestors(a)
@@ -341,6 +424,14 @@ func (r mockRepoForTest) Diff(left, right string, diffArgs ...string) (string, e
 	return fmt.Sprintf("Diff between %q and %q", left, right), nil
 }
 
+// RangeDiff compares two versions of a series of commits, each given by its base and head commits.
+//
+// This shows the differences between the changes made by each series, even
+// when the two series were based on different commits.
+func (r mockRepoForTest) RangeDiff(oldBase, oldHead, newBase, newHead string, diffArgs ...string) (string, error) {
+	return fmt.Sprintf("Range diff between %q..%q and %q..%q", oldBase, oldHead, newBase, newHead), nil
+}
+
 // Show returns the contents of the given file at the given commit.
 func (r mockRepoForTest) Show(commit, path string) (string, error) {
 	return fmt.Sprintf("%s:%s", commit, path), nil
@@ -392,16 +483,18 @@ func (r mockRepoForTest) ListCommitsBetween(from, to string) ([]string, error) {
 
 // GetNotes reads the notes from the given ref that annotate the given revision.
 func (r mockRepoForTest) GetNotes(notesRef, revision string) []Note {
-	notesText := r.Notes[notesRef][revision]
-	var notes []Note
-	for _, line := range strings.Split(notesText, "\n") {
-		notes = append(notes, Note(line))
-	}
-	return notes
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return splitNotes(r.Notes[notesRef][revision])
 }
 
 // AppendNote appends a note to a revision under the given ref.
 func (r mockRepoForTest) AppendNote(ref, revision string, note Note) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.Notes[ref]; !ok {
+		r.Notes[ref] = make(map[string]string)
+	}
 	existingNotes := r.Notes[ref][revision]
 	newNotes := existingNotes + "\n" + string(note)
 	r.Notes[ref][revision] = newNotes
@@ -410,19 +503,137 @@ func (r mockRepoForTest) AppendNote(ref, revision string, note Note) error {
 
 // ListNotedRevisions returns the collection of revisions that are annotated by notes in the given ref.
 func (r mockRepoForTest) ListNotedRevisions(notesRef string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	var revisions []string
 	for revision := range r.Notes[notesRef] {
 		if _, ok := r.Commits[revision]; ok {
 			revisions = append(revisions, revision)
 		}
 	}
+	sort.Strings(revisions)
 	return revisions
 }
 
+// ListNotedObjects returns the hashes of all of the objects that are annotated by notes in the given ref.
+func (r mockRepoForTest) ListNotedObjects(notesRef string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var objHashes []string
+	for objHash := range r.Notes[notesRef] {
+		objHashes = append(objHashes, objHash)
+	}
+	sort.Strings(objHashes)
+	return objHashes
+}
+
 // PushNotes pushes git notes to a remote repo.
 func (r mockRepoForTest) PushNotes(remote, notesRefPattern string) error { return nil }
 
+// PushNotesWithLease pushes git notes to a remote repo, but only if none of the
+// corresponding notes refs in the remote have changed since they were last fetched.
+//
+// If the push is rejected because the remote notes have changed, then the returned
+// error is ErrNotesPushRejected.
+func (r mockRepoForTest) PushNotesWithLease(remote, notesRefPattern string) error { return nil }
+
+// MergeNotes merges the notes from the second ref into those of the first.
+//
+// The contents of any note that differs between the two refs are combined
+// using the given merger. If that fails for any note, then the first ref is
+// left unchanged, and the returned error describes every failure.
+func (r mockRepoForTest) MergeNotes(notesRef, otherRef string, merge NotesMerger) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	merged := make(map[string]string)
+	for revision, notesText := range r.Notes[notesRef] {
+		merged[revision] = notesText
+	}
+	var errs []string
+	for revision, otherText := range r.Notes[otherRef] {
+		localText, ok := r.Notes[notesRef][revision]
+		if ok && localText == otherText {
+			continue
+		}
+		var local, remote []Note
+		if ok {
+			local = splitNotes(localText)
+		}
+		remote = splitNotes(otherText)
+		notes, err := merge(notesRef, revision, local, remote)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", revision, err))
+			continue
+		}
+		var lines []string
+		for _, note := range notes {
+			lines = append(lines, string(note))
+		}
+		merged[revision] = strings.Join(lines, "\n")
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("Failed to merge %s:\n%s", otherRef, strings.Join(errs, "\n"))
+	}
+	r.Notes[notesRef] = merged
+	return nil
+}
+
+// splitNotes splits the text of a note into its individual lines.
+func splitNotes(notesText string) []Note {
+	var notes []Note
+	for _, line := range strings.Split(notesText, "\n") {
+		notes = append(notes, Note(line))
+	}
+	return notes
+}
+
+// RewriteNotes replaces the notes that annotate the given objects under the given ref.
+func (r mockRepoForTest) RewriteNotes(notesRef string, notes map[string][]Note, message string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.Notes[notesRef]; !ok {
+		return "", fmt.Errorf("There are no notes in %q to rewrite", notesRef)
+	}
+	var lines []string
+	for object, objectNotes := range notes {
+		lines = lines[:0]
+		for _, note := range objectNotes {
+			lines = append(lines, string(note))
+		}
+		r.Notes[notesRef][object] = strings.Join(lines, "\n")
+	}
+	return fmt.Sprintf("%x", sha1.Sum([]byte(message))), nil
+}
+
 // PullNotes fetches the contents of the given notes ref from a remote repo,
-// and then merges them with the corresponding local notes using the
-// "cat_sort_uniq" strategy.
-func (r mockRepoForTest) PullNotes(remote, notesRefPattern string) error { return nil }
+// and then merges them with the corresponding local notes using the given merger.
+func (r mockRepoForTest) PullNotes(remote, notesRefPattern string, merge NotesMerger) error {
+	return nil
+}
+
+// FetchReviewRefs fetches the review refs of the given reviews from a remote repo.
+//
+// The reviewRefs argument maps the hash of each review to its review ref. Each
+// review ref that exists in the remote is stored locally in the ref returned by
+// GetFetchedReviewRef, while those that do not exist there are skipped.
+func (r mockRepoForTest) FetchReviewRefs(remote string, reviewRefs map[string]string) error {
+	return nil
+}
+
+// PruneFetchedReviewRefs deletes the review refs fetched by FetchReviewRefs
+// for every review other than the given ones, such as those of closed reviews.
+func (r mockRepoForTest) PruneFetchedReviewRefs(reviews []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keep := make(map[string]bool)
+	for _, review := range reviews {
+		keep[GetFetchedReviewRef(review)] = true
+	}
+	for ref := range r.Refs {
+		if strings.HasPrefix(ref, fetchedReviewRefPrefix) && !keep[ref] {
+			delete(r.Refs, ref)
+		}
+	}
+	return nil
+}
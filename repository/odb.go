@@ -0,0 +1,542 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Object types, as they are encoded in the header of a packed object.
+const (
+	packedCommit   = 1
+	packedTree     = 2
+	packedBlob     = 3
+	packedTag      = 4
+	packedOfsDelta = 6
+	packedRefDelta = 7
+)
+
+var packedTypeNames = map[byte]string{
+	packedCommit: "commit",
+	packedTree:   "tree",
+	packedBlob:   "blob",
+	packedTag:    "tag",
+}
+
+// packIndexMagic is the header of a version 2 pack index file.
+var packIndexMagic = []byte{0377, 't', 'O', 'c', 0, 0, 0, 2}
+
+// packFile represents a single packfile along with its (version 2) index.
+type packFile struct {
+	path    string
+	fanout  [256]uint32
+	hashes  []byte
+	offsets []byte
+	large   []byte
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openPackFile reads the index for the given packfile.
+//
+// The packfile itself is only opened once an object is read from it.
+func openPackFile(indexPath string) (*packFile, error) {
+	index, err := ioutil.ReadFile(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	if len(index) < len(packIndexMagic)+256*4 || !bytes.Equal(index[:len(packIndexMagic)], packIndexMagic) {
+		return nil, fmt.Errorf("Unsupported pack index %q", indexPath)
+	}
+	pack := &packFile{
+		path: strings.TrimSuffix(indexPath, ".idx") + ".pack",
+	}
+	pos := len(packIndexMagic)
+	for i := range pack.fanout {
+		pack.fanout[i] = binary.BigEndian.Uint32(index[pos:])
+		pos += 4
+	}
+	count := int(pack.fanout[255])
+	if len(index) < pos+count*(20+4+4) {
+		return nil, fmt.Errorf("Truncated pack index %q", indexPath)
+	}
+	pack.hashes = index[pos : pos+count*20]
+	pos += count * 20
+	// Skip the CRC32 checksums, as we do not verify them.
+	pos += count * 4
+	pack.offsets = index[pos : pos+count*4]
+	pos += count * 4
+	pack.large = index[pos:]
+	return pack, nil
+}
+
+// find returns the offset of the given object within the packfile, or -1 if it is not present.
+func (pack *packFile) find(hash []byte) int64 {
+	var lo uint32
+	if hash[0] > 0 {
+		lo = pack.fanout[hash[0]-1]
+	}
+	hi := pack.fanout[hash[0]]
+	i := lo + uint32(sort.Search(int(hi-lo), func(i int) bool {
+		start := (int(lo) + i) * 20
+		return bytes.Compare(pack.hashes[start:start+20], hash) >= 0
+	}))
+	if i >= hi || !bytes.Equal(pack.hashes[i*20:i*20+20], hash) {
+		return -1
+	}
+	offset := binary.BigEndian.Uint32(pack.offsets[i*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset)
+	}
+	largeIndex := int(offset&0x7fffffff) * 8
+	return int64(binary.BigEndian.Uint64(pack.large[largeIndex:]))
+}
+
+// readAt reads the (fully resolved) object stored at the given offset in the packfile.
+func (pack *packFile) readAt(store *objectStore, offset int64) (string, []byte, error) {
+	pack.mu.Lock()
+	if pack.file == nil {
+		file, err := os.Open(pack.path)
+		if err != nil {
+			pack.mu.Unlock()
+			return "", nil, err
+		}
+		pack.file = file
+	}
+	file := pack.file
+	pack.mu.Unlock()
+
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, 1<<62))
+	header, err := reader.ReadByte()
+	if err != nil {
+		return "", nil, err
+	}
+	objType := (header >> 4) & 7
+	size := int64(header & 0x0f)
+	for shift := uint(4); header&0x80 != 0; shift += 7 {
+		if header, err = reader.ReadByte(); err != nil {
+			return "", nil, err
+		}
+		size |= int64(header&0x7f) << shift
+	}
+
+	var baseType string
+	var base []byte
+	switch objType {
+	case packedOfsDelta:
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", nil, err
+		}
+		baseOffset := int64(b & 0x7f)
+		for b&0x80 != 0 {
+			if b, err = reader.ReadByte(); err != nil {
+				return "", nil, err
+			}
+			baseOffset = ((baseOffset + 1) << 7) | int64(b&0x7f)
+		}
+		baseType, base, err = pack.readAt(store, offset-baseOffset)
+		if err != nil {
+			return "", nil, err
+		}
+	case packedRefDelta:
+		baseHash := make([]byte, 20)
+		if _, err := io.ReadFull(reader, baseHash); err != nil {
+			return "", nil, err
+		}
+		baseType, base, err = store.read(hex.EncodeToString(baseHash))
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	data, err := inflate(reader, size)
+	if err != nil {
+		return "", nil, err
+	}
+	if base == nil {
+		typeName, ok := packedTypeNames[objType]
+		if !ok {
+			return "", nil, fmt.Errorf("Unknown packed object type %d in %q", objType, pack.path)
+		}
+		return typeName, data, nil
+	}
+	result, err := applyDelta(base, data)
+	return baseType, result, err
+}
+
+// inflate decompresses exactly size bytes from the given zlib stream.
+func inflate(r io.Reader, size int64) ([]byte, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readDeltaSize reads one of the variable-length sizes at the start of a delta.
+func readDeltaSize(delta []byte) (int, []byte) {
+	var size int
+	var shift uint
+	for len(delta) > 0 {
+		b := delta[0]
+		delta = delta[1:]
+		size |= int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return size, delta
+}
+
+// applyDelta reconstructs an object from its base and a git delta.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	baseSize, delta := readDeltaSize(delta)
+	if baseSize != len(base) {
+		return nil, fmt.Errorf("Delta base size mismatch: expected %d, got %d", baseSize, len(base))
+	}
+	resultSize, delta := readDeltaSize(delta)
+	result := make([]byte, 0, resultSize)
+	for len(delta) > 0 {
+		cmd := delta[0]
+		delta = delta[1:]
+		if cmd&0x80 == 0 {
+			// Insert the next cmd bytes of the delta.
+			if cmd == 0 || int(cmd) > len(delta) {
+				return nil, fmt.Errorf("Malformed delta insert instruction")
+			}
+			result = append(result, delta[:cmd]...)
+			delta = delta[cmd:]
+			continue
+		}
+		// Copy a range of the base, where the low bits of cmd say which offset
+		// and size bytes are present.
+		var offset, size int
+		for i := uint(0); i < 7; i++ {
+			if cmd&(1<<i) == 0 {
+				continue
+			}
+			if len(delta) == 0 {
+				return nil, fmt.Errorf("Truncated delta copy instruction")
+			}
+			if i < 4 {
+				offset |= int(delta[0]) << (8 * i)
+			} else {
+				size |= int(delta[0]) << (8 * (i - 4))
+			}
+			delta = delta[1:]
+		}
+		if size == 0 {
+			size = 0x10000
+		}
+		if offset+size > len(base) {
+			return nil, fmt.Errorf("Delta copy instruction out of range")
+		}
+		result = append(result, base[offset:offset+size]...)
+	}
+	if len(result) != resultSize {
+		return nil, fmt.Errorf("Delta result size mismatch: expected %d, got %d", resultSize, len(result))
+	}
+	return result, nil
+}
+
+// objectStore provides read and write access to the loose objects and packfiles
+// stored in a git "objects" directory, without using the git binary.
+type objectStore struct {
+	dir string
+
+	mu    sync.Mutex
+	packs []*packFile
+	// packsLoaded records the set of index files that have already been opened.
+	packsLoaded map[string]bool
+}
+
+func newObjectStore(dir string) *objectStore {
+	return &objectStore{
+		dir:         dir,
+		packsLoaded: make(map[string]bool),
+	}
+}
+
+// loadPacks opens any index files that have been added since the last call,
+// and returns the full list of known packs.
+func (store *objectStore) loadPacks() ([]*packFile, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	indexPaths, err := filepath.Glob(filepath.Join(store.dir, "pack", "*.idx"))
+	if err != nil {
+		return nil, err
+	}
+	for _, indexPath := range indexPaths {
+		if store.packsLoaded[indexPath] {
+			continue
+		}
+		pack, err := openPackFile(indexPath)
+		if err != nil {
+			return nil, err
+		}
+		store.packs = append(store.packs, pack)
+		store.packsLoaded[indexPath] = true
+	}
+	return store.packs, nil
+}
+
+func (store *objectStore) loosePath(hash string) string {
+	return filepath.Join(store.dir, hash[:2], hash[2:])
+}
+
+// readLoose reads a loose object, returning os.ErrNotExist if there is no such object.
+func (store *objectStore) readLoose(hash string) (string, []byte, error) {
+	file, err := os.Open(store.loosePath(hash))
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	zr, err := zlib.NewReader(file)
+	if err != nil {
+		return "", nil, err
+	}
+	defer zr.Close()
+	contents, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return "", nil, err
+	}
+	nul := bytes.IndexByte(contents, 0)
+	if nul < 0 {
+		return "", nil, fmt.Errorf("Malformed loose object %q", hash)
+	}
+	header := strings.Split(string(contents[:nul]), " ")
+	if len(header) != 2 {
+		return "", nil, fmt.Errorf("Malformed loose object header for %q", hash)
+	}
+	size, err := strconv.Atoi(header[1])
+	if err != nil || size != len(contents)-nul-1 {
+		return "", nil, fmt.Errorf("Malformed loose object size for %q", hash)
+	}
+	return header[0], contents[nul+1:], nil
+}
+
+// read returns the type and contents of the object with the given (full) hash.
+func (store *objectStore) read(hash string) (string, []byte, error) {
+	if !isHexHash(hash, 40) {
+		return "", nil, fmt.Errorf("Invalid object hash %q", hash)
+	}
+	objType, data, err := store.readLoose(hash)
+	if err == nil || !os.IsNotExist(err) {
+		return objType, data, err
+	}
+	rawHash, _ := hex.DecodeString(hash)
+	packs, err := store.loadPacks()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, pack := range packs {
+		if offset := pack.find(rawHash); offset >= 0 {
+			return pack.readAt(store, offset)
+		}
+	}
+	return "", nil, fmt.Errorf("Unknown object %q", hash)
+}
+
+// has returns true if the object store contains an object with the given hash.
+func (store *objectStore) has(hash string) bool {
+	if !isHexHash(hash, 40) {
+		return false
+	}
+	if _, err := os.Stat(store.loosePath(hash)); err == nil {
+		return true
+	}
+	rawHash, _ := hex.DecodeString(hash)
+	packs, err := store.loadPacks()
+	if err != nil {
+		return false
+	}
+	for _, pack := range packs {
+		if pack.find(rawHash) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// readType returns the contents of the object with the given hash, which must be of the given type.
+func (store *objectStore) readType(hash, objType string) ([]byte, error) {
+	actualType, data, err := store.read(hash)
+	if err != nil {
+		return nil, err
+	}
+	if actualType != objType {
+		return nil, fmt.Errorf("Object %q is a %s rather than a %s", hash, actualType, objType)
+	}
+	return data, nil
+}
+
+// write stores the given object as a loose object, and returns its hash.
+func (store *objectStore) write(objType string, data []byte) (string, error) {
+	header := fmt.Sprintf("%s %d\x00", objType, len(data))
+	hasher := sha1.New()
+	hasher.Write([]byte(header))
+	hasher.Write(data)
+	hash := fmt.Sprintf("%x", hasher.Sum(nil))
+	if store.has(hash) {
+		return hash, nil
+	}
+
+	objectPath := store.loosePath(hash)
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(objectPath), "tmp_obj_")
+	if err != nil {
+		return "", err
+	}
+	zw := zlib.NewWriter(tmp)
+	zw.Write([]byte(header))
+	zw.Write(data)
+	err = zw.Close()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0444)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), objectPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return hash, nil
+}
+
+// encodeTree builds the binary representation of a git tree object.
+//
+// The entries are sorted the same way git sorts them, which treats the
+// names of subtrees as if they ended with a trailing slash.
+func encodeTree(entries []treeEntry) ([]byte, error) {
+	sortKey := func(entry treeEntry) string {
+		if entry.Mode == "40000" {
+			return entry.Name + "/"
+		}
+		return entry.Name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortKey(entries[i]) < sortKey(entries[j])
+	})
+	var buffer bytes.Buffer
+	for _, entry := range entries {
+		rawHash, err := hex.DecodeString(entry.Hash)
+		if err != nil || len(rawHash) != 20 {
+			return nil, fmt.Errorf("Invalid tree entry hash %q", entry.Hash)
+		}
+		buffer.WriteString(entry.Mode)
+		buffer.WriteByte(' ')
+		buffer.WriteString(entry.Name)
+		buffer.WriteByte(0)
+		buffer.Write(rawHash)
+	}
+	return buffer.Bytes(), nil
+}
+
+// commitObject represents the parsed contents of a git commit object.
+type commitObject struct {
+	Tree      string
+	Parents   []string
+	Author    string
+	Committer string
+	Message   string
+}
+
+// parseCommit parses the contents of a git commit object.
+func parseCommit(data []byte) (*commitObject, error) {
+	var commit commitObject
+	headers := string(data)
+	if end := strings.Index(headers, "\n\n"); end >= 0 {
+		commit.Message = headers[end+2:]
+		headers = headers[:end]
+	}
+	for _, line := range strings.Split(headers, "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "tree":
+			commit.Tree = parts[1]
+		case "parent":
+			commit.Parents = append(commit.Parents, parts[1])
+		case "author":
+			commit.Author = parts[1]
+		case "committer":
+			commit.Committer = parts[1]
+		}
+	}
+	if commit.Tree == "" {
+		return nil, fmt.Errorf("Malformed commit: missing tree")
+	}
+	return &commit, nil
+}
+
+// identity represents a parsed author or committer line from a commit.
+type identity struct {
+	Name      string
+	Email     string
+	Timestamp string
+	Timezone  string
+}
+
+// parseIdentity parses an identity of the form "<name> <<email>> <timestamp> <timezone>".
+func parseIdentity(ident string) identity {
+	var result identity
+	emailStart := strings.Index(ident, "<")
+	emailEnd := strings.LastIndex(ident, ">")
+	if emailStart < 0 || emailEnd < emailStart {
+		return result
+	}
+	result.Name = strings.TrimSpace(ident[:emailStart])
+	result.Email = ident[emailStart+1 : emailEnd]
+	fields := strings.Fields(ident[emailEnd+1:])
+	if len(fields) > 0 {
+		result.Timestamp = fields[0]
+	}
+	if len(fields) > 1 {
+		result.Timezone = fields[1]
+	}
+	return result
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package repository
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("Hello, World!")
+	delta := []byte{
+		// Base size, followed by result size.
+		13, 17,
+		// Copy "Hello, " (offset 0, size 7).
+		0x80 | 0x10, 7,
+		// Insert "Gopher".
+		6, 'G', 'o', 'p', 'h', 'e', 'r',
+		// Copy "!" (offset 12, size 1), followed by inserting "!!!".
+		0x80 | 0x01 | 0x10, 12, 1,
+		3, '!', '!', '!',
+	}
+	result, err := applyDelta(base, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "Hello, Gopher!!!!" {
+		t.Fatalf("Unexpected delta result: %q", result)
+	}
+	if _, err := applyDelta([]byte("too short"), delta); err == nil {
+		t.Fatal("Expected an error when applying a delta to a base of the wrong size")
+	}
+}
+
+func TestTreeRoundTrip(t *testing.T) {
+	entries := []treeEntry{
+		{Mode: "100644", Name: "foo.go", Hash: strings.Repeat("a", 40)},
+		{Mode: "40000", Name: "foo", Hash: strings.Repeat("b", 40)},
+		{Mode: "100644", Name: "bar", Hash: strings.Repeat("c", 40)},
+	}
+	encoded, err := encodeTree(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parseTree(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Git sorts subtrees as if their names ended with a slash, so "foo.go" comes before "foo".
+	expectedNames := []string{"bar", "foo.go", "foo"}
+	if len(parsed) != len(expectedNames) {
+		t.Fatalf("Unexpected tree entries: %v", parsed)
+	}
+	for i, name := range expectedNames {
+		if parsed[i].Name != name {
+			t.Fatalf("Unexpected tree entries: %v", parsed)
+		}
+	}
+}
+
+func TestParseIdentity(t *testing.T) {
+	ident := parseIdentity("Jane Doe <jane@example.com> 1136239445 -0700")
+	if ident.Name != "Jane Doe" || ident.Email != "jane@example.com" || ident.Timestamp != "1136239445" || ident.Timezone != "-0700" {
+		t.Fatalf("Unexpected identity: %+v", ident)
+	}
+}
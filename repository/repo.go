@@ -17,6 +17,15 @@ limitations under the License.
 // Package repository contains helper methods for working with a Git repo.
 package repository
 
+import (
+	"context"
+	"errors"
+)
+
+// ErrNotesPushRejected is returned when notes cannot be pushed because the notes in
+// the remote repo have changed since they were last fetched.
+var ErrNotesPushRejected = errors.New("The remote notes have changed since they were last fetched")
+
 // Note represents the contents of a git-note
 type Note []byte
 
@@ -30,14 +39,36 @@ type CommitDetails struct {
 	Summary     string   `json:"summary,omitempty"`
 }
 
+// NotesMerger combines the contents of a note that differs between two notes refs.
+//
+// The local and remote arguments hold the lines of the note for the given object
+// in each of the refs, and either may be empty if that ref has no such note. The
+// returned lines become the contents of the merged note.
+type NotesMerger func(notesRef, object string, local, remote []Note) ([]Note, error)
+
 // Repo represents a source code repository.
 type Repo interface {
+	// WithContext returns a copy of the repo whose operations are bound to the given context.
+	//
+	// Cancelling the context kills any git processes started by the returned repo.
+	WithContext(ctx context.Context) Repo
+
 	// GetPath returns the path to the repo.
 	GetPath() string
 
+	// GetGitDir returns the path to the git directory that holds the repo's objects and refs.
+	//
+	// This is also where the tool stores any local state, such as its caches.
+	GetGitDir() (string, error)
+
 	// GetRepoStateHash returns a hash which embodies the entire current state of a repository.
 	GetRepoStateHash() (string, error)
 
+	// GetConfig returns the value of the given git config setting.
+	//
+	// The returned value is empty if the setting is not set.
+	GetConfig(key string) (string, error)
+
 	// GetUserEmail returns the email address that the user has used to configure git.
 	GetUserEmail() (string, error)
 
@@ -47,6 +78,18 @@ type Repo interface {
 	// GetSubmitStrategy returns the way in which a review is submitted
 	GetSubmitStrategy() (string, error)
 
+	// GetReviewRemotes returns the remotes that reviews are pushed to and pulled from.
+	//
+	// These are configured using the multi-valued "appraise.remote" git config
+	// setting, and default to just "origin".
+	GetReviewRemotes() ([]string, error)
+
+	// GetParallelism returns the maximum number of operations that should be run concurrently.
+	//
+	// This is configured using the "appraise.jobs" git config setting, and
+	// defaults to the number of available CPUs.
+	GetParallelism() (int, error)
+
 	// HasUncommittedChanges returns true if there are local, uncommitted changes.
 	HasUncommittedChanges() (bool, error)
 
@@ -73,6 +116,13 @@ type Repo interface {
 	// performed by the reviewee.
 	ResolveRefCommit(ref string) (string, error)
 
+	// ResolveReviewRefCommit returns the commit pointed to by the review ref of the given review.
+	//
+	// This is like ResolveRefCommit, except that if the review ref does not exist
+	// locally, then the copy of it that was fetched for the review by FetchReviewRefs
+	// takes precedence over any remote refs.
+	ResolveReviewRefCommit(review, ref string) (string, error)
+
 	// GetCommitMessage returns the message stored in the commit pointed to by the given ref.
 	GetCommitMessage(ref string) (string, error)
 
@@ -91,9 +141,22 @@ type Repo interface {
 	// IsAncestor determines if the first argument points to a commit that is an ancestor of the second.
 	IsAncestor(ancestor, descendant string) (bool, error)
 
+	// AreAncestors determines which of the commits in the first argument are ancestors of the second.
+	//
+	// The returned slice has one entry for each of the given commits. This is
+	// equivalent to calling IsAncestor for each commit, but only has to walk the
+	// history of the descendant once.
+	AreAncestors(ancestors []string, descendant string) ([]bool, error)
+
 	// Diff computes the diff between two given commits.
 	Diff(left, right string, diffArgs ...string) (string, error)
 
+	// RangeDiff compares two versions of a series of commits, each given by its base and head commits.
+	//
+	// This shows the differences between the changes made by each series, even
+	// when the two series were based on different commits.
+	RangeDiff(oldBase, oldHead, newBase, newHead string, diffArgs ...string) (string, error)
+
 	// Show returns the contents of the given file at the given commit.
 	Show(commit, path string) (string, error)
 
@@ -136,11 +199,68 @@ type Repo interface {
 	// ListNotedRevisions returns the collection of revisions that are annotated by notes in the given ref.
 	ListNotedRevisions(notesRef string) []string
 
+	// ListNotedObjects returns the hashes of all of the objects that are annotated by notes in the given ref.
+	//
+	// Unlike ListNotedRevisions, this includes objects that are not commits and
+	// objects that are not present in the repository.
+	ListNotedObjects(notesRef string) []string
+
 	// PushNotes pushes git notes to a remote repo.
 	PushNotes(remote, notesRefPattern string) error
 
+	// PushNotesWithLease pushes git notes to a remote repo, but only if none of the
+	// corresponding notes refs in the remote have changed since they were last fetched.
+	//
+	// If the push is rejected because the remote notes have changed, then the returned
+	// error is ErrNotesPushRejected.
+	PushNotesWithLease(remote, notesRefPattern string) error
+
+	// MergeNotes merges the notes from the second ref into those of the first.
+	//
+	// The contents of any note that differs between the two refs are combined
+	// using the given merger. If that fails for any note, then the first ref is
+	// left unchanged, and the returned error describes every failure.
+	MergeNotes(notesRef, otherRef string, merge NotesMerger) error
+
 	// PullNotes fetches the contents of the given notes ref from a remote repo,
-	// and then merges them with the corresponding local notes using the
-	// "cat_sort_uniq" strategy.
-	PullNotes(remote, notesRefPattern string) error
+	// and then merges them with the corresponding local notes using the given merger.
+	PullNotes(remote, notesRefPattern string, merge NotesMerger) error
+
+	// RewriteNotes replaces the notes that annotate the given objects under the given ref.
+	//
+	// Every replacement is recorded in a single new commit on the notes ref, which
+	// has the given message, and the hash of that commit is returned. Objects that
+	// are not given keep their existing notes.
+	RewriteNotes(notesRef string, notes map[string][]Note, message string) (string, error)
+
+	// FetchReviewRefs fetches the review refs of the given reviews from a remote repo.
+	//
+	// The reviewRefs argument maps the hash of each review to its review ref. Each
+	// review ref that exists in the remote is stored locally in the ref returned by
+	// GetFetchedReviewRef, while those that do not exist there are skipped.
+	FetchReviewRefs(remote string, reviewRefs map[string]string) error
+
+	// PruneFetchedReviewRefs deletes the review refs fetched by FetchReviewRefs
+	// for every review other than the given ones, such as those of closed reviews.
+	PruneFetchedReviewRefs(reviews []string) error
+}
+
+// fetchedReviewRefPrefix is the namespace holding the review refs fetched by FetchReviewRefs.
+const fetchedReviewRefPrefix = "refs/appraise/reviews/"
+
+// GetFetchedReviewRef returns the local ref that holds the fetched review ref of the given review.
+func GetFetchedReviewRef(review string) string {
+	return fetchedReviewRefPrefix + review
+}
+
+// resolveReviewRefCommit implements ResolveReviewRefCommit in terms of the other methods of the repo.
+func resolveReviewRefCommit(repo Repo, review, ref string) (string, error) {
+	if err := repo.VerifyGitRef(ref); err == nil {
+		return repo.GetCommitHash(ref)
+	}
+	fetchedRef := GetFetchedReviewRef(review)
+	if err := repo.VerifyGitRef(fetchedRef); err == nil {
+		return repo.GetCommitHash(fetchedRef)
+	}
+	return repo.ResolveRefCommit(ref)
 }
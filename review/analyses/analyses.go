@@ -20,6 +20,8 @@ package analyses
 import (
 	"encoding/json"
 	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/signing"
+	"github.com/google/git-appraise/review/versions"
 	"io/ioutil"
 	"net/http"
 	"sort"
@@ -41,6 +43,9 @@ const (
 	FormatVersion = 0
 )
 
+// Format describes the versions of the analyses report format, and how to upgrade older analyses reports.
+var Format = versions.Format{Latest: FormatVersion}
+
 // Report represents a build/test status report generated by analyses tool.
 // Every field is optional.
 type Report struct {
@@ -49,6 +54,8 @@ type Report struct {
 	Status    string `json:"status,omitempty"`
 	// Version represents the version of the metadata format.
 	Version int `json:"v,omitempty"`
+	// Sig optionally holds the signature of the report, made by the tool that wrote it.
+	signing.Sig
 }
 
 // LocationRange represents the location within a source file that an analysis message covers.
@@ -116,9 +123,12 @@ func (analysesReport Report) GetNotes() ([]Note, error) {
 
 // Parse parses an analysis report from a git note.
 func Parse(note repository.Note) (Report, error) {
-	bytes := []byte(note)
 	var report Report
-	err := json.Unmarshal(bytes, &report)
+	note, err := Format.Upgrade(note)
+	if err != nil {
+		return report, err
+	}
+	err = json.Unmarshal([]byte(note), &report)
 	return report, err
 }
 
@@ -148,7 +158,7 @@ func ParseAllValid(notes []repository.Note) []Report {
 	var reports []Report
 	for _, note := range notes {
 		report, err := Parse(note)
-		if err == nil && report.Version == FormatVersion {
+		if err == nil {
 			reports = append(reports, report)
 		}
 	}
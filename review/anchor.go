@@ -0,0 +1,260 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/google/git-appraise/review/comment"
+	"strconv"
+	"strings"
+)
+
+// Anchor describes where an inline comment lands in the head commit of a review.
+type Anchor struct {
+	// Location is the translated location of the comment, and is nil if the comment is outdated.
+	Location *comment.Location `json:"location,omitempty"`
+	// Outdated is set if the file or lines under discussion were deleted or rewritten
+	// between the commented upon commit and the head commit.
+	Outdated bool `json:"outdated,omitempty"`
+}
+
+// hunk describes a single block of changed lines in a diff with no context lines.
+//
+// Following the unified diff format, a count of zero means that the hunk only
+// adds or removes lines, in which case the start is the line before that change.
+type hunk struct {
+	oldStart, oldCount uint32
+	newStart, newCount uint32
+}
+
+// fileDiff describes how a single file changed between two commits.
+type fileDiff struct {
+	// newPath is the path of the file in the new commit, and is empty if the file was deleted.
+	newPath string
+	// hunks are the changed blocks of lines, in order.
+	hunks []hunk
+}
+
+// diffArgs are the arguments used to compute the diffs that comments are re-anchored across.
+//
+// The prefixes are given explicitly, so that they do not depend on the user's diff settings.
+var diffArgs = []string{"-U0", "-M", "--no-color", "--no-ext-diff", "--src-prefix=a/", "--dst-prefix=b/"}
+
+// parseDiffPath parses a path from a diff header line, removing the given prefix.
+func parseDiffPath(path, prefix string) string {
+	if strings.HasPrefix(path, "\"") {
+		if unquoted, err := strconv.Unquote(path); err == nil {
+			path = unquoted
+		}
+	}
+	return strings.TrimPrefix(path, prefix)
+}
+
+// parseHunkRange parses one side of a hunk header, such as "10,2" or "10".
+func parseHunkRange(value string) (start, count uint32, err error) {
+	parts := strings.SplitN(value, ",", 2)
+	parsed, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	start, count = uint32(parsed), 1
+	if len(parts) == 2 {
+		parsed, err = strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return 0, 0, err
+		}
+		count = uint32(parsed)
+	}
+	return start, count, nil
+}
+
+// parseDiff parses the output of "git diff" run with the diffArgs above.
+//
+// The result maps the old path of each changed file to how it changed. Files
+// that are missing from the result were not changed.
+func parseDiff(diff string) (map[string]*fileDiff, error) {
+	files := make(map[string]*fileDiff)
+	var current *fileDiff
+	// Once the hunks for a file start, lines such as "--- " are the contents of removed lines.
+	inHunks := false
+	scanner := bufio.NewScanner(strings.NewReader(diff))
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			current = &fileDiff{}
+			inHunks = false
+		case current == nil:
+			continue
+		case strings.HasPrefix(line, "@@ "):
+			inHunks = true
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("Malformed hunk header %q", line)
+			}
+			var h hunk
+			var err error
+			if h.oldStart, h.oldCount, err = parseHunkRange(strings.TrimPrefix(fields[1], "-")); err != nil {
+				return nil, fmt.Errorf("Malformed hunk header %q", line)
+			}
+			if h.newStart, h.newCount, err = parseHunkRange(strings.TrimPrefix(fields[2], "+")); err != nil {
+				return nil, fmt.Errorf("Malformed hunk header %q", line)
+			}
+			current.hunks = append(current.hunks, h)
+		case inHunks:
+			continue
+		case strings.HasPrefix(line, "rename from "):
+			files[parseDiffPath(strings.TrimPrefix(line, "rename from "), "")] = current
+		case strings.HasPrefix(line, "rename to "):
+			current.newPath = parseDiffPath(strings.TrimPrefix(line, "rename to "), "")
+		case strings.HasPrefix(line, "--- "):
+			if path := strings.TrimPrefix(line, "--- "); path != "/dev/null" {
+				files[parseDiffPath(path, "a/")] = current
+			}
+		case strings.HasPrefix(line, "+++ "):
+			if path := strings.TrimPrefix(line, "+++ "); path != "/dev/null" {
+				current.newPath = parseDiffPath(path, "b/")
+			}
+		}
+	}
+	return files, scanner.Err()
+}
+
+// translateLine returns the line in the new version of the file that corresponds
+// to the given line in the old version.
+//
+// If the line was deleted or rewritten, then the returned bool is false.
+func (d *fileDiff) translateLine(line uint32) (uint32, bool) {
+	offset := int64(0)
+	for _, h := range d.hunks {
+		if h.oldCount == 0 {
+			// The hunk only inserts lines, after the line given as its start.
+			if line <= h.oldStart {
+				break
+			}
+		} else {
+			if line < h.oldStart {
+				break
+			}
+			if line < h.oldStart+h.oldCount {
+				return 0, false
+			}
+		}
+		offset += int64(h.newCount) - int64(h.oldCount)
+	}
+	return uint32(int64(line) + offset), true
+}
+
+// translateRange returns the range in the new version of the file that corresponds
+// to the given range in the old version.
+//
+// If any line within the range was deleted or rewritten, then the returned bool is false.
+func (d *fileDiff) translateRange(r comment.Range) (comment.Range, bool) {
+	lastLine := r.LastLine()
+	for _, h := range d.hunks {
+		if h.oldCount > 0 && h.oldStart <= lastLine && h.oldStart+h.oldCount > r.StartLine {
+			return comment.Range{}, false
+		}
+	}
+	startLine, _ := d.translateLine(r.StartLine)
+	if r.EndLine != 0 {
+		r.EndLine, _ = d.translateLine(r.EndLine)
+	}
+	r.StartLine = startLine
+	return r, true
+}
+
+// anchor locates the given comment location in the target commit, using the
+// diffs between the commented upon commit and the target commit.
+func anchor(location comment.Location, target string, diff map[string]*fileDiff) *Anchor {
+	translated := comment.Location{
+		Commit: target,
+		Path:   location.Path,
+		Side:   location.Side,
+	}
+	fileDiff, changed := diff[location.Path]
+	if !changed {
+		translated.Range = location.Range
+		return &Anchor{Location: &translated}
+	}
+	if fileDiff.newPath == "" {
+		return &Anchor{Outdated: true}
+	}
+	translated.Path = fileDiff.newPath
+	if location.Range != nil && location.Range.StartLine > 0 {
+		r, ok := fileDiff.translateRange(*location.Range)
+		if !ok {
+			return &Anchor{Outdated: true}
+		}
+		translated.Range = &r
+	}
+	return &Anchor{Location: &translated}
+}
+
+// AnchorComments locates each of the comments about a specific file in the
+// current commits of the review, and records the result as the anchor of the
+// comment's thread.
+//
+// Comments on the base side of the review are located in its base commit, and
+// all other comments in its head commit. Comments are located by following the
+// lines they discuss through the diff between the commented upon commit and
+// that target commit. A comment whose lines were since deleted or rewritten is
+// marked as outdated.
+func (r *Review) AnchorComments() error {
+	targets := make(map[string]string)
+	getTarget := func(side string) (string, error) {
+		if target, ok := targets[side]; ok {
+			return target, nil
+		}
+		var target string
+		var err error
+		if side == comment.SideBase {
+			target, err = r.GetBaseCommit()
+		} else {
+			target, err = r.GetHeadCommit()
+		}
+		targets[side] = target
+		return target, err
+	}
+	diffs := make(map[string]map[string]*fileDiff)
+	for _, thread := range collectThreads(r.Comments, nil) {
+		location := thread.Comment.Location
+		if location == nil || location.Path == "" || location.Commit == "" {
+			continue
+		}
+		target, err := getTarget(location.Side)
+		if err != nil {
+			return err
+		}
+		key := location.Commit + ".." + target
+		diff, ok := diffs[key]
+		if !ok && location.Commit != target {
+			contents, err := r.Repo.Diff(location.Commit, target, diffArgs...)
+			if err != nil {
+				return err
+			}
+			if diff, err = parseDiff(contents); err != nil {
+				return err
+			}
+			diffs[key] = diff
+		}
+		thread.Anchor = anchor(*location, target, diff)
+	}
+	return nil
+}
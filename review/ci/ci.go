@@ -20,6 +20,8 @@ package ci
 import (
 	"encoding/json"
 	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/signing"
+	"github.com/google/git-appraise/review/versions"
 	"sort"
 	"strconv"
 )
@@ -37,6 +39,9 @@ const (
 	FormatVersion = 0
 )
 
+// Format describes the versions of the CI report format, and how to upgrade older CI reports.
+var Format = versions.Format{Latest: FormatVersion}
+
 // Report represents a build/test status report generated by a continuous integration tool.
 //
 // Every field is optional.
@@ -47,13 +52,18 @@ type Report struct {
 	Agent     string `json:"agent,omitempty"`
 	// Version represents the version of the metadata format.
 	Version int `json:"v,omitempty"`
+	// Sig optionally holds the agent's signature of the report.
+	signing.Sig
 }
 
 // Parse parses a CI report from a git note.
 func Parse(note repository.Note) (Report, error) {
-	bytes := []byte(note)
 	var report Report
-	err := json.Unmarshal(bytes, &report)
+	note, err := Format.Upgrade(note)
+	if err != nil {
+		return report, err
+	}
+	err = json.Unmarshal([]byte(note), &report)
 	return report, err
 }
 
@@ -85,7 +95,7 @@ func ParseAllValid(notes []repository.Note) []Report {
 	var reports []Report
 	for _, note := range notes {
 		report, err := Parse(note)
-		if err == nil && report.Version == FormatVersion {
+		if err == nil {
 			if report.Status == "" || report.Status == StatusSuccess || report.Status == StatusFailure {
 				reports = append(reports, report)
 			}
@@ -18,10 +18,13 @@ limitations under the License.
 package comment
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/json"
 	"fmt"
 	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/signing"
+	"github.com/google/git-appraise/review/versions"
 	"strconv"
 	"time"
 )
@@ -30,13 +33,90 @@ import (
 const Ref = "refs/notes/devtools/discuss"
 
 // FormatVersion defines the latest version of the comment format supported by the tool.
-const FormatVersion = 0
+//
+// Version 1 added the EndLine, StartColumn, and EndColumn fields of a Range.
+// Comments that do not use those fields are still written as version 0, so
+// that older versions of the tool can continue to read them. Lines are numbered
+// from 1, so the ranges starting on line 0 that some version 0 comments about a
+// whole file hold are dropped when upgrading them.
+//
+// Version 2 added the Supersedes and Retracts fields. Edits and retractions are
+// always written as version 2, so that older versions of the tool ignore them
+// rather than showing them as new comments.
+const FormatVersion = 2
+
+// Format describes the versions of the comment format, and how to upgrade older comments.
+//
+// Comments are identified by the hash of their contents, so an upgrade that
+// changes a comment also changes its hash. When such upgrades are written back by
+// migrating the notes, the references to the upgraded comments are rewritten too.
+var Format = versions.Format{
+	Latest:   FormatVersion,
+	Upgrades: []versions.Upgrade{upgradeWholeFileRange, nil},
+}
+
+// upgradeWholeFileRange upgrades a comment from version 0 to version 1, by
+// dropping any range that starts on line 0, which stood for the whole file.
+func upgradeWholeFileRange(fields map[string]json.RawMessage) error {
+	raw, ok := fields["location"]
+	if !ok {
+		return nil
+	}
+	var location map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &location); err != nil || location == nil {
+		return err
+	}
+	rawRange, ok := location["range"]
+	if !ok {
+		return nil
+	}
+	var r *Range
+	if err := json.Unmarshal(rawRange, &r); err != nil || r == nil || r.StartLine != 0 {
+		return err
+	}
+	delete(location, "range")
+	upgraded, err := json.Marshal(location)
+	fields["location"] = upgraded
+	return err
+}
+
+// amendmentVersion is the version of the comment format used for edits and retractions.
+const amendmentVersion = 2
 
 // Range represents the range of text that is under discussion.
+//
+// Lines and columns are numbered starting from 1, and columns count bytes.
+// Both ends of the range are inclusive.
 type Range struct {
 	StartLine uint32 `json:"startLine"`
+	// If the end line is omitted, then the range ends on the start line.
+	EndLine uint32 `json:"endLine,omitempty"`
+	// If the start column is omitted, then the range starts at the beginning of the start line.
+	StartColumn uint32 `json:"startColumn,omitempty"`
+	// If the end column is omitted, then the range finishes at the end of the end line.
+	EndColumn uint32 `json:"endColumn,omitempty"`
+}
+
+// LastLine returns the last line included in the range.
+func (r Range) LastLine() uint32 {
+	if r.EndLine == 0 {
+		return r.StartLine
+	}
+	return r.EndLine
+}
+
+// RequiredVersion returns the oldest version of the comment format that can represent the range.
+func (r Range) RequiredVersion() int {
+	if r.EndLine == 0 && r.StartColumn == 0 && r.EndColumn == 0 {
+		return 0
+	}
+	return 1
 }
 
+// SideBase is the side of a location that refers to the base commit of a review,
+// rather than to one of the commits being reviewed.
+const SideBase = "base"
+
 // Location represents the location of a comment within a commit.
 type Location struct {
 	Commit string `json:"commit,omitempty"`
@@ -44,6 +124,11 @@ type Location struct {
 	Path string `json:"path,omitempty"`
 	// If the range is omitted, then the location represents an entire file.
 	Range *Range `json:"range,omitempty"`
+	// Side is SideBase for comments on the code as it was before the review, in
+	// which case the commit is the base commit of the review. This allows commenting
+	// on lines that the review deletes. If the side is omitted, then the comment is
+	// on the code being reviewed.
+	Side string `json:"side,omitempty"`
 }
 
 // Comment represents a review comment, and can occur in any of the following contexts:
@@ -68,8 +153,15 @@ type Comment struct {
 	// has been addressed. Otherwise, the parent is the commit, and this means that the
 	// change has been accepted. If the resolved bit is unset, then the comment is only an FYI.
 	Resolved *bool `json:"resolved,omitempty"`
+	// If supersedes is provided, then the comment is an edit of the comment with that hash,
+	// and replaces its description and resolved bit.
+	Supersedes string `json:"supersedes,omitempty"`
+	// If retracts is provided, then the comment withdraws the comment with that hash.
+	Retracts string `json:"retracts,omitempty"`
 	// Version represents the version of the metadata format.
 	Version int `json:"v,omitempty"`
+	// Sig optionally holds the author's signature of the comment.
+	signing.Sig
 }
 
 // New returns a new comment with the given description message.
@@ -83,27 +175,81 @@ func New(author string, description string) Comment {
 	}
 }
 
+// NewEdit returns a new comment that replaces the description and resolved bit
+// of the comment with the given hash.
+//
+// Only edits by the original author of a comment are applied.
+func NewEdit(author, supersedes, description string, resolved *bool) Comment {
+	c := New(author, description)
+	c.Supersedes = supersedes
+	c.Resolved = resolved
+	c.Version = amendmentVersion
+	return c
+}
+
+// NewRetraction returns a new comment that withdraws the comment with the given hash.
+//
+// Only retractions by the original author of a comment are applied.
+func NewRetraction(author, retracts string) Comment {
+	c := New(author, "")
+	c.Retracts = retracts
+	c.Version = amendmentVersion
+	return c
+}
+
+// IsAmendment returns true if the comment is an edit or retraction of another comment.
+func (comment Comment) IsAmendment() bool {
+	return comment.Supersedes != "" || comment.Retracts != ""
+}
+
 // Parse parses a review comment from a git note.
 func Parse(note repository.Note) (Comment, error) {
-	bytes := []byte(note)
 	var comment Comment
-	err := json.Unmarshal(bytes, &comment)
+	note, err := Format.Upgrade(note)
+	if err != nil {
+		return comment, err
+	}
+	err = json.Unmarshal([]byte(note), &comment)
 	return comment, err
 }
 
+// ParseWithHash parses a review comment from a git note, and returns the hash
+// that identifies it.
+//
+// The hash is that of the comment as written in the note, rather than as
+// upgraded to the latest version of the format, so that the references to
+// comments written in older versions keep working until the notes are migrated.
+func ParseWithHash(note repository.Note) (Comment, string, error) {
+	var comment Comment
+	upgraded, err := Format.Upgrade(note)
+	if err != nil {
+		return comment, "", err
+	}
+	if err := json.Unmarshal(upgraded, &comment); err != nil {
+		return comment, "", err
+	}
+	written := comment
+	if !bytes.Equal(upgraded, note) {
+		written = Comment{}
+		if err := json.Unmarshal(note, &written); err != nil {
+			return comment, "", err
+		}
+	}
+	hash, err := written.Hash()
+	return comment, hash, err
+}
+
 // ParseAllValid takes collection of git notes and tries to parse a review
 // comment from each one. Any notes that are not valid review comments get
 // ignored, as we expect the git notes to be a heterogenous list, with only
 // some of them being review comments.
+//
+// The comments are keyed by the hashes returned by ParseWithHash.
 func ParseAllValid(notes []repository.Note) map[string]Comment {
 	comments := make(map[string]Comment)
 	for _, note := range notes {
-		comment, err := Parse(note)
-		if err == nil && comment.Version == FormatVersion {
-			hash, err := comment.Hash()
-			if err == nil {
-				comments[hash] = comment
-			}
+		if comment, hash, err := ParseWithHash(note); err == nil {
+			comments[hash] = comment
 		}
 	}
 	return comments
@@ -0,0 +1,240 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/analyses"
+	"github.com/google/git-appraise/review/ci"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-appraise/review/revision"
+	"github.com/google/git-appraise/review/status"
+	"github.com/google/git-appraise/review/versions"
+	"github.com/google/git-appraise/schema"
+	"sort"
+)
+
+// The kinds of problems reported by Fsck.
+const (
+	// ProblemInvalidNote is a note that does not match the schema of its format.
+	ProblemInvalidNote = "invalid-note"
+	// ProblemUnsupportedNote is a note written in a newer version of its format than this tool supports.
+	ProblemUnsupportedNote = "unsupported-note"
+	// ProblemUnknownObject is a set of notes attached to an object that is not a commit in the repository.
+	ProblemUnknownObject = "unknown-object"
+	// ProblemOrphanedReply is a comment replying to a comment that does not exist.
+	ProblemOrphanedReply = "orphaned-reply"
+	// ProblemMissingTargetRef is a review that is not abandoned, but whose target ref does not exist.
+	ProblemMissingTargetRef = "missing-target-ref"
+	// ProblemDuplicateRequest is a request that repeats an earlier request for the same review.
+	ProblemDuplicateRequest = "duplicate-request"
+	// ProblemConflictingRequest is an open review that shares its review ref with
+	// another open review, so which of them is the review of that ref is ambiguous.
+	ProblemConflictingRequest = "conflicting-request"
+)
+
+// noteSchemas maps each of the devtools notes refs to the name of the schema for its notes.
+var noteSchemas = map[string]string{
+	request.Ref:  "request",
+	comment.Ref:  "comment",
+	ci.Ref:       "ci",
+	analyses.Ref: "analysis",
+	revision.Ref: "revision",
+	status.Ref:   "status",
+}
+
+// Problem describes an inconsistency found in the review notes.
+type Problem struct {
+	Kind string `json:"kind"`
+	Ref  string `json:"ref"`
+	// Object is the hash of the annotated object.
+	Object string `json:"object"`
+	// Line is the (1-based) line of the problematic note among the notes for the
+	// object, or 0 if the problem is not specific to a single note.
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s: %s %.12s line %d: %s", p.Kind, p.Ref, p.Object, p.Line, p.Message)
+	}
+	return fmt.Sprintf("%s: %s %.12s: %s", p.Kind, p.Ref, p.Object, p.Message)
+}
+
+// checkNotes validates each of the given notes, which annotate a single object,
+// against the schema of their format.
+func checkNotes(ref, object string, format versions.Format, s *schema.Schema, notes []repository.Note) []Problem {
+	var problems []Problem
+	for i, note := range notes {
+		note = repository.Note(bytes.TrimSpace(note))
+		if len(note) == 0 {
+			continue
+		}
+		problem := Problem{Ref: ref, Object: object, Line: i + 1}
+		if version, err := versions.Version(note); err == nil && version > format.Latest {
+			problem.Kind = ProblemUnsupportedNote
+			problem.Message = (&versions.UnsupportedError{Version: version, Latest: format.Latest}).Error()
+		} else if err := s.Validate(note); err != nil {
+			problem.Kind = ProblemInvalidNote
+			problem.Message = err.Error()
+		} else {
+			continue
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// checkReplies reports the comments among the given notes, which annotate a single
+// object, that reply to a comment that is not also among those notes.
+func checkReplies(object string, notes []repository.Note) []Problem {
+	comments := comment.ParseAllValid(notes)
+	var hashes []string
+	for hash := range comments {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	var problems []Problem
+	for _, hash := range hashes {
+		parent := comments[hash].Parent
+		if _, ok := comments[parent]; parent != "" && !ok {
+			problems = append(problems, Problem{
+				Kind:    ProblemOrphanedReply,
+				Ref:     comment.Ref,
+				Object:  object,
+				Message: fmt.Sprintf("comment %.12s replies to %.12s, which is not a comment on the same revision", hash, parent),
+			})
+		}
+	}
+	return problems
+}
+
+// checkRequests reports the requests among the given notes, which annotate a
+// single object, that repeat an earlier request, and whether the target ref of
+// the current request exists.
+//
+// Abandoned reviews are not checked for their target refs, since those are
+// commonly deleted once they are no longer needed.
+func checkRequests(repo repository.Repo, object string, notes []repository.Note) []Problem {
+	var problems []Problem
+	lines := make(map[string]int)
+	for i, note := range notes {
+		note = repository.Note(bytes.TrimSpace(note))
+		if len(note) == 0 {
+			continue
+		}
+		if first, ok := lines[string(note)]; ok {
+			problems = append(problems, Problem{
+				Kind:    ProblemDuplicateRequest,
+				Ref:     request.Ref,
+				Object:  object,
+				Line:    i + 1,
+				Message: fmt.Sprintf("repeats the request on line %d", first),
+			})
+		} else {
+			lines[string(note)] = i + 1
+		}
+	}
+	requests := request.ParseAllValid(notes)
+	if len(requests) == 0 || status.IsAbandoned(status.ParseAllValid(repo.GetNotes(status.Ref, object))) {
+		return problems
+	}
+	sort.Stable(requestsByTimestamp(requests))
+	target := requests[len(requests)-1].TargetRef
+	if err := repo.VerifyGitRef(target); err != nil {
+		problems = append(problems, Problem{
+			Kind:    ProblemMissingTargetRef,
+			Ref:     request.Ref,
+			Object:  object,
+			Message: fmt.Sprintf("the target ref %q does not exist", target),
+		})
+	}
+	return problems
+}
+
+// checkReviewRefs reports the open reviews that share their review ref with another open review.
+//
+// Submitted and abandoned reviews are not checked, since their review refs are
+// commonly reused for later reviews.
+func checkReviewRefs(repo repository.Repo) []Problem {
+	// Reviews that fail to load are already reported by the checks of their notes.
+	reviews, _ := ListOpen(repo)
+	reviewRefs := make(map[string]int)
+	for _, r := range reviews {
+		reviewRefs[r.Request.ReviewRef]++
+	}
+	var problems []Problem
+	for _, r := range reviews {
+		if count := reviewRefs[r.Request.ReviewRef]; count > 1 {
+			problems = append(problems, Problem{
+				Kind:    ProblemConflictingRequest,
+				Ref:     request.Ref,
+				Object:  r.Revision,
+				Message: fmt.Sprintf("the review ref %q is shared by %d open reviews", r.Request.ReviewRef, count),
+			})
+		}
+	}
+	return problems
+}
+
+// Fsck checks the notes in every devtools notes ref for problems, without changing anything.
+//
+// The problems are grouped by the refs of the notes that they were found in.
+func Fsck(repo repository.Repo) ([]Problem, error) {
+	var refs []string
+	for ref := range noteSchemas {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	var problems []Problem
+	for _, ref := range refs {
+		s, err := schema.Load(noteSchemas[ref])
+		if err != nil {
+			return nil, err
+		}
+		commits := make(map[string]bool)
+		for _, revision := range repo.ListNotedRevisions(ref) {
+			commits[revision] = true
+		}
+		for _, object := range repo.ListNotedObjects(ref) {
+			if !commits[object] {
+				problems = append(problems, Problem{
+					Kind:    ProblemUnknownObject,
+					Ref:     ref,
+					Object:  object,
+					Message: "the notes are attached to an object that is not a commit in this repository",
+				})
+			}
+			notes := repo.GetNotes(ref, object)
+			problems = append(problems, checkNotes(ref, object, noteFormats[ref], s, notes)...)
+			switch ref {
+			case comment.Ref:
+				problems = append(problems, checkReplies(object, notes)...)
+			case request.Ref:
+				problems = append(problems, checkRequests(repo, object, notes)...)
+			}
+		}
+		if ref == request.Ref {
+			problems = append(problems, checkReviewRefs(repo)...)
+		}
+	}
+	return problems, nil
+}
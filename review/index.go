@@ -0,0 +1,298 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-appraise/review/status"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// indexFormatVersion must be incremented whenever the layout of the index changes.
+	indexFormatVersion = 11
+
+	// indexPath is the location of the review index, relative to the git directory.
+	indexPath = "appraise/index.json"
+)
+
+// indexedReview is the cached state of a single review.
+type indexedReview struct {
+	// Fingerprint is the hash of the request, comment, and status notes for the review.
+	Fingerprint string `json:"fingerprint"`
+	// TargetCommit is the commit the target ref pointed to when Submitted was computed.
+	TargetCommit string            `json:"targetCommit,omitempty"`
+	Summary      Summary           `json:"summary"`
+	AllRequests  []request.Request `json:"allRequests"`
+}
+
+// reviewIndex is the on-disk cache of review summaries.
+//
+// The index is valid as-is for as long as the repo state hash is unchanged. When
+// that hash changes, the notes ref tips and per-review fingerprints are used to
+// determine which reviews actually need to be reloaded.
+type reviewIndex struct {
+	Version   int                      `json:"v"`
+	StateHash string                   `json:"stateHash"`
+	NotesTips map[string]string        `json:"notesTips"`
+	Revisions []string                 `json:"revisions"`
+	Reviews   map[string]indexedReview `json:"reviews"`
+}
+
+// getIndexFile returns the path of the review index for the given repo.
+//
+// If the repo has nowhere to store the index, then the returned path is empty.
+func getIndexFile(repo repository.Repo) string {
+	gitDir, err := repo.GetGitDir()
+	if err != nil || gitDir == "" {
+		return ""
+	}
+	return filepath.Join(gitDir, filepath.FromSlash(indexPath))
+}
+
+// readIndex reads the review index from the given file.
+//
+// Any problem reading the index, including it having been written by a
+// different version of the tool, results in a nil index.
+func readIndex(indexFile string) *reviewIndex {
+	if indexFile == "" {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(indexFile)
+	if err != nil {
+		return nil
+	}
+	var index reviewIndex
+	if err := json.Unmarshal(contents, &index); err != nil || index.Version != indexFormatVersion {
+		return nil
+	}
+	return &index
+}
+
+// writeIndex atomically replaces the review index in the given file.
+func writeIndex(indexFile string, index *reviewIndex) error {
+	if indexFile == "" {
+		return nil
+	}
+	contents, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(indexFile), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(indexFile), "index")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(contents)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), indexFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// getNotesTips returns the commits at the tips of the notes refs that make up a review summary.
+func getNotesTips(repo repository.Repo) map[string]string {
+	tips := make(map[string]string)
+	for _, notesRef := range []string{request.Ref, comment.Ref, status.Ref} {
+		// A missing notes ref simply means that there are no such notes yet.
+		tip, _ := repo.GetCommitHash(notesRef)
+		tips[notesRef] = tip
+	}
+	return tips
+}
+
+// fingerprintNotes computes a hash that changes whenever any of the given review notes change.
+func fingerprintNotes(notesByRef ...[]repository.Note) string {
+	var buffer bytes.Buffer
+	for _, notes := range notesByRef {
+		for _, note := range notes {
+			buffer.Write(note)
+			buffer.WriteByte('\n')
+		}
+		buffer.WriteByte(0)
+	}
+	return fmt.Sprintf("%x", sha1.Sum(buffer.Bytes()))
+}
+
+// summaries returns the review summaries stored in the index, in the order they were listed.
+func (index *reviewIndex) summaries(repo repository.Repo) []Summary {
+	var reviews []Summary
+	for _, revision := range index.Revisions {
+		reviews = append(reviews, *index.summary(repo, revision))
+	}
+	return reviews
+}
+
+// summary returns the review summary for the given revision, or nil if it is not in the index.
+func (index *reviewIndex) summary(repo repository.Repo, revision string) *Summary {
+	entry, ok := index.Reviews[revision]
+	if !ok {
+		return nil
+	}
+	summary := entry.Summary
+	summary.Repo = repo
+	summary.AllRequests = entry.AllRequests
+	return &summary
+}
+
+// updateIndex brings the given review index up to date with the current state of the repo.
+//
+// The previous index may be nil, in which case every review is loaded from scratch.
+// Otherwise, reviews whose notes and target refs are unchanged are reused as-is.
+//
+// If some reviews fail to load, then they are left out of the returned index,
+// and a LoadErrors value describing the failures is returned alongside it.
+func updateIndex(repo repository.Repo, previous *reviewIndex) (*reviewIndex, error) {
+	stateHash, err := repo.GetRepoStateHash()
+	if err != nil {
+		return nil, err
+	}
+	if previous != nil && previous.StateHash == stateHash {
+		return previous, nil
+	}
+	if previous == nil {
+		previous = &reviewIndex{}
+	}
+
+	index := &reviewIndex{
+		Version:   indexFormatVersion,
+		StateHash: stateHash,
+		NotesTips: getNotesTips(repo),
+		Reviews:   make(map[string]indexedReview),
+	}
+	// If a notes ref tip cannot be read, then we cannot tell if it changed, and have to assume it did.
+	notesUnchanged := len(previous.NotesTips) == len(index.NotesTips)
+	for notesRef, tip := range index.NotesTips {
+		notesUnchanged = notesUnchanged && tip != "" && previous.NotesTips[notesRef] == tip
+	}
+
+	revisions := previous.Revisions
+	if !notesUnchanged {
+		revisions = repo.ListNotedRevisions(request.Ref)
+	}
+
+	// Load the reviews whose notes have changed, using a bounded pool of concurrent
+	// workers. Each worker only writes to its own slots of these slices, so the
+	// final order matches the order of the revisions.
+	entries := make([]indexedReview, len(revisions))
+	found := make([]bool, len(revisions))
+	reloaded := make([]bool, len(revisions))
+	loadErrs := make([]error, len(revisions))
+	forEachConcurrently(getJobs(repo), len(revisions), func(i int) {
+		revision := revisions[i]
+		entries[i], found[i] = previous.Reviews[revision]
+		if notesUnchanged {
+			return
+		}
+		requestNotes := repo.GetNotes(request.Ref, revision)
+		commentNotes := repo.GetNotes(comment.Ref, revision)
+		statusNotes := repo.GetNotes(status.Ref, revision)
+		fingerprint := fingerprintNotes(requestNotes, commentNotes, statusNotes)
+		if found[i] && entries[i].Fingerprint == fingerprint {
+			return
+		}
+		summary, err := summaryFromNotes(repo, revision, requestNotes, commentNotes, statusNotes)
+		loadErrs[i] = err
+		found[i] = err == nil && summary != nil
+		if !found[i] {
+			return
+		}
+		entries[i] = indexedReview{
+			Fingerprint: fingerprint,
+			Summary:     *summary,
+			AllRequests: summary.AllRequests,
+		}
+		reloaded[i] = true
+	})
+
+	// Recompute the submitted state of every reloaded review, along with every
+	// review whose target ref has moved since it was last checked.
+	targetCommits := make(map[string]string)
+	var stale []*Summary
+	for i := range entries {
+		if !found[i] {
+			continue
+		}
+		entry := &entries[i]
+		targetRef := entry.Summary.Request.TargetRef
+		if _, ok := targetCommits[targetRef]; !ok {
+			targetCommits[targetRef], _ = repo.GetCommitHash(targetRef)
+		}
+		if reloaded[i] || targetCommits[targetRef] != entry.TargetCommit {
+			stale = append(stale, &entry.Summary)
+		}
+		entry.TargetCommit = targetCommits[targetRef]
+		entry.Summary.Repo = nil
+		entry.Summary.AllRequests = nil
+	}
+	var errs LoadErrors
+	for i, err := range loadErrs {
+		if err != nil {
+			errs = append(errs, LoadError{Revision: revisions[i], Err: err})
+		}
+	}
+	errs = append(errs, updateSubmitted(repo, stale)...)
+	failed := errs.failed()
+	for i, entry := range entries {
+		if found[i] && !failed[entry.Summary.Revision] {
+			index.Revisions = append(index.Revisions, entry.Summary.Revision)
+			index.Reviews[entry.Summary.Revision] = entry
+		}
+	}
+	return index, errs.asError()
+}
+
+// loadIndex returns the up-to-date review index for the given repo, updating
+// the on-disk copy if necessary.
+//
+// An index with failed reviews is returned but not written, so that the next
+// command tries to load those reviews again.
+func loadIndex(repo repository.Repo) (*reviewIndex, error) {
+	indexFile := getIndexFile(repo)
+	previous := readIndex(indexFile)
+	index, err := updateIndex(repo, previous)
+	if err == nil && index != previous {
+		// Failing to write the index only means that the next command will be slower.
+		writeIndex(indexFile, index)
+	}
+	return index, err
+}
+
+// RebuildIndex discards the on-disk review index, and rebuilds it from scratch.
+func RebuildIndex(repo repository.Repo) error {
+	index, err := updateIndex(repo, nil)
+	if err != nil {
+		return err
+	}
+	return writeIndex(getIndexFile(repo), index)
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"strings"
+	"sync"
+)
+
+// LoadError reports a failure to load a single review.
+type LoadError struct {
+	Revision string
+	Err      error
+}
+
+func (e LoadError) Error() string {
+	return fmt.Sprintf("%.12s: %v", e.Revision, e.Err)
+}
+
+// LoadErrors reports all of the failures encountered while loading multiple reviews.
+//
+// The reviews that loaded successfully are still returned alongside it.
+type LoadErrors []LoadError
+
+func (errs LoadErrors) Error() string {
+	var messages []string
+	for _, err := range errs {
+		messages = append(messages, "  "+err.Error())
+	}
+	return fmt.Sprintf("Failed to load %d review(s):\n%s", len(errs), strings.Join(messages, "\n"))
+}
+
+// asError converts the collected failures into an error, which is nil if there were none.
+func (errs LoadErrors) asError() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// failed returns the set of revisions for which loading failed.
+func (errs LoadErrors) failed() map[string]bool {
+	revisions := make(map[string]bool)
+	for _, err := range errs {
+		revisions[err.Revision] = true
+	}
+	return revisions
+}
+
+// getJobs returns the maximum number of reviews to load concurrently.
+func getJobs(repo repository.Repo) int {
+	jobs, err := repo.GetParallelism()
+	if err != nil || jobs < 1 {
+		return 1
+	}
+	return jobs
+}
+
+// forEachConcurrently calls the given function with each index in [0, count),
+// using at most the given number of concurrent workers.
+//
+// It returns once every call has completed.
+func forEachConcurrently(jobs, count int, fn func(i int)) {
+	if jobs > count {
+		jobs = count
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < jobs; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < count; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
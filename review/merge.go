@@ -0,0 +1,135 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/analyses"
+	"github.com/google/git-appraise/review/ci"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-appraise/review/revision"
+	"github.com/google/git-appraise/review/status"
+	"github.com/google/git-appraise/review/versions"
+	"strings"
+)
+
+// noteParsers maps each of the devtools notes refs to a function that checks
+// whether or not a line is a well-formed note for that ref.
+var noteParsers = map[string]func(repository.Note) error{
+	request.Ref: func(note repository.Note) error {
+		_, err := request.Parse(note)
+		return err
+	},
+	comment.Ref: func(note repository.Note) error {
+		_, err := comment.Parse(note)
+		return err
+	},
+	ci.Ref: func(note repository.Note) error {
+		_, err := ci.Parse(note)
+		return err
+	},
+	analyses.Ref: func(note repository.Note) error {
+		_, err := analyses.Parse(note)
+		return err
+	},
+	revision.Ref: func(note repository.Note) error {
+		_, err := revision.Parse(note)
+		return err
+	},
+	status.Ref: func(note repository.Note) error {
+		_, err := status.Parse(note)
+		return err
+	},
+}
+
+// mergeNotes combines the local and remote contents of a single note, and
+// describes each of the malformed lines that it kept.
+func mergeNotes(notesRef string, local, remote []repository.Note) ([]repository.Note, []string) {
+	parse := noteParsers[notesRef]
+	seen := make(map[[sha1.Size]byte]bool)
+	var merged []repository.Note
+	var malformed []string
+	for _, side := range []struct {
+		name  string
+		notes []repository.Note
+	}{{"local", local}, {"remote", remote}} {
+		for i, note := range side.notes {
+			note = repository.Note(bytes.TrimSpace(note))
+			if len(note) == 0 {
+				continue
+			}
+			hash := sha1.Sum(note)
+			if seen[hash] {
+				continue
+			}
+			seen[hash] = true
+			merged = append(merged, note)
+			if parse == nil {
+				continue
+			}
+			// Notes written by newer versions of the tool are not malformed, even though we cannot read them.
+			if err := parse(note); err != nil && !versions.IsUnsupported(err) {
+				malformed = append(malformed, fmt.Sprintf("line %d of the %s note is malformed: %v", i+1, side.name, err))
+			}
+		}
+	}
+	return merged, malformed
+}
+
+// MergeNotes combines the local and remote contents of a single note.
+//
+// It satisfies the repository.NotesMerger type. The merged note contains every
+// distinct line from the local note, in order, followed by every line from the
+// remote note that was not already present. Lines are compared by the hash of
+// their contents, and blank lines are dropped.
+//
+// Lines that do not parse as a note of the type used by the notes ref (e.g.
+// because they were truncated) are kept verbatim, just like the notes written by
+// newer versions of the tool, so that merging never loses any data. They are
+// skipped when the notes are read, and reported by Fsck.
+func MergeNotes(notesRef, object string, local, remote []repository.Note) ([]repository.Note, error) {
+	merged, _ := mergeNotes(notesRef, local, remote)
+	return merged, nil
+}
+
+// NotesMerge merges notes like MergeNotes does, while keeping track of the
+// malformed lines that it finds.
+type NotesMerge struct {
+	// AllowMalformed keeps the malformed lines in the merged notes. Otherwise
+	// merging a note that contains any of them fails.
+	AllowMalformed bool
+	// Malformed describes each of the malformed lines found so far.
+	Malformed []string
+}
+
+// Merge combines the local and remote contents of a single note.
+//
+// It satisfies the repository.NotesMerger type.
+func (m *NotesMerge) Merge(notesRef, object string, local, remote []repository.Note) ([]repository.Note, error) {
+	merged, malformed := mergeNotes(notesRef, local, remote)
+	for _, line := range malformed {
+		m.Malformed = append(m.Malformed, fmt.Sprintf("the notes for %.12s in %s: %s", object, notesRef, line))
+	}
+	if len(malformed) > 0 && !m.AllowMalformed {
+		return nil, fmt.Errorf("%d malformed line(s) in %s: %s", len(malformed), notesRef, strings.Join(malformed, "; "))
+	}
+	return merged, nil
+}
@@ -0,0 +1,299 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/analyses"
+	"github.com/google/git-appraise/review/ci"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-appraise/review/revision"
+	"github.com/google/git-appraise/review/status"
+	"github.com/google/git-appraise/review/versions"
+	"sort"
+)
+
+// MigrationMessage is the commit message used for the notes rewritten by a migration.
+const MigrationMessage = "Migrate the review notes to the latest format"
+
+// noteFormats maps each of the devtools notes refs to the format of the notes it holds.
+var noteFormats = map[string]versions.Format{
+	request.Ref:  request.Format,
+	comment.Ref:  comment.Format,
+	ci.Ref:       ci.Format,
+	analyses.Ref: analyses.Format,
+	revision.Ref: revision.Format,
+	status.Ref:   status.Format,
+}
+
+// commentReferenceFields are the fields of a comment that hold the hash of another comment.
+var commentReferenceFields = []string{"parent", "supersedes", "retracts"}
+
+// Migration describes how the notes in a single notes ref are rewritten in the latest format.
+type Migration struct {
+	Ref string
+	// Notes holds the rewritten notes of each annotated object whose notes changed.
+	Notes map[string][]repository.Note
+	// Upgraded is the number of notes that are rewritten.
+	Upgraded int
+	// Unsupported is the number of notes that are left as-is because they are
+	// written in a newer version of the format than this tool supports.
+	Unsupported int
+	// Signed is the number of notes that are left as-is, despite being in an
+	// older version of the format, because rewriting them would invalidate their signatures.
+	Signed int
+	// Referenced is the number of comments that are left as-is, despite being in
+	// an older version of the format, because rewriting them would change their
+	// hashes, which are referred to by notes that cannot be rewritten (such as signed replies).
+	Referenced int
+	// Commit is the notes commit holding the rewritten notes, and is only set once the migration is applied.
+	Commit string
+}
+
+// isSigned determines if the given note carries a signature.
+func isSigned(note repository.Note) bool {
+	var fields struct {
+		Signature string `json:"signature"`
+	}
+	return json.Unmarshal(note, &fields) == nil && fields.Signature != ""
+}
+
+// commentHash returns the hash that identifies the comment in the given note, as
+// computed by a version of the tool that reads the note as-is.
+func commentHash(note repository.Note) (string, error) {
+	var c comment.Comment
+	if err := json.Unmarshal(note, &c); err != nil {
+		return "", err
+	}
+	return c.Hash()
+}
+
+// remapCommentReferences replaces the hashes of comments referred to by the given note.
+func remapCommentReferences(note repository.Note, hashes map[string]string) repository.Note {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(note, &fields); err != nil {
+		return note
+	}
+	remapped := false
+	for _, field := range commentReferenceFields {
+		var hash string
+		if raw, ok := fields[field]; ok && json.Unmarshal(raw, &hash) == nil && hashes[hash] != "" {
+			fields[field], _ = json.Marshal(hashes[hash])
+			remapped = true
+		}
+	}
+	if !remapped {
+		return note
+	}
+	if result, err := json.Marshal(fields); err == nil {
+		return result
+	}
+	return note
+}
+
+// commentReferences returns the hashes of the comments referred to by the given note.
+func commentReferences(note repository.Note) []string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(note, &fields); err != nil {
+		return nil
+	}
+	var references []string
+	for _, field := range commentReferenceFields {
+		var hash string
+		if raw, ok := fields[field]; ok && json.Unmarshal(raw, &hash) == nil && hash != "" {
+			references = append(references, hash)
+		}
+	}
+	return references
+}
+
+// pinReferencedComments leaves the comments that are referred to by comments
+// that cannot be rewritten as-is, since upgrading them would change their hashes,
+// and so turn those references into dangling ones (e.g. orphaning a signed reply).
+//
+// The notes are the original comments, while the upgraded notes are the same
+// comments in the latest format, and the rewritable flags mark the comments that
+// may be changed. Comments that are left as-is are marked as not rewritable, and
+// their upgraded notes are reset, which in turn pins the comments they refer to.
+// The number of such comments that would otherwise have been upgraded is returned.
+func pinReferencedComments(notes, upgraded []repository.Note, rewritable []bool) int {
+	indices := make(map[string]int)
+	for i, note := range notes {
+		if hash, err := commentHash(note); err == nil {
+			indices[hash] = i
+		}
+	}
+	var pending []int
+	for i := range notes {
+		if !rewritable[i] {
+			pending = append(pending, i)
+		}
+	}
+	pinned := 0
+	for len(pending) > 0 {
+		i := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for _, hash := range commentReferences(notes[i]) {
+			j, ok := indices[hash]
+			if !ok || !rewritable[j] {
+				continue
+			}
+			rewritable[j] = false
+			if !bytes.Equal(upgraded[j], notes[j]) {
+				pinned++
+			}
+			upgraded[j] = notes[j]
+			pending = append(pending, j)
+		}
+	}
+	return pinned
+}
+
+// remapComments rewrites the references between the given comments, so that
+// they refer to the new hashes of any comments that were upgraded.
+//
+// The notes are the original comments, while the upgraded notes are the same
+// comments in the latest format, and the rewritable flags mark the comments that
+// may be changed. Since changing a reference changes the hash of the comment
+// holding it, the references are rewritten repeatedly until no more hashes change.
+func remapComments(notes, upgraded []repository.Note, rewritable []bool) []repository.Note {
+	hashes := make(map[string]string)
+	migrated := make([]repository.Note, len(notes))
+	copy(migrated, upgraded)
+	// Each pass resolves at least one more level of replies, so this always terminates.
+	for pass := 0; pass <= len(notes); pass++ {
+		changed := false
+		for i := range notes {
+			if !rewritable[i] {
+				continue
+			}
+			migrated[i] = remapCommentReferences(upgraded[i], hashes)
+			if bytes.Equal(migrated[i], notes[i]) {
+				continue
+			}
+			oldHash, err := commentHash(notes[i])
+			if err != nil {
+				continue
+			}
+			newHash, err := commentHash(migrated[i])
+			if err == nil && newHash != oldHash && hashes[oldHash] != newHash {
+				hashes[oldHash] = newHash
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	return migrated
+}
+
+// migrateNotes rewrites the given notes, which annotate a single object, in the
+// latest version of the format.
+//
+// If none of the notes change, then the result is nil.
+func (m *Migration) migrateNotes(format versions.Format, notes []repository.Note) []repository.Note {
+	var original, upgraded []repository.Note
+	var rewritable []bool
+	for _, note := range notes {
+		note = repository.Note(bytes.TrimSpace(note))
+		if len(note) == 0 {
+			continue
+		}
+		upgradedNote, err := format.Upgrade(note)
+		canRewrite := false
+		switch {
+		case versions.IsUnsupported(err):
+			m.Unsupported++
+		case err != nil:
+			// Malformed notes are left as-is.
+		case isSigned(note):
+			if !bytes.Equal(upgradedNote, note) {
+				m.Signed++
+			}
+		default:
+			canRewrite = true
+		}
+		if !canRewrite {
+			upgradedNote = note
+		}
+		original = append(original, note)
+		upgraded = append(upgraded, upgradedNote)
+		rewritable = append(rewritable, canRewrite)
+	}
+	migrated := upgraded
+	if m.Ref == comment.Ref {
+		m.Referenced += pinReferencedComments(original, upgraded, rewritable)
+		migrated = remapComments(original, upgraded, rewritable)
+	}
+	changed := 0
+	for i := range original {
+		if !bytes.Equal(original[i], migrated[i]) {
+			changed++
+		}
+	}
+	if changed == 0 {
+		return nil
+	}
+	m.Upgraded += changed
+	return migrated
+}
+
+// PlanMigrations works out how to rewrite the notes in every devtools notes ref
+// in the latest version of their formats, without changing anything.
+//
+// The migrations are returned in the order of their refs.
+func PlanMigrations(repo repository.Repo) []*Migration {
+	var refs []string
+	for ref := range noteFormats {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	var migrations []*Migration
+	for _, ref := range refs {
+		m := &Migration{
+			Ref:   ref,
+			Notes: make(map[string][]repository.Note),
+		}
+		for _, object := range repo.ListNotedRevisions(ref) {
+			if migrated := m.migrateNotes(noteFormats[ref], repo.GetNotes(ref, object)); migrated != nil {
+				m.Notes[object] = migrated
+			}
+		}
+		migrations = append(migrations, m)
+	}
+	return migrations
+}
+
+// Apply writes the rewritten notes of the migration as a single commit on its
+// notes ref, so that the whole migration can be reviewed at once.
+//
+// A migration without any rewritten notes leaves the notes ref unchanged.
+func (m *Migration) Apply(repo repository.Repo) error {
+	if len(m.Notes) == 0 {
+		return nil
+	}
+	commit, err := repo.RewriteNotes(m.Ref, m.Notes, MigrationMessage)
+	if err != nil {
+		return err
+	}
+	m.Commit = commit
+	return nil
+}
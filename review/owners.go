@@ -0,0 +1,256 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"github.com/google/git-appraise/repository"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// ownersFileName is the name of the files that list the owners of a directory.
+	ownersFileName = "OWNERS"
+
+	// AnyOwner is the entry in an OWNERS file that lets anyone approve changes to a directory.
+	AnyOwner = "*"
+
+	// noParentDirective stops a directory from inheriting the owners of its parent directories.
+	noParentDirective = "set noparent"
+)
+
+// ownersFile holds the contents of a single OWNERS file.
+type ownersFile struct {
+	owners   []string
+	noParent bool
+}
+
+// parseOwnersFile parses the contents of an OWNERS file.
+//
+// Each line is either blank, a comment starting with "#", the "set noparent"
+// directive, or the email address of an owner.
+func parseOwnersFile(contents string) ownersFile {
+	var file ownersFile
+	for _, line := range strings.Split(contents, "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			continue
+		case line == noParentDirective:
+			file.noParent = true
+		default:
+			file.owners = append(file.owners, line)
+		}
+	}
+	return file
+}
+
+// ownersReader looks up the owners of paths, caching the OWNERS file of each directory.
+type ownersReader struct {
+	// read returns the contents of the OWNERS file in the given directory, and false if there is none.
+	read  func(dir string) (string, bool)
+	cache map[string]ownersFile
+}
+
+func (reader *ownersReader) readDir(dir string) ownersFile {
+	if file, ok := reader.cache[dir]; ok {
+		return file
+	}
+	var file ownersFile
+	if contents, ok := reader.read(dir); ok {
+		file = parseOwnersFile(contents)
+	}
+	reader.cache[dir] = file
+	return file
+}
+
+// getOwners returns the owners of the given path.
+//
+// These are the owners listed in the OWNERS file of the directory containing
+// the path, along with those of each of its parent directories, up to either
+// the root of the repo or a directory with the "set noparent" directive.
+func (reader *ownersReader) getOwners(filePath string) []string {
+	seen := make(map[string]bool)
+	var owners []string
+	dir := path.Dir(filePath)
+	for {
+		file := reader.readDir(dir)
+		for _, owner := range file.owners {
+			if !seen[owner] {
+				seen[owner] = true
+				owners = append(owners, owner)
+			}
+		}
+		if file.noParent || dir == "." {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// listChangedPaths returns the path of every file changed between the two commits.
+//
+// Renamed files are listed under both their old and new paths.
+func listChangedPaths(repo repository.Repo, base, head string) ([]string, error) {
+	diff, err := repo.Diff(base, head, "--name-only", "--no-renames", "-z")
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, filePath := range strings.Split(strings.TrimSpace(diff), "\x00") {
+		if filePath != "" {
+			paths = append(paths, filePath)
+		}
+	}
+	return paths, nil
+}
+
+// GetOwners returns the owners of each path changed between the base and head
+// commits, according to the OWNERS files in the given target ref.
+//
+// Paths that are not covered by any OWNERS file are mapped to an empty list.
+func GetOwners(repo repository.Repo, targetRef, base, head string) (map[string][]string, error) {
+	target, err := repo.ResolveRefCommit(targetRef)
+	if err != nil {
+		return nil, err
+	}
+	paths, err := listChangedPaths(repo, base, head)
+	if err != nil {
+		return nil, err
+	}
+	reader := &ownersReader{
+		read: func(dir string) (string, bool) {
+			// A failure to read an OWNERS file simply means that the directory does not have one.
+			contents, err := repo.Show(target, path.Join(dir, ownersFileName))
+			return contents, err == nil
+		},
+		cache: make(map[string]ownersFile),
+	}
+	owners := make(map[string][]string)
+	for _, filePath := range paths {
+		owners[filePath] = reader.getOwners(filePath)
+	}
+	return owners, nil
+}
+
+// LoadOwners looks up the owners of each path changed by the review, and
+// records the result in the review's Owners field.
+func (r *Review) LoadOwners() error {
+	base, err := r.GetBaseCommit()
+	if err != nil {
+		return err
+	}
+	head, err := r.GetHeadCommit()
+	if err != nil {
+		return err
+	}
+	owners, err := GetOwners(r.Repo, r.Request.TargetRef, base, head)
+	if err != nil {
+		return err
+	}
+	r.Owners = owners
+	return nil
+}
+
+// isCoveredBy determines if any of the given approvers may approve a path with the given owners.
+func isCoveredBy(owners []string, approvers map[string]bool) bool {
+	if len(owners) == 0 {
+		// Nobody owns the path, so it does not need an owner's approval.
+		return true
+	}
+	for _, owner := range owners {
+		if approvers[owner] || (owner == AnyOwner && len(approvers) > 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetUncoveredPaths returns the paths that still need an approval from one of
+// their owners, given the votes on the review.
+//
+// The review must have had its owners loaded with LoadOwners. As with the
+// approval policy, the requester's own approval does not count.
+func (r *Review) GetUncoveredPaths(votes map[string]bool) []string {
+	approvers := make(map[string]bool)
+	for author, approved := range votes {
+		if approved && author != r.Request.Requester {
+			approvers[author] = true
+		}
+	}
+	var uncovered []string
+	for filePath, owners := range r.Owners {
+		if !isCoveredBy(owners, approvers) {
+			uncovered = append(uncovered, filePath)
+		}
+	}
+	sort.Strings(uncovered)
+	return uncovered
+}
+
+// SuggestReviewers picks a small set of owners who, between them, can approve
+// every one of the given paths that is not already covered by the given reviewers.
+//
+// Owners are picked greedily, starting with whoever owns the most remaining
+// paths. The requester is never suggested.
+func SuggestReviewers(owners map[string][]string, requester string, reviewers []string) []string {
+	approvers := make(map[string]bool)
+	for _, reviewer := range reviewers {
+		approvers[reviewer] = true
+	}
+	remaining := make(map[string][]string)
+	for filePath, pathOwners := range owners {
+		if !isCoveredBy(pathOwners, approvers) {
+			remaining[filePath] = pathOwners
+		}
+	}
+	var suggested []string
+	for len(remaining) > 0 {
+		counts := make(map[string]int)
+		for _, pathOwners := range remaining {
+			for _, owner := range pathOwners {
+				if owner != requester && owner != AnyOwner {
+					counts[owner]++
+				}
+			}
+		}
+		best := ""
+		for owner, count := range counts {
+			if count > counts[best] || (count == counts[best] && owner < best) {
+				best = owner
+			}
+		}
+		if best == "" {
+			// The remaining paths are only owned by the requester, or by anyone.
+			break
+		}
+		suggested = append(suggested, best)
+		approvers[best] = true
+		for filePath, pathOwners := range remaining {
+			if isCoveredBy(pathOwners, approvers) {
+				delete(remaining, filePath)
+			}
+		}
+	}
+	return suggested
+}
@@ -20,6 +20,8 @@ package request
 import (
 	"encoding/json"
 	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/signing"
+	"github.com/google/git-appraise/review/versions"
 	"strconv"
 	"time"
 )
@@ -30,6 +32,9 @@ const Ref = "refs/notes/devtools/reviews"
 // FormatVersion defines the latest version of the request format supported by the tool.
 const FormatVersion = 0
 
+// Format describes the versions of the review request format, and how to upgrade older review requests.
+var Format = versions.Format{Latest: FormatVersion}
+
 // Request represents an initial request for a code review.
 //
 // Every field except for TargetRef is optional.
@@ -50,6 +55,13 @@ type Request struct {
 	// This allows someone viewing that submitted review to find the diff against which the
 	// code was reviewed.
 	BaseCommit string `json:"baseCommit,omitempty"`
+	// DependsOn is the revision of the review that this review is stacked on top of, if any.
+	DependsOn string `json:"dependsOn,omitempty"`
+	// Editor is the person who wrote this version of the request, when they are not the requester.
+	// It is only set on requests derived from an earlier version using the "edit" subcommand.
+	Editor string `json:"editor,omitempty"`
+	// Sig optionally holds the requester's signature of the request.
+	signing.Sig
 }
 
 // New returns a new request.
@@ -66,11 +78,22 @@ func New(requester string, reviewers []string, reviewRef, targetRef, description
 	}
 }
 
+// Author returns the person who wrote this version of the request.
+func (request *Request) Author() string {
+	if request.Editor != "" {
+		return request.Editor
+	}
+	return request.Requester
+}
+
 // Parse parses a review request from a git note.
 func Parse(note repository.Note) (Request, error) {
-	bytes := []byte(note)
 	var request Request
-	err := json.Unmarshal(bytes, &request)
+	note, err := Format.Upgrade(note)
+	if err != nil {
+		return request, err
+	}
+	err = json.Unmarshal([]byte(note), &request)
 	// TODO(ojarjur): If "requester" is not set, then use git-blame to fill it in.
 	return request, err
 }
@@ -83,7 +106,7 @@ func ParseAllValid(notes []repository.Note) []Request {
 	var requests []Request
 	for _, note := range notes {
 		request, err := Parse(note)
-		if err == nil && request.Version == FormatVersion && request.TargetRef != "" {
+		if err == nil && request.TargetRef != "" {
 			requests = append(requests, request)
 		}
 	}
@@ -0,0 +1,126 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"strings"
+)
+
+const (
+	// descriptionSearchPrefix marks a review spec that searches the descriptions of reviews.
+	descriptionSearchPrefix = ":/"
+
+	// minHashPrefixLength is the shortest hash prefix that is matched against review revisions.
+	minHashPrefixLength = 4
+
+	// fullHashLength is the length of a full revision, which is looked up without listing every review.
+	fullHashLength = 40
+
+	branchRefPrefix = "refs/heads/"
+)
+
+// isHex determines if the given string only contains hexadecimal digits.
+func isHex(s string) bool {
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchReviews returns the reviews that match the given spec, as described for Resolve.
+func matchReviews(reviews []Summary, spec string) []Summary {
+	var matches []Summary
+	for _, r := range reviews {
+		if r.Revision == spec {
+			return []Summary{r}
+		}
+	}
+	if strings.HasPrefix(spec, descriptionSearchPrefix) {
+		text := strings.TrimPrefix(spec, descriptionSearchPrefix)
+		for _, r := range reviews {
+			if strings.Contains(r.Request.Description, text) {
+				matches = append(matches, r)
+			}
+		}
+		return matches
+	}
+	if len(spec) >= minHashPrefixLength && isHex(spec) {
+		for _, r := range reviews {
+			if strings.HasPrefix(r.Revision, strings.ToLower(spec)) {
+				matches = append(matches, r)
+			}
+		}
+		if len(matches) > 0 {
+			return matches
+		}
+	}
+	for _, r := range reviews {
+		if r.Request.ReviewRef == spec || r.Request.ReviewRef == branchRefPrefix+spec {
+			matches = append(matches, r)
+		}
+	}
+	if len(matches) > 1 {
+		// A branch is often reused for several reviews, but it usually has only one open review.
+		var open []Summary
+		for _, r := range matches {
+			if !r.Submitted && !r.Abandoned {
+				open = append(open, r)
+			}
+		}
+		if len(open) > 0 {
+			return open
+		}
+	}
+	return matches
+}
+
+// Resolve returns the review identified by the given spec, or nil if no review matches it.
+//
+// The spec may be the revision of the review, a unique prefix of that revision,
+// the name of the branch under review, or ":/" followed by text to find in the
+// description of the review. If the spec matches more than one review, then an
+// error listing the candidates is returned.
+//
+// A full revision is looked up directly. Any other spec is matched against
+// every review, so if some of them fail to load, then an error describing the
+// failures is returned, since the spec might have matched one of those.
+func Resolve(repo repository.Repo, spec string) (*Review, error) {
+	if len(spec) == fullHashLength && isHex(spec) {
+		return Get(repo, strings.ToLower(spec))
+	}
+	reviews, err := ListAll(repo)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve %q, as not every review could be loaded (use the full revision of the review instead):\n%v", spec, err)
+	}
+	matches := matchReviews(reviews, spec)
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	if len(matches) > 1 {
+		var candidates []string
+		for _, r := range matches {
+			description := strings.SplitN(r.Request.Description, "\n", 2)[0]
+			candidates = append(candidates, fmt.Sprintf("  %.12s %s", r.Revision, description))
+		}
+		return nil, fmt.Errorf("%q matches more than one review:\n%s", spec, strings.Join(candidates, "\n"))
+	}
+	return matches[0].Details()
+}
@@ -26,6 +26,9 @@ import (
 	"github.com/google/git-appraise/review/ci"
 	"github.com/google/git-appraise/review/comment"
 	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-appraise/review/revision"
+	"github.com/google/git-appraise/review/signing"
+	"github.com/google/git-appraise/review/status"
 	"sort"
 )
 
@@ -37,11 +40,29 @@ import (
 // FYI only, and that there are no unaddressed comments. If it is set to true,
 // then that means that there are no unaddressed comments, and that the root
 // comment has its resolved bit set to true.
+//
+// If the comment has been edited by its author, then the Comment field holds the
+// latest version of the comment, and the Edit field holds the latest edit. If it
+// has been retracted, then the thread is only kept for the sake of any replies,
+// and the comment's description and resolved bit are cleared.
+//
+// A reply whose parent comment is missing (e.g. because it has not been pulled
+// yet) is kept as a thread of its own, with the Orphaned field set, so that it
+// still counts towards the status of the review.
+//
+// The Verification field is only set once the signatures in the review have been
+// checked using VerifySignatures, and the Anchor field is only set once the
+// comments have been located in the head commit using AnchorComments.
 type CommentThread struct {
-	Hash     string          `json:"hash,omitempty"`
-	Comment  comment.Comment `json:"comment"`
-	Children []CommentThread `json:"children,omitempty"`
-	Resolved *bool           `json:"resolved,omitempty"`
+	Hash         string           `json:"hash,omitempty"`
+	Comment      comment.Comment  `json:"comment"`
+	Children     []CommentThread  `json:"children,omitempty"`
+	Resolved     *bool            `json:"resolved,omitempty"`
+	Edit         *comment.Comment `json:"edit,omitempty"`
+	Retracted    bool             `json:"retracted,omitempty"`
+	Orphaned     bool             `json:"orphaned,omitempty"`
+	Verification signing.Status   `json:"verification,omitempty"`
+	Anchor       *Anchor          `json:"anchor,omitempty"`
 }
 
 // Summary represents the high-level state of a code review.
@@ -51,9 +72,10 @@ type CommentThread struct {
 // of reviews (such as listing the open reviews) should prefer operating on
 // the summary rather than the details.
 //
-// Review summaries have two status fields which are orthogonal:
+// Review summaries have three status fields which are orthogonal:
 // 1. Resolved indicates if a reviewer has accepted or rejected the change.
 // 2. Submitted indicates if the change has been incorporated into the target.
+// 3. Abandoned indicates if the change is no longer being pursued.
 type Summary struct {
 	Repo        repository.Repo   `json:"-"`
 	Revision    string            `json:"revision"`
@@ -62,6 +84,12 @@ type Summary struct {
 	Comments    []CommentThread   `json:"comments,omitempty"`
 	Resolved    *bool             `json:"resolved,omitempty"`
 	Submitted   bool              `json:"submitted"`
+	Abandoned   bool              `json:"abandoned,omitempty"`
+	// Votes maps each person who approved (true) or rejected (false) the review to their latest vote.
+	Votes map[string]bool `json:"votes,omitempty"`
+	// Unsupported is the number of notes about the review that are written in a newer
+	// version of their format than this tool supports, and so are left out of the review.
+	Unsupported int `json:"unsupported,omitempty"`
 }
 
 // Review represents the entire state of a code review.
@@ -74,6 +102,19 @@ type Review struct {
 	*Summary
 	Reports  []ci.Report       `json:"reports,omitempty"`
 	Analyses []analyses.Report `json:"analyses,omitempty"`
+	// Revisions are the recorded revisions of the review, in order.
+	Revisions []revision.Revision `json:"revisions,omitempty"`
+	// StatusChanges are the times the review was abandoned or reopened, in order.
+	StatusChanges []status.Status `json:"statusChanges,omitempty"`
+	// RequestVerification is only set once the signatures in the review have been
+	// checked using VerifySignatures.
+	RequestVerification signing.Status `json:"requestVerification,omitempty"`
+	// Owners maps each path changed by the review to the people who can approve it,
+	// and is only set once the owners have been looked up using LoadOwners.
+	Owners map[string][]string `json:"owners,omitempty"`
+	// verifiedComments are the comment threads with only the verified amendments
+	// applied, and are only set once VerifySignatures has been called.
+	verifiedComments []CommentThread
 }
 
 type byTimestamp []CommentThread
@@ -99,6 +140,8 @@ func (requests requestsByTimestamp) Less(i, j int) bool {
 // updateThreadsStatus calculates the aggregate status of a sequence of comment threads.
 //
 // The aggregate status is the conjunction of all of the non-nil child statuses.
+// Orphaned threads can only reject: a resolved reply marks its (missing) parent
+// as addressed, rather than approving the review, so it is treated as FYI.
 //
 // This has the side-effect of setting the "Resolved" field of all descendant comment threads.
 func updateThreadsStatus(threads []CommentThread) *bool {
@@ -108,6 +151,9 @@ func updateThreadsStatus(threads []CommentThread) *bool {
 	for i := range threads {
 		thread := &threads[i]
 		thread.updateResolvedStatus()
+		if thread.Orphaned && thread.Resolved != nil && *thread.Resolved {
+			continue
+		}
 		if thread.Resolved != nil {
 			noUnresolved = noUnresolved && *thread.Resolved
 			result = &noUnresolved
@@ -140,23 +186,78 @@ func (thread *CommentThread) updateResolvedStatus() {
 
 // mutableThread is an internal-only data structure used to store partially constructed comment threads.
 type mutableThread struct {
-	Hash     string
-	Comment  comment.Comment
-	Children []*mutableThread
+	Hash      string
+	Comment   comment.Comment
+	Children  []*mutableThread
+	Edit      *comment.Comment
+	Retracted bool
+	Orphaned  bool
 }
 
 // fixMutableThread is a helper method to finalize a mutableThread struct
 // (partially constructed comment thread) as a CommentThread struct
 // (fully constructed comment thread).
-func fixMutableThread(mutableThread *mutableThread) CommentThread {
+//
+// Retracted comments without any remaining replies are dropped, in which case
+// the returned bool is false.
+func fixMutableThread(mutableThread *mutableThread) (CommentThread, bool) {
 	var children []CommentThread
 	for _, mutableChild := range mutableThread.Children {
-		children = append(children, fixMutableThread(mutableChild))
+		if child, ok := fixMutableThread(mutableChild); ok {
+			children = append(children, child)
+		}
+	}
+	if mutableThread.Retracted && children == nil {
+		return CommentThread{}, false
 	}
 	return CommentThread{
-		Hash:     mutableThread.Hash,
-		Comment:  mutableThread.Comment,
-		Children: children,
+		Hash:      mutableThread.Hash,
+		Comment:   mutableThread.Comment,
+		Children:  children,
+		Edit:      mutableThread.Edit,
+		Retracted: mutableThread.Retracted,
+		Orphaned:  mutableThread.Orphaned,
+	}, true
+}
+
+// amendComments applies the given edits and retractions to the given comment threads.
+//
+// Amendments are applied in timestamp order, and only when they were made by
+// the author of the comment they amend. Once a comment has been retracted, any
+// later edits to it are ignored.
+func amendComments(threadsByHash map[string]*mutableThread, amendmentsByHash map[string]comment.Comment) {
+	var hashes []string
+	for hash := range amendmentsByHash {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		left, right := amendmentsByHash[hashes[i]], amendmentsByHash[hashes[j]]
+		if left.Timestamp != right.Timestamp {
+			return left.Timestamp < right.Timestamp
+		}
+		return hashes[i] < hashes[j]
+	})
+	for _, hash := range hashes {
+		amendment := amendmentsByHash[hash]
+		target := amendment.Supersedes
+		if amendment.Retracts != "" {
+			target = amendment.Retracts
+		}
+		thread, ok := threadsByHash[target]
+		if !ok || thread.Retracted || thread.Comment.Author != amendment.Author {
+			continue
+		}
+		if amendment.Retracts != "" {
+			thread.Retracted = true
+			thread.Edit = nil
+			thread.Comment.Description = ""
+			thread.Comment.Resolved = nil
+			continue
+		}
+		edit := amendment
+		thread.Edit = &edit
+		thread.Comment.Description = amendment.Description
+		thread.Comment.Resolved = amendment.Resolved
 	}
 }
 
@@ -164,9 +265,17 @@ func fixMutableThread(mutableThread *mutableThread) CommentThread {
 //
 // Since the comments can be processed in any order, this uses an internal mutable
 // data structure, and then converts it to the proper CommentThread structure at the end.
+//
+// Edits and retractions are folded into the comments that they amend, rather
+// than being included as comments of their own.
 func buildCommentThreads(commentsByHash map[string]comment.Comment) []CommentThread {
 	threadsByHash := make(map[string]*mutableThread)
+	amendmentsByHash := make(map[string]comment.Comment)
 	for hash, comment := range commentsByHash {
+		if comment.IsAmendment() {
+			amendmentsByHash[hash] = comment
+			continue
+		}
 		thread, ok := threadsByHash[hash]
 		if !ok {
 			thread = &mutableThread{
@@ -176,6 +285,7 @@ func buildCommentThreads(commentsByHash map[string]comment.Comment) []CommentThr
 			threadsByHash[hash] = thread
 		}
 	}
+	amendComments(threadsByHash, amendmentsByHash)
 	var rootHashes []string
 	for hash, thread := range threadsByHash {
 		if thread.Comment.Parent == "" {
@@ -184,29 +294,32 @@ func buildCommentThreads(commentsByHash map[string]comment.Comment) []CommentThr
 			parent, ok := threadsByHash[thread.Comment.Parent]
 			if ok {
 				parent.Children = append(parent.Children, thread)
+			} else {
+				thread.Orphaned = true
+				rootHashes = append(rootHashes, hash)
 			}
 		}
 	}
 	var threads []CommentThread
 	for _, hash := range rootHashes {
-		threads = append(threads, fixMutableThread(threadsByHash[hash]))
+		if thread, ok := fixMutableThread(threadsByHash[hash]); ok {
+			threads = append(threads, thread)
+		}
 	}
 	return threads
 }
 
-// loadComments reads in the log-structured sequence of comments for a review,
+// loadComments parses the log-structured sequence of comments for a review,
 // and then builds the corresponding tree-structured comment threads.
-func (r *Summary) loadComments() []CommentThread {
-	commentNotes := r.Repo.GetNotes(comment.Ref, r.Revision)
+func loadComments(commentNotes []repository.Note) []CommentThread {
 	commentsByHash := comment.ParseAllValid(commentNotes)
 	return buildCommentThreads(commentsByHash)
 }
 
-// GetSummary returns the summary of the specified code review.
+// summaryFromNotes builds the summary of a code review from its request, comment, and status notes.
 //
 // If no review request exists, the returned review summary is nil.
-func GetSummary(repo repository.Repo, revision string) (*Summary, error) {
-	requestNotes := repo.GetNotes(request.Ref, revision)
+func summaryFromNotes(repo repository.Repo, revision string, requestNotes, commentNotes, statusNotes []repository.Note) (*Summary, error) {
 	requests := request.ParseAllValid(requestNotes)
 	if requests == nil {
 		return nil, nil
@@ -218,25 +331,102 @@ func GetSummary(repo repository.Repo, revision string) (*Summary, error) {
 		Request:     requests[len(requests)-1],
 		AllRequests: requests,
 	}
-	reviewSummary.Comments = reviewSummary.loadComments()
+	reviewSummary.Comments = loadComments(commentNotes)
 	reviewSummary.Resolved = updateThreadsStatus(reviewSummary.Comments)
-	submitted, err := repo.IsAncestor(revision, reviewSummary.Request.TargetRef)
-	if err != nil {
+	reviewSummary.Votes = computeVotes(reviewSummary.Comments)
+	reviewSummary.Abandoned = status.IsAbandoned(status.ParseAllValid(statusNotes))
+	reviewSummary.Unsupported = request.Format.CountUnsupported(requestNotes) +
+		comment.Format.CountUnsupported(commentNotes) + status.Format.CountUnsupported(statusNotes)
+	return &reviewSummary, nil
+}
+
+// updateSubmitted computes the Submitted field of each of the given review summaries.
+//
+// Rather than checking each review individually, the reviews are grouped by
+// target ref, so that the history of each target ref only has to be walked once.
+// If that fails for a target ref, then every review in the group is reported as failed.
+func updateSubmitted(repo repository.Repo, summaries []*Summary) LoadErrors {
+	summariesByTarget := make(map[string][]*Summary)
+	var targetRefs []string
+	for _, summary := range summaries {
+		targetRef := summary.Request.TargetRef
+		if _, ok := summariesByTarget[targetRef]; !ok {
+			targetRefs = append(targetRefs, targetRef)
+		}
+		summariesByTarget[targetRef] = append(summariesByTarget[targetRef], summary)
+	}
+	groupErrs := make([]error, len(targetRefs))
+	forEachConcurrently(getJobs(repo), len(targetRefs), func(i int) {
+		group := summariesByTarget[targetRefs[i]]
+		var revisions []string
+		for _, summary := range group {
+			revisions = append(revisions, summary.Revision)
+		}
+		submitted, err := repo.AreAncestors(revisions, targetRefs[i])
+		if err != nil {
+			groupErrs[i] = err
+			return
+		}
+		for j, summary := range group {
+			summary.Submitted = submitted[j]
+		}
+	})
+	var errs LoadErrors
+	for i, err := range groupErrs {
+		if err == nil {
+			continue
+		}
+		for _, summary := range summariesByTarget[targetRefs[i]] {
+			errs = append(errs, LoadError{Revision: summary.Revision, Err: err})
+		}
+	}
+	return errs
+}
+
+// GetSummary returns the summary of the specified code review.
+//
+// The summary is read from the review index if that is up to date, and is
+// otherwise loaded directly from the repo.
+//
+// If no review request exists, the returned review summary is nil.
+func GetSummary(repo repository.Repo, revision string) (*Summary, error) {
+	if index := readIndex(getIndexFile(repo)); index != nil {
+		if stateHash, err := repo.GetRepoStateHash(); err == nil && stateHash == index.StateHash {
+			if summary := index.summary(repo, revision); summary != nil {
+				return summary, nil
+			}
+		}
+	}
+	requestNotes := repo.GetNotes(request.Ref, revision)
+	commentNotes := repo.GetNotes(comment.Ref, revision)
+	statusNotes := repo.GetNotes(status.Ref, revision)
+	summary, err := summaryFromNotes(repo, revision, requestNotes, commentNotes, statusNotes)
+	if err != nil || summary == nil {
 		return nil, err
 	}
-	reviewSummary.Submitted = submitted
-	return &reviewSummary, nil
+	if errs := updateSubmitted(repo, []*Summary{summary}); errs != nil {
+		return nil, errs[0].Err
+	}
+	return summary, nil
 }
 
 // Details returns the detailed review for the given summary.
 func (r *Summary) Details() (*Review, error) {
+	revisionNotes := r.Repo.GetNotes(revision.Ref, r.Revision)
+	summary := *r
+	summary.Unsupported += revision.Format.CountUnsupported(revisionNotes)
 	review := Review{
-		Summary: r,
+		Summary:       &summary,
+		Revisions:     revision.ParseAllValid(revisionNotes),
+		StatusChanges: status.ParseAllValid(r.Repo.GetNotes(status.Ref, r.Revision)),
 	}
 	currentCommit, err := review.GetHeadCommit()
 	if err == nil {
-		review.Reports = ci.ParseAllValid(review.Repo.GetNotes(ci.Ref, currentCommit))
-		review.Analyses = analyses.ParseAllValid(review.Repo.GetNotes(analyses.Ref, currentCommit))
+		ciNotes := review.Repo.GetNotes(ci.Ref, currentCommit)
+		analysesNotes := review.Repo.GetNotes(analyses.Ref, currentCommit)
+		review.Reports = ci.ParseAllValid(ciNotes)
+		review.Analyses = analyses.ParseAllValid(analysesNotes)
+		summary.Unsupported += ci.Format.CountUnsupported(ciNotes) + analyses.Format.CountUnsupported(analysesNotes)
 	}
 	return &review, nil
 }
@@ -256,26 +446,34 @@ func Get(repo repository.Repo, revision string) (*Review, error) {
 }
 
 // ListAll returns all reviews stored in the git-notes.
-func ListAll(repo repository.Repo) []Summary {
-	var reviews []Summary
-	for _, revision := range repo.ListNotedRevisions(request.Ref) {
-		review, err := GetSummary(repo, revision)
-		if err == nil && review != nil {
-			reviews = append(reviews, *review)
-		}
+//
+// The reviews are read through the on-disk review index, which is updated as
+// needed by loading the changed reviews concurrently. The number of concurrent
+// loads is limited by the "appraise.jobs" git config setting.
+//
+// If some reviews fail to load, then the remaining reviews are returned along
+// with a LoadErrors value describing the failures.
+func ListAll(repo repository.Repo) ([]Summary, error) {
+	index, err := loadIndex(repo)
+	if index == nil {
+		return nil, err
 	}
-	return reviews
+	return index.summaries(repo), err
 }
 
-// ListOpen returns all reviews that are not yet incorporated into their target refs.
-func ListOpen(repo repository.Repo) []Summary {
+// ListOpen returns all reviews that are neither incorporated into their target refs nor abandoned.
+//
+// If some reviews fail to load, then the remaining open reviews are returned along
+// with a LoadErrors value describing the failures.
+func ListOpen(repo repository.Repo) ([]Summary, error) {
 	var openReviews []Summary
-	for _, review := range ListAll(repo) {
-		if !review.Submitted {
+	reviews, err := ListAll(repo)
+	for _, review := range reviews {
+		if !review.Submitted && !review.Abandoned {
 			openReviews = append(openReviews, review)
 		}
 	}
-	return openReviews
+	return openReviews, err
 }
 
 // GetCurrent returns the current, open code review.
@@ -286,8 +484,12 @@ func GetCurrent(repo repository.Repo) (*Review, error) {
 	if err != nil {
 		return nil, err
 	}
+	openReviews, err := ListOpen(repo)
+	if err != nil {
+		return nil, err
+	}
 	var matchingReviews []Summary
-	for _, review := range ListOpen(repo) {
+	for _, review := range openReviews {
 		if review.Request.ReviewRef == reviewRef {
 			matchingReviews = append(matchingReviews, review)
 		}
@@ -412,9 +614,10 @@ func (r *Review) findLastCommit(latestCommit string, commentThreads []CommentThr
 		}
 	}
 	for _, commentThread := range commentThreads {
-		comment := commentThread.Comment
-		if comment.Location != nil {
-			updateLatest(comment.Location.Commit)
+		location := commentThread.Comment.Location
+		// Comments on the base side of the review are about the base commit rather than the reviewed commits.
+		if location != nil && location.Side != comment.SideBase {
+			updateLatest(location.Commit)
 		}
 		updateLatest(r.findLastCommit(latestCommit, commentThread.Children))
 	}
@@ -433,7 +636,7 @@ func (r *Review) GetHeadCommit() (string, error) {
 		return r.findLastCommit(r.Revision, r.Comments), nil
 	}
 
-	return r.Repo.ResolveRefCommit(r.Request.ReviewRef)
+	return r.Repo.ResolveReviewRefCommit(r.Revision, r.Request.ReviewRef)
 }
 
 // GetBaseCommit returns the commit against which a review should be compared.
@@ -451,19 +654,29 @@ func (r *Review) GetBaseCommit() (string, error) {
 		return r.Repo.GetLastParent(r.Revision)
 	}
 
-	targetRefHead, err := r.Repo.ResolveRefCommit(r.Request.TargetRef)
-	if err != nil {
-		return "", err
-	}
-	leftHandSide := targetRefHead
 	rightHandSide := r.Revision
 	if r.Request.ReviewRef != "" {
-		if reviewRefHead, err := r.Repo.ResolveRefCommit(r.Request.ReviewRef); err == nil {
+		if reviewRefHead, err := r.Repo.ResolveReviewRefCommit(r.Revision, r.Request.ReviewRef); err == nil {
 			rightHandSide = reviewRefHead
 		}
 	}
 
-	return r.Repo.MergeBase(leftHandSide, rightHandSide)
+	// A review that depends on an open review is compared against the head of that
+	// review. If the parent review has been submitted or abandoned, or cannot be
+	// loaded, then we fall back to the target ref.
+	if parent, err := r.GetParent(); err == nil && parent != nil && !parent.Submitted && !parent.Abandoned {
+		parentHead, err := parent.GetHeadCommit()
+		if err != nil {
+			return "", err
+		}
+		return r.Repo.MergeBase(parentHead, rightHandSide)
+	}
+
+	targetRefHead, err := r.Repo.ResolveRefCommit(r.Request.TargetRef)
+	if err != nil {
+		return "", err
+	}
+	return r.Repo.MergeBase(targetRefHead, rightHandSide)
 }
 
 // GetDiff returns the diff for a review.
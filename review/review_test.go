@@ -17,10 +17,22 @@ limitations under the License.
 package review
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/google/git-appraise/repository"
 	"github.com/google/git-appraise/review/comment"
 	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-appraise/review/revision"
+	"github.com/google/git-appraise/review/signing"
+	"github.com/google/git-appraise/review/status"
+	"github.com/google/git-appraise/review/versions"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
 	"sort"
+	"strings"
 	"testing"
 )
 
@@ -511,6 +523,189 @@ func TestFYIThenRejectedThreadsStatus(t *testing.T) {
 	validateRejected(t, status)
 }
 
+func TestGetVerifiedResolved(t *testing.T) {
+	accepted := true
+	rejected := false
+	r := &Review{
+		Summary: &Summary{
+			Comments: []CommentThread{
+				CommentThread{
+					Comment: comment.Comment{
+						Timestamp: "012345",
+						Resolved:  &accepted,
+					},
+					Verification: signing.StatusForged,
+				},
+			},
+		},
+	}
+	validateUnresolved(t, r.GetVerifiedResolved())
+	if r.Comments[0].Comment.Resolved != &accepted {
+		t.Fatal("The original comment threads were modified")
+	}
+
+	r.Comments = append(r.Comments, CommentThread{
+		Comment: comment.Comment{
+			Timestamp: "012346",
+			Resolved:  &accepted,
+		},
+		Verification: signing.StatusVerified,
+	})
+	validateAccepted(t, r.GetVerifiedResolved())
+
+	r.Comments[0].Children = []CommentThread{
+		CommentThread{
+			Comment: comment.Comment{
+				Timestamp: "012347",
+				Resolved:  &rejected,
+			},
+			Verification: signing.StatusUnsigned,
+		},
+	}
+	validateRejected(t, r.GetVerifiedResolved())
+}
+
+func TestVerifySignaturesIgnoresForgedAmendments(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	rejected := false
+	rejection := comment.Comment{Timestamp: "0000000010", Author: "reviewer", Resolved: &rejected, Description: "nmw"}
+	rejectionHash, err := rejection.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Anyone can write an unsigned retraction that claims to come from the reviewer.
+	retraction := comment.NewRetraction("reviewer", rejectionHash)
+	retraction.Timestamp = "0000000011"
+	for _, c := range []comment.Comment{rejection, retraction} {
+		note, err := c.Write()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.AppendNote(comment.Ref, repository.TestCommitG, note); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r, err := Get(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Votes["reviewer"]; ok {
+		t.Fatalf("The retraction was not applied to the unverified comments: %v", r.Votes)
+	}
+	r.VerifySignatures()
+	validateRejected(t, r.GetVerifiedResolved())
+	if approved, ok := r.GetVerifiedVotes()["reviewer"]; !ok || approved {
+		t.Fatalf("Unexpected verified votes: %v", r.GetVerifiedVotes())
+	}
+}
+
+// setUpSSHSigning configures the given mock repo to sign notes with a new SSH
+// key, which is trusted for the given identity, and returns a directory to remove
+// once the test is done.
+//
+// The test is skipped if ssh-keygen is not installed.
+func setUpSSHSigning(t *testing.T, repo repository.Repo, identity string) string {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not installed")
+	}
+	dir, err := ioutil.TempDir("", "git-appraise-signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "key")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", keyFile).CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to generate an SSH key: %v\n%s", err, out)
+	}
+	publicKey, err := ioutil.ReadFile(keyFile + ".pub")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	allowedSigners := filepath.Join(dir, "allowed_signers")
+	if err := ioutil.WriteFile(allowedSigners, []byte(identity+" "+string(publicKey)), 0600); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	repository.SetMockConfig(repo, "gpg.format", "ssh")
+	repository.SetMockConfig(repo, "user.signingKey", keyFile)
+	repository.SetMockConfig(repo, "gpg.ssh.allowedSignersFile", allowedSigners)
+	return dir
+}
+
+func TestVerifySignaturesRejectsReplayedApprovals(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	reviewer := "reviewer@example.com"
+	defer os.RemoveAll(setUpSSHSigning(t, repo, reviewer))
+
+	// Sign and add an approval of the head of review G.
+	accepted := true
+	approval := comment.New(reviewer, "LGTM")
+	approval.Location = &comment.Location{Commit: repository.TestCommitI}
+	approval.Resolved = &accepted
+	if err := signing.Sign(repo, repository.TestCommitG, &approval); err != nil {
+		t.Fatal(err)
+	}
+	note, err := approval.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(comment.Ref, repository.TestCommitG, note); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Get(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.VerifySignatures()
+	if !r.GetVerifiedVotes()[reviewer] {
+		t.Fatalf("The signed approval was not counted: %v, %v", r.GetVerifiedVotes(), r.Comments)
+	}
+
+	// Copying the same note into the notes of review B makes it forged.
+	if err := repo.AppendNote(comment.Ref, repository.TestCommitB, note); err != nil {
+		t.Fatal(err)
+	}
+	r, err = Get(repo, repository.TestCommitB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.VerifySignatures()
+	for _, thread := range r.Comments {
+		if thread.Comment.Author == reviewer && thread.Verification != signing.StatusForged {
+			t.Fatalf("Unexpected verification of a replayed approval: %q", thread.Verification)
+		}
+	}
+	if _, ok := r.GetVerifiedVotes()[reviewer]; ok {
+		t.Fatalf("A replayed approval was counted: %v", r.GetVerifiedVotes())
+	}
+
+	// An approval that was signed for review G, but approves a commit outside of it, is not counted either.
+	repo = repository.NewMockRepoForTest()
+	defer os.RemoveAll(setUpSSHSigning(t, repo, reviewer))
+	approval.Location = &comment.Location{Commit: repository.TestCommitJ}
+	if err := signing.Sign(repo, repository.TestCommitG, &approval); err != nil {
+		t.Fatal(err)
+	}
+	if note, err = approval.Write(); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(comment.Ref, repository.TestCommitG, note); err != nil {
+		t.Fatal(err)
+	}
+	r, err = Get(repo, repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.VerifySignatures()
+	if r.Comments[0].Verification != signing.StatusVerified {
+		t.Fatalf("Unexpected verification of the approval: %q", r.Comments[0].Verification)
+	}
+	if _, ok := r.GetVerifiedVotes()[reviewer]; ok {
+		t.Fatalf("An approval of a commit outside of the review was counted: %v", r.GetVerifiedVotes())
+	}
+}
+
 func TestBuildCommentThreads(t *testing.T) {
 	rejected := false
 	accepted := true
@@ -575,6 +770,97 @@ func TestBuildCommentThreads(t *testing.T) {
 	}
 }
 
+func TestBuildCommentThreadsWithAmendments(t *testing.T) {
+	rejected := false
+	accepted := true
+	commentsByHash := make(map[string]comment.Comment)
+	add := func(c comment.Comment) string {
+		hash, err := c.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		commentsByHash[hash] = c
+		return hash
+	}
+	rejection := add(comment.Comment{Timestamp: "012345", Author: "reviewer", Resolved: &rejected, Description: "tpyo"})
+	question := add(comment.Comment{Timestamp: "012346", Author: "reviewer", Description: "question"})
+	add(comment.Comment{Timestamp: "012347", Author: "author", Parent: question, Description: "answer"})
+	mistake := add(comment.Comment{Timestamp: "012348", Author: "reviewer", Description: "mistake"})
+
+	edit := comment.NewEdit("reviewer", rejection, "typo", &accepted)
+	edit.Timestamp = "012350"
+	add(edit)
+	// Edits by anyone other than the original author are ignored.
+	forgery := comment.NewEdit("someone else", rejection, "forged", &rejected)
+	forgery.Timestamp = "012351"
+	add(forgery)
+	for _, retracted := range []string{question, mistake} {
+		retraction := comment.NewRetraction("reviewer", retracted)
+		retraction.Timestamp = "012352"
+		add(retraction)
+	}
+
+	threads := buildCommentThreads(commentsByHash)
+	status := updateThreadsStatus(threads)
+	if len(threads) != 2 {
+		t.Fatalf("Unexpected threads: %v", threads)
+	}
+	if threads[0].Hash != rejection || threads[0].Comment.Description != "typo" || threads[0].Edit == nil {
+		t.Fatalf("Unexpected edited thread: %v", threads[0])
+	}
+	if threads[1].Hash != question || !threads[1].Retracted || len(threads[1].Children) != 1 {
+		t.Fatalf("Unexpected retracted thread: %v", threads[1])
+	}
+	validateAccepted(t, status)
+}
+
+func TestBuildCommentThreadsWithOrphanedReply(t *testing.T) {
+	accepted := true
+	rejected := false
+	root := comment.Comment{Timestamp: "012345", Resolved: &accepted, Description: "root"}
+	rootHash, err := root.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The parent of this reply has not been pulled yet.
+	orphan := comment.Comment{Timestamp: "012346", Resolved: &rejected, Parent: "missing", Description: "orphan"}
+	orphanHash, err := orphan.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	threads := buildCommentThreads(map[string]comment.Comment{
+		rootHash:   root,
+		orphanHash: orphan,
+	})
+	status := updateThreadsStatus(threads)
+	if len(threads) != 2 {
+		t.Fatalf("Unexpected threads: %v", threads)
+	}
+	if threads[0].Hash != rootHash || threads[0].Orphaned {
+		t.Fatalf("Unexpected root thread: %v", threads[0])
+	}
+	if threads[1].Hash != orphanHash || !threads[1].Orphaned {
+		t.Fatalf("Unexpected orphaned thread: %v", threads[1])
+	}
+	validateRejected(t, status)
+}
+
+func TestResolvedOrphanedReplyDoesNotAccept(t *testing.T) {
+	accepted := true
+	orphan := comment.Comment{Timestamp: "012346", Author: "reviewer", Resolved: &accepted, Parent: "missing", Description: "done"}
+	orphanHash, err := orphan.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	threads := buildCommentThreads(map[string]comment.Comment{orphanHash: orphan})
+	if status := updateThreadsStatus(threads); status != nil {
+		t.Fatalf("Unexpected status from a resolved orphaned reply: %v", *status)
+	}
+	if votes := computeVotes(threads); votes != nil {
+		t.Fatalf("Unexpected votes from an orphaned reply: %v", votes)
+	}
+}
+
 func TestGetHeadCommit(t *testing.T) {
 	repo := repository.NewMockRepoForTest()
 
@@ -665,3 +951,772 @@ func TestGetRequests(t *testing.T) {
 		t.Fatal("Unexpected requests for a pending review: ", pendingReview.AllRequests, pendingReview.Request)
 	}
 }
+
+func TestUpdateIndex(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	index, err := updateIndex(repo, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Revisions) != 3 {
+		t.Fatalf("Unexpected revisions in the review index: %v", index.Revisions)
+	}
+	if reused, err := updateIndex(repo, index); err != nil || reused != index {
+		t.Fatal("Expected the review index to be reused when the repo is unchanged: ", err)
+	}
+
+	c := comment.New("user@example.com", "New comment")
+	note, err := c.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(comment.Ref, repository.TestCommitB, note); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := updateIndex(repo, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.StateHash == index.StateHash {
+		t.Fatal("Expected the state hash to change after adding a comment")
+	}
+	oldEntry := index.Reviews[repository.TestCommitB]
+	newEntry := updated.Reviews[repository.TestCommitB]
+	if oldEntry.Fingerprint == newEntry.Fingerprint || len(newEntry.Summary.Comments) != len(oldEntry.Summary.Comments)+1 {
+		t.Fatalf("Expected the new comment to be reflected in the review index: %v", newEntry)
+	}
+	if index.Reviews[repository.TestCommitG].Fingerprint != updated.Reviews[repository.TestCommitG].Fingerprint {
+		t.Fatal("Expected an unchanged review to keep its fingerprint")
+	}
+	summary := updated.summary(repo, repository.TestCommitG)
+	if summary == nil || summary.Repo == nil || len(summary.AllRequests) != 3 || summary.Submitted {
+		t.Fatalf("Unexpected summary read from the review index: %v", summary)
+	}
+}
+
+func TestListAllSubmitted(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	reviews, err := ListAll(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	submitted := make(map[string]bool)
+	for _, summary := range reviews {
+		submitted[summary.Revision] = summary.Submitted
+	}
+	if len(submitted) != 3 || !submitted[repository.TestCommitB] || !submitted[repository.TestCommitD] || submitted[repository.TestCommitG] {
+		t.Fatalf("Unexpected submitted states: %v", submitted)
+	}
+}
+
+func TestForEachConcurrently(t *testing.T) {
+	results := make([]int, 100)
+	forEachConcurrently(8, len(results), func(i int) {
+		results[i] = i * i
+	})
+	for i, result := range results {
+		if result != i*i {
+			t.Fatalf("Unexpected result at position %d: %d", i, result)
+		}
+	}
+	// A count smaller than the number of jobs must not leave any workers blocked.
+	forEachConcurrently(8, 0, func(i int) {
+		t.Fatal("Unexpected call for an empty range")
+	})
+}
+
+func TestListAllOrder(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	reviews, err := ListAll(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{repository.TestCommitB, repository.TestCommitD, repository.TestCommitG}
+	if len(reviews) != len(expected) {
+		t.Fatalf("Unexpected reviews: %v", reviews)
+	}
+	for i, revision := range expected {
+		if reviews[i].Revision != revision {
+			t.Fatalf("Unexpected review order: %v", reviews)
+		}
+	}
+}
+
+func TestMergeNotes(t *testing.T) {
+	first := repository.Note(`{"timestamp": "0000000001", "author": "alice", "description": "first"}`)
+	second := repository.Note(`{"timestamp": "0000000002", "author": "bob", "description": "second"}`)
+	third := repository.Note(`{"timestamp": "0000000003", "author": "carol", "description": "third"}`)
+	merged, err := MergeNotes(comment.Ref, repository.TestCommitG,
+		[]repository.Note{first, repository.Note(""), second},
+		[]repository.Note{first, repository.Note(""), third, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []repository.Note{first, second, third}
+	if len(merged) != len(expected) {
+		t.Fatalf("Unexpected merged notes: %q", merged)
+	}
+	for i, note := range expected {
+		if string(merged[i]) != string(note) {
+			t.Fatalf("Unexpected merged notes: %q", merged)
+		}
+	}
+
+	// Malformed (e.g. truncated) lines make the merge fail, unless they are allowed.
+	truncated := repository.Note(`{"timestamp": "0000000004", "author": "dave", "descr`)
+	strict := &NotesMerge{}
+	if merged, err := strict.Merge(comment.Ref, repository.TestCommitG, []repository.Note{first}, []repository.Note{truncated}); err == nil || merged != nil {
+		t.Fatalf("Unexpected result of merging a malformed line: %q, %v", merged, err)
+	}
+	if len(strict.Malformed) != 1 {
+		t.Fatalf("Unexpected malformed lines: %q", strict.Malformed)
+	}
+	lenient := &NotesMerge{AllowMalformed: true}
+	merged, err = lenient.Merge(comment.Ref, repository.TestCommitG, []repository.Note{first}, []repository.Note{truncated, truncated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged) != 2 || string(merged[1]) != string(truncated) {
+		t.Fatalf("Unexpected merged notes: %q", merged)
+	}
+	if len(lenient.Malformed) != 1 || !strings.Contains(lenient.Malformed[0], "line 1 of the remote note is malformed") {
+		t.Fatalf("Unexpected malformed lines: %q", lenient.Malformed)
+	}
+	// Notes in refs that are not used by reviews are merged without being parsed.
+	if _, err := strict.Merge("refs/notes/other", repository.TestCommitG, []repository.Note{first}, []repository.Note{truncated}); err != nil || len(strict.Malformed) != 1 {
+		t.Fatalf("Unexpected malformed lines: %q, %v", strict.Malformed, err)
+	}
+}
+
+func TestMergeNotesKeepsMalformedLines(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	remoteRef := "refs/notes/origin/devtools/discuss"
+	truncated := repository.Note(`{"author": "bob", "descr`)
+	if err := repo.AppendNote(remoteRef, repository.TestCommitB, truncated); err != nil {
+		t.Fatal(err)
+	}
+	before := repo.GetNotes(comment.Ref, repository.TestCommitB)
+	// Unless malformed lines are allowed, the local notes are left unchanged.
+	if err := repo.MergeNotes(comment.Ref, remoteRef, (&NotesMerge{}).Merge); err == nil {
+		t.Fatal("Unexpected success merging a malformed line")
+	}
+	if after := repo.GetNotes(comment.Ref, repository.TestCommitB); len(after) != len(before) {
+		t.Fatalf("Unexpected notes after a failed merge: %q", after)
+	}
+	if err := repo.MergeNotes(comment.Ref, remoteRef, MergeNotes); err != nil {
+		t.Fatal(err)
+	}
+	after := repo.GetNotes(comment.Ref, repository.TestCommitB)
+	if len(after) != len(before)+1 || string(after[len(after)-1]) != string(truncated) {
+		t.Fatalf("Unexpected merged notes: %q", after)
+	}
+	// The malformed line is skipped when reading the review.
+	r, err := Get(repo, repository.TestCommitB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Comments) == 0 {
+		t.Fatal("Failed to read the comments alongside a malformed line")
+	}
+}
+
+func TestAnchor(t *testing.T) {
+	diff, err := parseDiff(`diff --git a/changed.txt b/changed.txt
+index 1111111..2222222 100644
+--- a/changed.txt
++++ b/changed.txt
+@@ -2,0 +3,2 @@ first
++inserted
++inserted
+@@ -10,2 +12 @@ second
+--- a removed line that looks like a header
+-removed
++rewritten
+diff --git a/old.txt b/new.txt
+similarity index 100%
+rename from old.txt
+rename to new.txt
+diff --git a/deleted.txt b/deleted.txt
+deleted file mode 100644
+index 3333333..0000000
+--- a/deleted.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-gone
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location := func(path string, r *comment.Range) comment.Location {
+		return comment.Location{Commit: "head", Path: path, Range: r}
+	}
+	testCases := []struct {
+		original comment.Location
+		expected Anchor
+	}{
+		{location("changed.txt", &comment.Range{StartLine: 2}), Anchor{Location: &comment.Location{Commit: "head", Path: "changed.txt", Range: &comment.Range{StartLine: 2}}}},
+		{location("changed.txt", &comment.Range{StartLine: 3, EndLine: 9}), Anchor{Location: &comment.Location{Commit: "head", Path: "changed.txt", Range: &comment.Range{StartLine: 5, EndLine: 11}}}},
+		{location("changed.txt", &comment.Range{StartLine: 9, EndLine: 10}), Anchor{Outdated: true}},
+		{location("changed.txt", &comment.Range{StartLine: 12, StartColumn: 3}), Anchor{Location: &comment.Location{Commit: "head", Path: "changed.txt", Range: &comment.Range{StartLine: 13, StartColumn: 3}}}},
+		{location("old.txt", &comment.Range{StartLine: 7}), Anchor{Location: &comment.Location{Commit: "head", Path: "new.txt", Range: &comment.Range{StartLine: 7}}}},
+		{location("deleted.txt", nil), Anchor{Outdated: true}},
+		{location("unchanged.txt", &comment.Range{StartLine: 4}), Anchor{Location: &comment.Location{Commit: "head", Path: "unchanged.txt", Range: &comment.Range{StartLine: 4}}}},
+	}
+	for _, testCase := range testCases {
+		original := testCase.original
+		original.Commit = "base"
+		result := anchor(original, "head", diff)
+		if result.Outdated != testCase.expected.Outdated || !reflect.DeepEqual(result.Location, testCase.expected.Location) {
+			t.Errorf("Unexpected anchor for %+v: %+v", original, result)
+		}
+	}
+}
+
+func TestAnchorCommentsOnBaseSide(t *testing.T) {
+	r, err := Get(repository.NewMockRepoForTest(), repository.TestCommitG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &comment.Location{Commit: repository.TestCommitE, Path: "README", Range: &comment.Range{StartLine: 3}, Side: comment.SideBase}
+	head := &comment.Location{Commit: repository.TestCommitH, Path: "README", Range: &comment.Range{StartLine: 3}}
+	r.Comments = []CommentThread{
+		CommentThread{Hash: "base", Comment: comment.Comment{Location: base}},
+		CommentThread{Hash: "head", Comment: comment.Comment{Location: head}},
+	}
+	if err := r.AnchorComments(); err != nil {
+		t.Fatal(err)
+	}
+	// Base side comments are anchored in the base commit, and stay on the base side.
+	expected := map[string]comment.Location{
+		"base": comment.Location{Commit: repository.TestCommitF, Path: "README", Range: &comment.Range{StartLine: 3}, Side: comment.SideBase},
+		"head": comment.Location{Commit: repository.TestCommitI, Path: "README", Range: &comment.Range{StartLine: 3}},
+	}
+	for _, thread := range r.Comments {
+		if thread.Anchor == nil || thread.Anchor.Outdated || !reflect.DeepEqual(*thread.Anchor.Location, expected[thread.Hash]) {
+			t.Errorf("Unexpected anchor for the %s comment: %+v", thread.Hash, thread.Anchor)
+		}
+	}
+}
+
+func TestGetInterdiff(t *testing.T) {
+	r := &Review{
+		Summary: &Summary{
+			Repo: repository.NewMockRepoForTest(),
+		},
+		Revisions: []revision.Revision{
+			revision.Revision{Commit: "head1", BaseCommit: "base1"},
+			revision.Revision{Commit: "head2", BaseCommit: "base1"},
+			revision.Revision{Commit: "head3", BaseCommit: "base2"},
+		},
+	}
+	expected := map[[2]int]string{
+		{0, 1}: `Diff between "base1" and "head1"`,
+		{1, 2}: `Diff between "head1" and "head2"`,
+		{2, 3}: `Range diff between "base1".."head2" and "base2".."head3"`,
+	}
+	for revisions, want := range expected {
+		diff, err := r.GetInterdiff(revisions[0], revisions[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff != want {
+			t.Errorf("Unexpected interdiff for %v: %q", revisions, diff)
+		}
+	}
+	for _, revisions := range [][2]int{{1, 1}, {2, 1}, {0, 4}, {-1, 2}} {
+		if _, err := r.GetInterdiff(revisions[0], revisions[1]); err == nil {
+			t.Errorf("Unexpectedly computed an interdiff for %v", revisions)
+		}
+	}
+}
+
+func TestComputeVotes(t *testing.T) {
+	accepted := true
+	rejected := false
+	threads := []CommentThread{
+		CommentThread{Comment: comment.Comment{Timestamp: "012346", Author: "alice", Resolved: &rejected}},
+		CommentThread{Comment: comment.Comment{Timestamp: "012345", Author: "alice", Resolved: &accepted}},
+		CommentThread{Comment: comment.Comment{Timestamp: "012347", Author: "bob", Resolved: &accepted}},
+		CommentThread{Comment: comment.Comment{Timestamp: "012348", Author: "bob"}},
+		CommentThread{Comment: comment.Comment{Timestamp: "012349", Author: "carol"}},
+	}
+	votes := computeVotes(threads)
+	if len(votes) != 2 || votes["alice"] || !votes["bob"] {
+		t.Fatalf("Unexpected votes: %v", votes)
+	}
+	if votes := computeVotes(threads[3:]); votes != nil {
+		t.Fatalf("Unexpected votes without any approvals or rejections: %v", votes)
+	}
+
+	// An approval and a rejection with the same timestamp are ordered by their hashes.
+	approval := comment.Comment{Timestamp: "012350", Author: "dave", Resolved: &accepted}
+	rejection := comment.Comment{Timestamp: "012350", Author: "dave", Resolved: &rejected}
+	tied := []CommentThread{
+		CommentThread{Hash: hashComment(t, approval), Comment: approval},
+		CommentThread{Hash: hashComment(t, rejection), Comment: rejection},
+	}
+	expected := tied[0].Hash > tied[1].Hash
+	for _, order := range [][]CommentThread{tied, {tied[1], tied[0]}} {
+		if votes := computeVotes(order); len(votes) != 1 || votes["dave"] != expected {
+			t.Errorf("Unexpected votes for %q then %q: %v", order[0].Hash, order[1].Hash, votes)
+		}
+	}
+}
+
+// hashComment returns the hash of the given comment.
+func hashComment(t *testing.T, c comment.Comment) string {
+	hash, err := c.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestPolicyCheck(t *testing.T) {
+	summary := &Summary{
+		Request: request.Request{
+			Requester: "alice",
+			Reviewers: []string{"bob", "carol"},
+		},
+	}
+	votes := map[string]bool{"alice": true, "bob": true, "dave": false}
+	if err := (Policy{}).Check(summary, votes); err != nil {
+		t.Fatalf("Unexpected error from the empty policy: %v", err)
+	}
+	if err := (Policy{RequiredApprovals: 1}).Check(summary, votes); err != nil {
+		t.Fatalf("Unexpected error with one approval: %v", err)
+	}
+	if err := (Policy{RequiredApprovals: 2}).Check(summary, votes); err == nil {
+		t.Fatal("The requester's own approval was counted")
+	}
+	if err := (Policy{RequireReviewers: true}).Check(summary, votes); err == nil || !strings.Contains(err.Error(), "carol") {
+		t.Fatalf("Unexpected error for a missing reviewer approval: %v", err)
+	}
+	votes["carol"] = true
+	if err := (Policy{RequiredApprovals: 2, RequireReviewers: true}).Check(summary, votes); err != nil {
+		t.Fatalf("Unexpected error once every reviewer approved: %v", err)
+	}
+}
+
+func TestOwners(t *testing.T) {
+	files := map[string]string{
+		".":   "root@example.com\n",
+		"a":   "# Owners of a\nalice@example.com  # lead\n",
+		"c":   "set noparent\nbob@example.com\n",
+		"d/e": "*\n",
+	}
+	reader := &ownersReader{
+		read: func(dir string) (string, bool) {
+			contents, ok := files[dir]
+			return contents, ok
+		},
+		cache: make(map[string]ownersFile),
+	}
+	owners := make(map[string][]string)
+	for _, filePath := range []string{"a/b/f", "c/g", "h", "d/e/i"} {
+		owners[filePath] = reader.getOwners(filePath)
+	}
+	expected := map[string][]string{
+		"a/b/f": []string{"alice@example.com", "root@example.com"},
+		"c/g":   []string{"bob@example.com"},
+		"h":     []string{"root@example.com"},
+		"d/e/i": []string{"*", "root@example.com"},
+	}
+	if !reflect.DeepEqual(owners, expected) {
+		t.Fatalf("Unexpected owners: %v", owners)
+	}
+
+	suggested := SuggestReviewers(owners, "alice@example.com", nil)
+	if !reflect.DeepEqual(suggested, []string{"root@example.com", "bob@example.com"}) {
+		t.Fatalf("Unexpected suggested reviewers: %v", suggested)
+	}
+	suggested = SuggestReviewers(owners, "alice@example.com", []string{"bob@example.com"})
+	if !reflect.DeepEqual(suggested, []string{"root@example.com"}) {
+		t.Fatalf("Unexpected suggested reviewers: %v", suggested)
+	}
+
+	r := &Review{
+		Summary: &Summary{
+			Request: request.Request{Requester: "alice@example.com"},
+		},
+		Owners: owners,
+	}
+	uncovered := r.GetUncoveredPaths(map[string]bool{"alice@example.com": true, "bob@example.com": true})
+	if !reflect.DeepEqual(uncovered, []string{"a/b/f", "h"}) {
+		t.Fatalf("Unexpected uncovered paths: %v", uncovered)
+	}
+	if uncovered := r.GetUncoveredPaths(map[string]bool{"bob@example.com": true, "root@example.com": true}); uncovered != nil {
+		t.Fatalf("Unexpected uncovered paths: %v", uncovered)
+	}
+}
+
+func TestGetUnsubmittedAncestors(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	child := &Summary{
+		Repo:     repo,
+		Revision: "child",
+		Request:  request.Request{DependsOn: repository.TestCommitG},
+	}
+	ancestors, err := child.GetUnsubmittedAncestors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ancestors) != 1 || ancestors[0].Revision != repository.TestCommitG {
+		t.Fatalf("Unexpected ancestors: %v", ancestors)
+	}
+
+	child.Request.DependsOn = repository.TestCommitB
+	if ancestors, err := child.GetUnsubmittedAncestors(); err != nil || len(ancestors) != 0 {
+		t.Fatalf("Unexpected ancestors of a review depending on a submitted review: %v, %v", ancestors, err)
+	}
+
+	child.Request.DependsOn = "missing"
+	if _, err := child.GetUnsubmittedAncestors(); err == nil {
+		t.Fatal("Unexpected success for a review depending on a missing review")
+	}
+
+	// An abandoned review will never be submitted, so it does not block the reviews that depend on it.
+	abandon, err := status.New("ojarjur", status.StateAbandoned, "").Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.AppendNote(status.Ref, repository.TestCommitG, abandon); err != nil {
+		t.Fatal(err)
+	}
+	child.Request.DependsOn = repository.TestCommitG
+	if ancestors, err := child.GetUnsubmittedAncestors(); err != nil || len(ancestors) != 0 {
+		t.Fatalf("Unexpected ancestors of a review depending on an abandoned review: %v, %v", ancestors, err)
+	}
+}
+
+func TestSortIntoStacks(t *testing.T) {
+	reviews := []Summary{
+		Summary{Revision: "c", Request: request.Request{DependsOn: "b"}},
+		Summary{Revision: "a"},
+		Summary{Revision: "b", Request: request.Request{DependsOn: "a"}},
+		Summary{Revision: "d", Request: request.Request{DependsOn: "missing"}},
+		Summary{Revision: "e", Request: request.Request{DependsOn: "f"}},
+		Summary{Revision: "f", Request: request.Request{DependsOn: "e"}},
+	}
+	sorted, depths := SortIntoStacks(reviews)
+	var revisions []string
+	for _, r := range sorted {
+		revisions = append(revisions, r.Revision)
+	}
+	if !reflect.DeepEqual(revisions, []string{"a", "b", "c", "d", "e", "f"}) {
+		t.Fatalf("Unexpected order of reviews: %v", revisions)
+	}
+	if !reflect.DeepEqual(depths, []int{0, 1, 2, 0, 0, 1}) {
+		t.Fatalf("Unexpected depths of reviews: %v", depths)
+	}
+}
+
+func TestMatchReviews(t *testing.T) {
+	reviews := []Summary{
+		Summary{Revision: "abcd1234", Request: request.Request{ReviewRef: "refs/heads/feature", Description: "Add a feature"}, Submitted: true},
+		Summary{Revision: "abce5678", Request: request.Request{ReviewRef: "refs/heads/feature", Description: "Fix the feature"}},
+		Summary{Revision: "bead0000", Request: request.Request{ReviewRef: "refs/heads/bead", Description: "Fix a bug"}},
+	}
+	for _, test := range []struct {
+		spec     string
+		expected []string
+	}{
+		{"abcd1234", []string{"abcd1234"}},
+		{"ABCE", []string{"abce5678"}},
+		{"abc", nil},
+		{"abc1", nil},
+		{"feature", []string{"abce5678"}},
+		{"refs/heads/feature", []string{"abce5678"}},
+		{"bead", []string{"bead0000"}},
+		{":/Fix", []string{"abce5678", "bead0000"}},
+		{":/bug", []string{"bead0000"}},
+	} {
+		var revisions []string
+		for _, r := range matchReviews(reviews, test.spec) {
+			revisions = append(revisions, r.Revision)
+		}
+		if !reflect.DeepEqual(revisions, test.expected) {
+			t.Errorf("Unexpected matches for %q: %v", test.spec, revisions)
+		}
+	}
+}
+
+func TestResolve(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	r, err := Resolve(repo, ":/Final description")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r == nil || r.Revision != repository.TestCommitG {
+		t.Fatalf("Unexpected review: %v", r)
+	}
+	// Only one of the reviews of the branch is still open.
+	if r, err := Resolve(repo, "ojarjur/mychange"); err != nil || r == nil || r.Revision != repository.TestCommitG {
+		t.Fatalf("Unexpected result for the review branch: %v, %v", r, err)
+	}
+	// An empty search matches every review.
+	if _, err := Resolve(repo, ":/"); err == nil || !strings.Contains(err.Error(), "more than one review") {
+		t.Fatalf("Unexpected result for an ambiguous spec: %v", err)
+	}
+	if r, err := Resolve(repo, "missing"); r != nil || err != nil {
+		t.Fatalf("Unexpected result for a spec matching no reviews: %v, %v", r, err)
+	}
+}
+
+func TestResolveWithLoadErrors(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	fullRevision := strings.Repeat("ab", 20)
+	fullRequest := `{"timestamp": "0000000006", "targetRef": "refs/heads/master", "requester": "ojarjur", "description": "Full"}`
+	if err := repo.AppendNote(request.Ref, fullRevision, repository.Note(fullRequest)); err != nil {
+		t.Fatal(err)
+	}
+	// A review whose target ref is missing fails to load.
+	brokenRequest := `{"timestamp": "0000000006", "targetRef": "refs/heads/missing", "requester": "ojarjur", "description": "Broken"}`
+	if err := repo.AppendNote(request.Ref, repository.TestCommitE, repository.Note(brokenRequest)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Full revisions are looked up directly, so they are not affected by the broken review.
+	for _, spec := range []string{fullRevision, strings.ToUpper(fullRevision)} {
+		if r, err := Resolve(repo, spec); err != nil || r == nil || r.Revision != fullRevision {
+			t.Fatalf("Unexpected result for the full revision %q: %v, %v", spec, r, err)
+		}
+	}
+	if r, err := Resolve(repo, strings.Repeat("cd", 20)); r != nil || err != nil {
+		t.Fatalf("Unexpected result for a full revision without a review: %v, %v", r, err)
+	}
+	// Any other spec reports the failure, whether or not it matches one of the loaded reviews.
+	for _, spec := range []string{":/Final description", "missing"} {
+		if r, err := Resolve(repo, spec); r != nil || err == nil || !strings.Contains(err.Error(), "Failed to load 1 review(s)") {
+			t.Errorf("Unexpected result for %q with a broken review: %v, %v", spec, r, err)
+		}
+	}
+}
+
+// testCommentUpgradeFormat marks the description of every comment written before version 1.
+var testCommentUpgradeFormat = versions.Format{
+	Latest: comment.FormatVersion + 1,
+	Upgrades: []versions.Upgrade{func(fields map[string]json.RawMessage) error {
+		var description string
+		json.Unmarshal(fields["description"], &description)
+		fields["description"], _ = json.Marshal(description + " (migrated)")
+		return nil
+	}},
+}
+
+func TestMigrateComments(t *testing.T) {
+	format := testCommentUpgradeFormat
+	root := comment.New("alice", "root")
+	rootHash, _ := root.Hash()
+	reply := comment.New("bob", "reply")
+	reply.Parent = rootHash
+	replyHash, _ := reply.Hash()
+	nested := comment.New("alice", "nested")
+	nested.Parent = replyHash
+	nested.Version = 2
+	signed := comment.New("carol", "signed")
+	signed.Signature = "signature"
+	var notes []repository.Note
+	for _, c := range []comment.Comment{root, reply, nested, signed} {
+		note, _ := c.Write()
+		notes = append(notes, note)
+	}
+	notes = append(notes, repository.Note(`{"description":"unsupported","v":99}`))
+
+	m := &Migration{Ref: comment.Ref}
+	migrated := m.migrateNotes(format, notes)
+	if m.Upgraded != 3 || m.Signed != 1 || m.Unsupported != 1 || len(migrated) != len(notes) {
+		t.Fatalf("Unexpected migration: %+v of %d notes", m, len(migrated))
+	}
+	var comments []comment.Comment
+	for _, note := range migrated {
+		var c comment.Comment
+		json.Unmarshal(note, &c)
+		comments = append(comments, c)
+	}
+	if comments[0].Description != "root (migrated)" || comments[1].Description != "reply (migrated)" ||
+		comments[2].Description != "nested" || comments[3].Description != "signed" {
+		t.Fatalf("Unexpected migrated comments: %v", comments)
+	}
+	newRootHash, _ := comments[0].Hash()
+	newReplyHash, _ := comments[1].Hash()
+	if comments[1].Parent != newRootHash || comments[2].Parent != newReplyHash {
+		t.Fatalf("The references between the migrated comments were not updated: %v", comments)
+	}
+	if !bytes.Equal(migrated[4], notes[4]) {
+		t.Fatalf("An unsupported note was rewritten: %q", migrated[4])
+	}
+}
+
+func TestMigrateCommentsWithSignedReplies(t *testing.T) {
+	root := comment.New("alice", "root")
+	rootHash, _ := root.Hash()
+	reply := comment.New("bob", "reply")
+	reply.Parent = rootHash
+	replyHash, _ := reply.Hash()
+	signed := comment.New("carol", "signed")
+	signed.Parent = replyHash
+	signed.Signature = "signature"
+	unrelated := comment.New("dave", "unrelated")
+	var notes []repository.Note
+	for _, c := range []comment.Comment{root, reply, signed, unrelated} {
+		note, _ := c.Write()
+		notes = append(notes, note)
+	}
+
+	m := &Migration{Ref: comment.Ref}
+	migrated := m.migrateNotes(testCommentUpgradeFormat, notes)
+	if m.Upgraded != 1 || m.Signed != 1 || m.Referenced != 2 || len(migrated) != len(notes) {
+		t.Fatalf("Unexpected migration: %+v of %d notes", m, len(migrated))
+	}
+	// The comments that the signed reply depends on keep their hashes.
+	for i := 0; i < 3; i++ {
+		if !bytes.Equal(migrated[i], notes[i]) {
+			t.Fatalf("A comment that a signed reply depends on was rewritten: %q", migrated[i])
+		}
+	}
+	if !strings.Contains(string(migrated[3]), "unrelated (migrated)") {
+		t.Fatalf("An unrelated comment was not migrated: %q", migrated[3])
+	}
+	threads := buildCommentThreads(comment.ParseAllValid(migrated))
+	for _, thread := range threads {
+		if thread.Orphaned {
+			t.Fatalf("The migration orphaned a reply: %+v", thread)
+		}
+	}
+}
+
+func TestMigrateWholeFileRanges(t *testing.T) {
+	wholeFile := repository.Note(`{"timestamp":"0000000006","author":"alice","location":{"commit":"G","path":"README","range":{"startLine":0}},"description":"whole file"}`)
+	line := repository.Note(`{"timestamp":"0000000006","author":"alice","location":{"commit":"G","path":"README","range":{"startLine":5}},"description":"line"}`)
+	wholeFileHash, err := commentHash(wholeFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := comment.New("bob", "reply")
+	reply.Parent = wholeFileHash
+	replyNote, err := reply.Write()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notes := []repository.Note{wholeFile, line, replyNote}
+
+	// Before migrating, the upgraded comment keeps the hash of its note, so the reply still finds it.
+	comments := comment.ParseAllValid(notes)
+	if c, ok := comments[wholeFileHash]; !ok || c.Location.Range != nil {
+		t.Fatalf("Unexpected comments read from a range starting on line 0: %+v", comments)
+	}
+	for _, thread := range buildCommentThreads(comments) {
+		if thread.Orphaned {
+			t.Fatalf("Upgrading a comment orphaned its reply: %+v", thread)
+		}
+	}
+
+	m := &Migration{Ref: comment.Ref}
+	migrated := m.migrateNotes(comment.Format, notes)
+	if m.Upgraded != 2 || len(migrated) != len(notes) {
+		t.Fatalf("Unexpected migration: %+v of %d notes", m, len(migrated))
+	}
+	if strings.Contains(string(migrated[0]), "range") || !strings.Contains(string(migrated[0]), `"v":2`) {
+		t.Fatalf("Unexpected migration of a range starting on line 0: %q", migrated[0])
+	}
+	// Comments that are already valid in their version are not rewritten.
+	if !bytes.Equal(migrated[1], line) {
+		t.Fatalf("A comment with a valid range was rewritten: %q", migrated[1])
+	}
+	for _, thread := range buildCommentThreads(comment.ParseAllValid(migrated)) {
+		if thread.Orphaned {
+			t.Fatalf("The migration orphaned a reply: %+v", thread)
+		}
+	}
+}
+
+func TestPlanMigrations(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	for _, m := range PlanMigrations(repo) {
+		if m.Upgraded != 0 || len(m.Notes) != 0 {
+			t.Fatalf("Unexpected migration of notes already in the latest format: %+v", m)
+		}
+	}
+
+	original := noteFormats[request.Ref]
+	defer func() {
+		noteFormats[request.Ref] = original
+	}()
+	noteFormats[request.Ref] = versions.Format{
+		Latest: 1,
+		Upgrades: []versions.Upgrade{func(fields map[string]json.RawMessage) error {
+			fields["description"], _ = json.Marshal("migrated")
+			return nil
+		}},
+	}
+	var upgraded int
+	for _, m := range PlanMigrations(repo) {
+		if err := m.Apply(repo); err != nil {
+			t.Fatal(err)
+		}
+		upgraded += m.Upgraded
+		if m.Ref == request.Ref && m.Commit == "" {
+			t.Fatal("The migration of the review requests was not committed")
+		}
+	}
+	if upgraded != 5 {
+		t.Fatalf("Unexpected number of upgraded notes: %d", upgraded)
+	}
+	for _, note := range repo.GetNotes(request.Ref, repository.TestCommitG) {
+		if !strings.Contains(string(note), `"description":"migrated"`) || !strings.Contains(string(note), `"v":1`) {
+			t.Fatalf("Unexpected migrated request: %q", note)
+		}
+	}
+}
+
+func TestFsck(t *testing.T) {
+	repo := repository.NewMockRepoForTest()
+	problems, err := Fsck(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("Unexpected problems with the test notes: %v", problems)
+	}
+
+	unknownObject := "0123456789012345678901234567890123456789"
+	notes := []struct {
+		ref, object, note string
+	}{
+		{request.Ref, repository.TestCommitG, `{"timestamp": "0000000005", "reviewRef": "refs/heads/ojarjur/mychange", "targetRef": "refs/heads/master", "requester": "ojarjur", "reviewers": ["ojarjur"], "description": "Final description of G"}`},
+		{request.Ref, repository.TestCommitH, `{"timestamp": "0000000006", "reviewRef": "refs/heads/ojarjur/mychange", "targetRef": "refs/heads/master", "requester": "ojarjur"}`},
+		{request.Ref, repository.TestCommitI, `{"timestamp": "0000000006", "reviewRef": "refs/heads/ojarjur/other", "targetRef": "refs/heads/missing", "requester": "ojarjur"}`},
+		{comment.Ref, repository.TestCommitG, `{"timestamp": "6", "author": "ojarjur"}`},
+		{comment.Ref, repository.TestCommitG, `{"timestamp": "0000000006", "author": "ojarjur", "v": 99}`},
+		{comment.Ref, repository.TestCommitG, `{"timestamp": "0000000006", "author": "ojarjur", "parent": "deadbeef"}`},
+		{comment.Ref, unknownObject, `{"timestamp": "0000000006", "author": "ojarjur"}`},
+	}
+	for _, n := range notes {
+		if err := repo.AppendNote(n.ref, n.object, repository.Note(n.note)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	problems, err = Fsck(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, p := range problems {
+		kinds = append(kinds, p.Kind+" "+p.Object)
+	}
+	sort.Strings(kinds)
+	expected := []string{
+		ProblemConflictingRequest + " " + repository.TestCommitG,
+		ProblemConflictingRequest + " " + repository.TestCommitH,
+		ProblemDuplicateRequest + " " + repository.TestCommitG,
+		ProblemInvalidNote + " " + repository.TestCommitG,
+		ProblemMissingTargetRef + " " + repository.TestCommitI,
+		ProblemOrphanedReply + " " + repository.TestCommitG,
+		ProblemUnknownObject + " " + unknownObject,
+		ProblemUnsupportedNote + " " + repository.TestCommitG,
+	}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package revision defines the internal representation of a revision of a review.
+//
+// A revision records the head commit of a review at a point in time, such as
+// each time that the review is requested, so that it is possible to see what
+// changed between the rounds of a review.
+package revision
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/versions"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Ref defines the git-notes ref that we expect to contain review revisions.
+const Ref = "refs/notes/devtools/revisions"
+
+// FormatVersion defines the latest version of the revision format supported by the tool.
+const FormatVersion = 0
+
+// Format describes the versions of the revision format, and how to upgrade older revisions.
+var Format = versions.Format{Latest: FormatVersion}
+
+// Revision represents a single revision (patch set) of a review.
+type Revision struct {
+	// Timestamp and Author are optimizations that allows us to display revisions
+	// without having to run git-blame over the notes object.
+	Timestamp string `json:"timestamp,omitempty"`
+	Author    string `json:"author,omitempty"`
+	// Commit is the head commit of the review at this revision.
+	Commit string `json:"commit"`
+	// BaseCommit is the commit against which the head commit was being reviewed
+	// at this revision. Comparing each revision against its own base allows the
+	// changes between revisions to be found even if the review was rebased.
+	BaseCommit string `json:"baseCommit,omitempty"`
+	// Version represents the version of the metadata format.
+	Version int `json:"v,omitempty"`
+}
+
+// New returns a new revision for the given head and base commits.
+//
+// The Timestamp and Author fields are automatically filled in with the current time and user.
+func New(author, commit, baseCommit string) Revision {
+	return Revision{
+		Timestamp:  strconv.FormatInt(time.Now().Unix(), 10),
+		Author:     author,
+		Commit:     commit,
+		BaseCommit: baseCommit,
+	}
+}
+
+// Parse parses a review revision from a git note.
+func Parse(note repository.Note) (Revision, error) {
+	var revision Revision
+	note, err := Format.Upgrade(note)
+	if err != nil {
+		return revision, err
+	}
+	err = json.Unmarshal([]byte(note), &revision)
+	return revision, err
+}
+
+type byTimestamp []Revision
+
+// Interface methods for sorting revisions by timestamp
+func (revisions byTimestamp) Len() int      { return len(revisions) }
+func (revisions byTimestamp) Swap(i, j int) { revisions[i], revisions[j] = revisions[j], revisions[i] }
+func (revisions byTimestamp) Less(i, j int) bool {
+	if revisions[i].Timestamp != revisions[j].Timestamp {
+		return revisions[i].Timestamp < revisions[j].Timestamp
+	}
+	left, _ := revisions[i].Hash()
+	right, _ := revisions[j].Hash()
+	return left < right
+}
+
+// ParseAllValid takes collection of git notes and tries to parse a review
+// revision from each one. Any notes that are not valid revisions get ignored.
+//
+// The revisions are returned in timestamp order. Revisions with the same
+// timestamp are ordered by their hashes, so that the order (and therefore the
+// numbering of the revisions) does not depend on the order of the notes, which
+// can differ between clones after a merge. Since several people may record the
+// same revision, consecutive revisions with the same commits are combined.
+func ParseAllValid(notes []repository.Note) []Revision {
+	var revisions []Revision
+	for _, note := range notes {
+		revision, err := Parse(note)
+		if err == nil && revision.Commit != "" {
+			revisions = append(revisions, revision)
+		}
+	}
+	sort.Sort(byTimestamp(revisions))
+	var result []Revision
+	for _, revision := range revisions {
+		if len(result) > 0 && result[len(result)-1].SameCommits(revision) {
+			continue
+		}
+		result = append(result, revision)
+	}
+	return result
+}
+
+// SameCommits returns true if both revisions have the same head and base commits.
+func (revision Revision) SameCommits(other Revision) bool {
+	return revision.Commit == other.Commit && revision.BaseCommit == other.BaseCommit
+}
+
+// Hash returns the SHA1 hash of the revision, as written to a git note.
+func (revision Revision) Hash() (string, error) {
+	note, err := revision.Write()
+	return fmt.Sprintf("%x", sha1.Sum(note)), err
+}
+
+// Write writes a review revision as a JSON-formatted git note.
+func (revision Revision) Write() (repository.Note, error) {
+	bytes, err := json.Marshal(revision)
+	return repository.Note(bytes), err
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package revision
+
+import (
+	"github.com/google/git-appraise/repository"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestParseAllValid(t *testing.T) {
+	revisions := ParseAllValid([]repository.Note{
+		repository.Note(`{"timestamp": "0000000003", "commit": "c", "baseCommit": "base2"}`),
+		repository.Note(`{"timestamp": "0000000001", "commit": "a", "baseCommit": "base1"}`),
+		repository.Note(`{"timestamp": "0000000002", "commit": "a", "baseCommit": "base1", "author": "someone else"}`),
+		repository.Note(`{"timestamp": "0000000002", "commit": "b", "baseCommit": "base1"}`),
+		repository.Note(`{"timestamp": "0000000004", "commit": "a", "baseCommit": "base1"}`),
+		repository.Note(`{"timestamp": "0000000005", "baseCommit": "base1"}`),
+		repository.Note(`{"timestamp": "0000000006", "commit": "d", "v": 1}`),
+		repository.Note(`not json`),
+	})
+	var commits []string
+	for _, revision := range revisions {
+		commits = append(commits, revision.Commit)
+	}
+	if len(commits) != 4 || commits[0] != "a" || commits[1] != "b" || commits[2] != "c" || commits[3] != "a" {
+		t.Fatalf("Unexpected revisions: %v", commits)
+	}
+}
+
+func TestParseAllValidIgnoresNoteOrder(t *testing.T) {
+	notes := []repository.Note{
+		repository.Note(`{"timestamp": "0000000001", "commit": "a", "baseCommit": "base1"}`),
+		repository.Note(`{"timestamp": "0000000002", "commit": "b", "baseCommit": "base1"}`),
+		repository.Note(`{"timestamp": "0000000002", "commit": "c", "baseCommit": "base1"}`),
+		repository.Note(`{"timestamp": "0000000002", "commit": "d", "baseCommit": "base2"}`),
+		repository.Note(`{"timestamp": "0000000003", "commit": "e", "baseCommit": "base2"}`),
+	}
+	expected := ParseAllValid(notes)
+	if len(expected) != len(notes) {
+		t.Fatalf("Unexpected revisions: %v", expected)
+	}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		shuffled := append([]repository.Note(nil), notes...)
+		random.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		if revisions := ParseAllValid(shuffled); !reflect.DeepEqual(revisions, expected) {
+			t.Fatalf("The order of the revisions depends on the order of the notes: %v instead of %v", revisions, expected)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"fmt"
+	"github.com/google/git-appraise/review/revision"
+)
+
+// RecordRevision records the current head and base commits of the review as a new revision.
+//
+// Nothing is recorded if those commits match the latest recorded revision, in
+// which case the returned bool is false.
+func (r *Review) RecordRevision(author string) (bool, error) {
+	head, err := r.GetHeadCommit()
+	if err != nil {
+		return false, err
+	}
+	base, err := r.GetBaseCommit()
+	if err != nil {
+		return false, err
+	}
+	latest := revision.New(author, head, base)
+	if len(r.Revisions) > 0 && r.Revisions[len(r.Revisions)-1].SameCommits(latest) {
+		return false, nil
+	}
+	note, err := latest.Write()
+	if err != nil {
+		return false, err
+	}
+	if err := r.Repo.AppendNote(revision.Ref, r.Revision, note); err != nil {
+		return false, err
+	}
+	r.Revisions = append(r.Revisions, latest)
+	return true, nil
+}
+
+// GetInterdiff returns the changes made between two recorded revisions of the review.
+//
+// Revisions are numbered starting from 1, in the order they were recorded, and
+// the "from" revision 0 refers to the base commit of the "to" revision. When the
+// two revisions have different base commits (for example, because the review was
+// rebased), each revision is compared against its own base.
+func (r *Review) GetInterdiff(from, to int, diffArgs ...string) (string, error) {
+	if to < 1 || to > len(r.Revisions) {
+		return "", fmt.Errorf("There is no revision %d; the review has %d recorded revision(s).", to, len(r.Revisions))
+	}
+	if from < 0 || from >= to {
+		return "", fmt.Errorf("The revision to diff from must be between 0 and %d.", to-1)
+	}
+	newRevision := r.Revisions[to-1]
+	if from == 0 {
+		return r.Repo.Diff(newRevision.BaseCommit, newRevision.Commit, diffArgs...)
+	}
+	oldRevision := r.Revisions[from-1]
+	if oldRevision.BaseCommit == newRevision.BaseCommit || oldRevision.BaseCommit == "" || newRevision.BaseCommit == "" {
+		return r.Repo.Diff(oldRevision.Commit, newRevision.Commit, diffArgs...)
+	}
+	return r.Repo.RangeDiff(oldRevision.BaseCommit, oldRevision.Commit, newRevision.BaseCommit, newRevision.Commit, diffArgs...)
+}
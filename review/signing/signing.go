@@ -0,0 +1,420 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package signing signs and verifies the notes used for code reviews.
+//
+// Notes are signed with the same GPG or SSH key, and the same programs, that
+// the user has configured git to use for signing commits. The signature covers
+// the revision that the note annotates, followed by the JSON form of the note
+// without its signature, with its fields sorted and its whitespace removed, and
+// is then embedded in the note as its "signature" field.
+package signing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// namespace is the SSH signature namespace used for notes. This keeps
+	// signatures made for other purposes from being passed off as note signatures.
+	namespace = "git-appraise"
+
+	openPGPSignaturePrefix = "-----BEGIN PGP SIGNATURE-----"
+	sshSignaturePrefix     = "-----BEGIN SSH SIGNATURE-----"
+)
+
+// Status describes the result of verifying the signature on a note.
+type Status string
+
+const (
+	// StatusUnsigned means that the note has no signature.
+	StatusUnsigned Status = "unsigned"
+	// StatusVerified means that the note was signed by its claimed author.
+	StatusVerified Status = "verified"
+	// StatusUnverifiable means that the note is signed, but that the signature
+	// could not be checked; for example, because the signing key is unknown.
+	StatusUnverifiable Status = "unverifiable"
+	// StatusForged means that either the signature does not match the contents
+	// of the note, or that the note was signed by someone other than its claimed author.
+	StatusForged Status = "forged"
+)
+
+// Sig holds the signature of a note.
+//
+// It is embedded in each of the note types that can be signed, so that the
+// signature is stored as a field of the note.
+type Sig struct {
+	Signature string `json:"signature,omitempty"`
+}
+
+func (s *Sig) sig() *Sig {
+	return s
+}
+
+// Signable is implemented by pointers to each of the note types that embed a Sig.
+type Signable interface {
+	sig() *Sig
+}
+
+// signatureField is the name of the field that holds the signature of a note.
+const signatureField = "signature"
+
+// splitSignature returns the signature of the given JSON note, along with the
+// bytes covered by that signature.
+//
+// Those bytes are computed from the raw note, rather than from a parsed copy
+// of it, so that they include any fields this version of the tool does not
+// know about, and are in a canonical form that does not depend on the order of
+// the fields in the note.
+func splitSignature(note []byte) ([]byte, string, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(note, &fields); err != nil {
+		return nil, "", err
+	}
+	var signature string
+	if raw, ok := fields[signatureField]; ok {
+		if err := json.Unmarshal(raw, &signature); err != nil {
+			return nil, "", err
+		}
+		delete(fields, signatureField)
+	}
+	// Maps are marshalled with their keys sorted, and raw messages are compacted.
+	payload, err := json.Marshal(fields)
+	return payload, signature, err
+}
+
+// payload returns the bytes covered by the signature of the given note.
+func payload(note Signable) ([]byte, error) {
+	s := note.sig()
+	signature := s.Signature
+	s.Signature = ""
+	defer func() {
+		s.Signature = signature
+	}()
+	serialized, err := json.Marshal(note)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := splitSignature(serialized)
+	return data, err
+}
+
+// signedData returns the bytes that are signed for a note with the given payload,
+// which annotates the given revision.
+//
+// The revision is included so that a signed note cannot be copied into the
+// notes of another review, where it would otherwise still verify.
+func signedData(revision string, payload []byte) []byte {
+	return append([]byte("revision "+revision+"\n"), payload...)
+}
+
+// config holds the git config settings used for signing and verifying notes.
+type config struct {
+	// Format is either "openpgp" or "ssh", as per the "gpg.format" setting.
+	Format string
+	// Key is the signing key, as per the "user.signingKey" setting.
+	Key string
+	// OpenPGPProgram and SSHProgram are the programs used for each format of signature.
+	OpenPGPProgram string
+	SSHProgram     string
+	// AllowedSigners is the file listing the SSH keys trusted by the user.
+	AllowedSigners string
+	// TrustedKeys lists the fingerprints of OpenPGP keys that are trusted, in
+	// addition to those that are fully trusted in the user's keyring.
+	TrustedKeys []string
+}
+
+// trustedKeysConfig is the setting that lists the fingerprints of trusted OpenPGP keys.
+const trustedKeysConfig = "appraise.trustedKeys"
+
+// readConfig reads the signing settings from the git config of the given repo.
+func readConfig(repo repository.Repo) (*config, error) {
+	var c config
+	settings := []struct {
+		value        *string
+		keys         []string
+		defaultValue string
+	}{
+		{&c.Format, []string{"gpg.format"}, "openpgp"},
+		{&c.Key, []string{"user.signingKey"}, ""},
+		{&c.OpenPGPProgram, []string{"gpg.openpgp.program", "gpg.program"}, "gpg"},
+		{&c.SSHProgram, []string{"gpg.ssh.program"}, "ssh-keygen"},
+		{&c.AllowedSigners, []string{"gpg.ssh.allowedSignersFile"}, ""},
+	}
+	for _, setting := range settings {
+		*setting.value = setting.defaultValue
+		for _, key := range setting.keys {
+			value, err := repo.GetConfig(key)
+			if err != nil {
+				return nil, err
+			}
+			if value != "" {
+				*setting.value = value
+				break
+			}
+		}
+	}
+	c.AllowedSigners = expandHome(c.AllowedSigners)
+	trustedKeys, err := repo.GetConfig(trustedKeysConfig)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range strings.FieldsFunc(trustedKeys, func(r rune) bool { return r == ',' || r == ' ' }) {
+		c.TrustedKeys = append(c.TrustedKeys, strings.ToUpper(key))
+	}
+	return &c, nil
+}
+
+// expandHome expands a leading "~/" in the given path to the user's home directory.
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(os.Getenv("HOME"), path[2:])
+	}
+	return path
+}
+
+// run runs the given program with the given input, and returns its stdout.
+func run(input []byte, program string, args ...string) ([]byte, error) {
+	cmd := exec.Command(program, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return stdout.Bytes(), fmt.Errorf("%s: %s", program, message)
+		}
+		return stdout.Bytes(), fmt.Errorf("%s: %v", program, err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// writeTempFile writes the given contents to a new temporary file, and returns its name.
+//
+// The caller is responsible for removing the file.
+func writeTempFile(contents []byte) (string, error) {
+	file, err := ioutil.TempFile("", "appraise-signature")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(contents)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// Sign signs the given note, which annotates the given revision, using the user's configured signing key.
+func Sign(repo repository.Repo, revision string, note Signable) error {
+	c, err := readConfig(repo)
+	if err != nil {
+		return err
+	}
+	notePayload, err := payload(note)
+	if err != nil {
+		return err
+	}
+	data := signedData(revision, notePayload)
+	var signature []byte
+	switch c.Format {
+	case "openpgp":
+		args := []string{"--status-fd=2", "-bsa"}
+		if c.Key != "" {
+			args = append(args, "-u", c.Key)
+		}
+		signature, err = run(data, c.OpenPGPProgram, args...)
+	case "ssh":
+		signature, err = signSSH(c, data)
+	default:
+		return fmt.Errorf("Unsupported signature format %q", c.Format)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to sign the note: %v", err)
+	}
+	note.sig().Signature = strings.TrimSpace(string(signature))
+	return nil
+}
+
+// signSSH signs the given data using the configured SSH key.
+func signSSH(c *config, data []byte) ([]byte, error) {
+	if c.Key == "" {
+		return nil, errors.New("No SSH signing key is configured. Set the user.signingKey setting to use one.")
+	}
+	keyFile := expandHome(c.Key)
+	if strings.HasPrefix(c.Key, "key::") {
+		// The key is given literally, and its private half is expected to be in the SSH agent.
+		var err error
+		keyFile, err = writeTempFile([]byte(strings.TrimPrefix(c.Key, "key::")))
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(keyFile)
+	}
+	return run(data, c.SSHProgram, "-Y", "sign", "-n", namespace, "-f", keyFile)
+}
+
+// Verify checks the signature on the given note, which annotates the given
+// revision, and claims to be written by the given author.
+//
+// The note is given as it is stored, so that the signature is checked against
+// every field in it. A note that was signed for a different revision is forged.
+// Any problem running the programs used to check signatures results in StatusUnverifiable.
+func Verify(repo repository.Repo, revision string, note repository.Note, author string) Status {
+	notePayload, signature, err := splitSignature(note)
+	if err != nil {
+		return StatusUnverifiable
+	}
+	data := signedData(revision, notePayload)
+	if signature == "" {
+		return StatusUnsigned
+	}
+	c, err := readConfig(repo)
+	if err != nil {
+		return StatusUnverifiable
+	}
+	signatureFile, err := writeTempFile([]byte(signature + "\n"))
+	if err != nil {
+		return StatusUnverifiable
+	}
+	defer os.Remove(signatureFile)
+
+	var status Status
+	var signer string
+	switch {
+	case strings.HasPrefix(signature, openPGPSignaturePrefix):
+		status, signer = verifyOpenPGP(c, data, signatureFile)
+	case strings.HasPrefix(signature, sshSignaturePrefix):
+		status, signer = verifySSH(c, data, signatureFile, author)
+	default:
+		return StatusForged
+	}
+	if status == StatusVerified && !matchesAuthor(signer, author) {
+		return StatusForged
+	}
+	return status
+}
+
+// verifyOpenPGP checks an OpenPGP signature, and returns the user ID of the signer.
+func verifyOpenPGP(c *config, data []byte, signatureFile string) (Status, string) {
+	// The exit code is non-zero for both bad and unverifiable signatures, so we rely on the status output instead.
+	out, _ := run(data, c.OpenPGPProgram, "--status-fd=1", "--verify", signatureFile, "-")
+	return parseOpenPGPStatus(string(out), c.TrustedKeys)
+}
+
+// parseOpenPGPStatus interprets the status output of verifying an OpenPGP
+// signature, and returns the user ID of the signer.
+//
+// A good signature is only verified if it was made with a key that is either
+// fully trusted in the user's keyring, or listed in the given trusted keys.
+// Otherwise, anyone could add a key with the author's user ID to the keyring.
+func parseOpenPGPStatus(out string, trustedKeys []string) (Status, string) {
+	var signer string
+	var fingerprints []string
+	good := false
+	trusted := false
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(strings.TrimPrefix(line, "[GNUPG:] "))
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "BADSIG":
+			return StatusForged, ""
+		case "GOODSIG":
+			if parts := strings.SplitN(strings.TrimPrefix(line, "[GNUPG:] "), " ", 3); len(parts) == 3 {
+				good = true
+				signer = parts[2]
+			}
+		case "VALIDSIG":
+			// The first field is the fingerprint of the signing key, and the last is that of its primary key.
+			if len(fields) > 1 {
+				fingerprints = append(fingerprints, strings.ToUpper(fields[1]), strings.ToUpper(fields[len(fields)-1]))
+			}
+		case "TRUST_FULLY", "TRUST_ULTIMATE":
+			trusted = true
+		case "EXPKEYSIG", "REVKEYSIG", "ERRSIG":
+			return StatusUnverifiable, ""
+		}
+	}
+	if !good || len(fingerprints) == 0 {
+		return StatusUnverifiable, ""
+	}
+	for _, fingerprint := range fingerprints {
+		for _, key := range trustedKeys {
+			if fingerprint == key {
+				trusted = true
+			}
+		}
+	}
+	if !trusted {
+		return StatusUnverifiable, ""
+	}
+	return StatusVerified, signer
+}
+
+// verifySSH checks an SSH signature against the allowed signers file, and returns the principal of the signer.
+func verifySSH(c *config, data []byte, signatureFile, author string) (Status, string) {
+	if c.AllowedSigners == "" {
+		return StatusUnverifiable, ""
+	}
+	out, err := run(nil, c.SSHProgram, "-Y", "find-principals", "-f", c.AllowedSigners, "-s", signatureFile)
+	if err != nil {
+		// The key is not one of the allowed signers.
+		return StatusUnverifiable, ""
+	}
+	principals := strings.Fields(string(out))
+	if len(principals) == 0 {
+		return StatusUnverifiable, ""
+	}
+	principal := principals[0]
+	for _, candidate := range principals {
+		if candidate == author {
+			principal = candidate
+		}
+	}
+	if _, err := run(data, c.SSHProgram, "-Y", "verify", "-f", c.AllowedSigners, "-I", principal,
+		"-n", namespace, "-s", signatureFile); err != nil {
+		return StatusForged, ""
+	}
+	return StatusVerified, principal
+}
+
+// matchesAuthor determines if the given signer identity corresponds to the given author.
+//
+// Authors are usually email addresses, while signers are either email addresses
+// (for SSH keys) or user IDs of the form "Name <email>" (for OpenPGP keys).
+func matchesAuthor(signer, author string) bool {
+	if author == "" {
+		return false
+	}
+	signer = strings.ToLower(signer)
+	author = strings.ToLower(author)
+	return signer == author || strings.Contains(signer, "<"+author+">")
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package signing
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type testNote struct {
+	Author string `json:"author"`
+	Sig
+}
+
+func TestSplitSignature(t *testing.T) {
+	note := &testNote{Author: "ojarjur", Sig: Sig{Signature: "sig"}}
+	data, err := payload(note)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if note.Signature != "sig" {
+		t.Fatal("Computing the payload removed the signature from the note")
+	}
+	serialized, err := json.Marshal(note)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, signature, err := splitSignature(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signature != "sig" || string(stored) != string(data) {
+		t.Fatalf("Unexpected payload %q and signature %q for %s, instead of %q", stored, signature, serialized, data)
+	}
+
+	// Fields that this version does not know about are still covered, and the order of the fields does not matter.
+	newer, _, err := splitSignature([]byte(`{"signature": "sig", "future": {"b": 1, "a": 2}, "author": "ojarjur"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"author":"ojarjur","future":{"b":1,"a":2}}`; string(newer) != expected {
+		t.Fatalf("Unexpected payload %q instead of %q", newer, expected)
+	}
+}
+
+func TestParseOpenPGPStatus(t *testing.T) {
+	const fingerprint = "0123456789ABCDEF0123456789ABCDEF01234567"
+	goodSig := "[GNUPG:] NEWSIG\n" +
+		"[GNUPG:] GOODSIG 89ABCDEF01234567 Omar Jarjur <ojarjur@google.com>\n" +
+		"[GNUPG:] VALIDSIG " + fingerprint + " 2015-01-01 1420070400 0 4 0 1 8 00 " + fingerprint + "\n"
+	if status, _ := parseOpenPGPStatus(goodSig+"[GNUPG:] TRUST_UNDEFINED 0 pgp\n", nil); status != StatusUnverifiable {
+		t.Fatalf("Unexpected status for a signature by an untrusted key: %q", status)
+	}
+	status, signer := parseOpenPGPStatus(goodSig+"[GNUPG:] TRUST_FULLY 0 pgp\n", nil)
+	if status != StatusVerified || signer != "Omar Jarjur <ojarjur@google.com>" {
+		t.Fatalf("Unexpected result for a signature by a trusted key: %q, %q", status, signer)
+	}
+	if status, _ := parseOpenPGPStatus(goodSig+"[GNUPG:] TRUST_UNDEFINED 0 pgp\n", []string{fingerprint}); status != StatusVerified {
+		t.Fatalf("Unexpected status for a signature by a key in the trusted keys: %q", status)
+	}
+	if status, _ := parseOpenPGPStatus("[GNUPG:] GOODSIG 89ABCDEF01234567 Omar Jarjur <ojarjur@google.com>\n[GNUPG:] TRUST_FULLY 0 pgp\n", nil); status != StatusUnverifiable {
+		t.Fatalf("Unexpected status for a signature without a fingerprint: %q", status)
+	}
+	if status, _ := parseOpenPGPStatus("[GNUPG:] BADSIG 89ABCDEF01234567 Omar Jarjur <ojarjur@google.com>\n", []string{fingerprint}); status != StatusForged {
+		t.Fatalf("Unexpected status for a bad signature: %q", status)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"fmt"
+)
+
+// GetParent returns the review that this review depends on, or nil if it does not depend on another review.
+func (r *Summary) GetParent() (*Review, error) {
+	if r.Request.DependsOn == "" {
+		return nil, nil
+	}
+	parent, err := Get(r.Repo, r.Request.DependsOn)
+	if err != nil {
+		return nil, err
+	}
+	if parent == nil {
+		return nil, fmt.Errorf("The review depends on %q, which is not a known review.", r.Request.DependsOn)
+	}
+	return parent, nil
+}
+
+// GetUnsubmittedAncestors returns the reviews that this review depends on, either
+// directly or through other reviews, that have not yet been submitted.
+//
+// The reviews are returned in the order in which they need to be submitted,
+// starting from the bottom of the stack. An abandoned review will never be
+// submitted, so the stack ends at the first submitted or abandoned review.
+func (r *Summary) GetUnsubmittedAncestors() ([]*Review, error) {
+	var ancestors []*Review
+	visited := map[string]bool{r.Revision: true}
+	current := r
+	for {
+		parent, err := current.GetParent()
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil || parent.Submitted || parent.Abandoned {
+			break
+		}
+		if visited[parent.Revision] {
+			return nil, fmt.Errorf("The reviews that %q depends on form a cycle.", r.Revision)
+		}
+		visited[parent.Revision] = true
+		ancestors = append([]*Review{parent}, ancestors...)
+		current = parent.Summary
+	}
+	return ancestors, nil
+}
+
+// SortIntoStacks arranges the given reviews into stacks, where each review is
+// followed by the reviews that depend on it.
+//
+// The returned depths give how far each review is from the bottom of its stack.
+// Reviews whose parent is not one of the given reviews are at the bottom of a
+// stack, and otherwise the order of the given reviews is preserved.
+func SortIntoStacks(reviews []Summary) ([]Summary, []int) {
+	indices := make(map[string]int)
+	for i, r := range reviews {
+		indices[r.Revision] = i
+	}
+	children := make(map[int][]int)
+	var roots []int
+	for i, r := range reviews {
+		if parent, ok := indices[r.Request.DependsOn]; ok && parent != i {
+			children[parent] = append(children[parent], i)
+		} else {
+			roots = append(roots, i)
+		}
+	}
+	var sorted []Summary
+	var depths []int
+	visited := make(map[int]bool)
+	var visit func(i, depth int)
+	visit = func(i, depth int) {
+		if visited[i] {
+			return
+		}
+		visited[i] = true
+		sorted = append(sorted, reviews[i])
+		depths = append(depths, depth)
+		for _, child := range children[i] {
+			visit(child, depth+1)
+		}
+	}
+	for _, i := range roots {
+		visit(i, 0)
+	}
+	// Reviews that depend on each other in a cycle have no root, so they are listed last.
+	for i := range reviews {
+		visit(i, 0)
+	}
+	return sorted, depths
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package status defines the internal representation of changes to the lifecycle state of a review.
+package status
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/versions"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Ref defines the git-notes ref that we expect to contain review status changes.
+const Ref = "refs/notes/devtools/status"
+
+// FormatVersion defines the latest version of the status format supported by the tool.
+const FormatVersion = 0
+
+// Format describes the versions of the status change format, and how to upgrade older status changes.
+var Format = versions.Format{Latest: FormatVersion}
+
+const (
+	// StateAbandoned means that the review is no longer being pursued.
+	StateAbandoned = "abandoned"
+	// StateOpen means that the review is being pursued, and is used to reopen abandoned reviews.
+	StateOpen = "open"
+)
+
+// Status represents a change to the lifecycle state of a review.
+type Status struct {
+	// Timestamp and Author are optimizations that allows us to display status changes
+	// without having to run git-blame over the notes object.
+	Timestamp string `json:"timestamp,omitempty"`
+	Author    string `json:"author,omitempty"`
+	// State is the state of the review following the change.
+	State string `json:"state"`
+	// Description optionally explains the reason for the change.
+	Description string `json:"description,omitempty"`
+	// Version represents the version of the metadata format.
+	Version int `json:"v,omitempty"`
+}
+
+// New returns a new status change to the given state.
+//
+// The Timestamp and Author fields are automatically filled in with the current time and user.
+func New(author, state, description string) Status {
+	return Status{
+		Timestamp:   strconv.FormatInt(time.Now().Unix(), 10),
+		Author:      author,
+		State:       state,
+		Description: description,
+	}
+}
+
+// Parse parses a review status change from a git note.
+func Parse(note repository.Note) (Status, error) {
+	var status Status
+	note, err := Format.Upgrade(note)
+	if err != nil {
+		return status, err
+	}
+	err = json.Unmarshal([]byte(note), &status)
+	return status, err
+}
+
+type byTimestamp []Status
+
+// Interface methods for sorting status changes by timestamp
+func (statuses byTimestamp) Len() int      { return len(statuses) }
+func (statuses byTimestamp) Swap(i, j int) { statuses[i], statuses[j] = statuses[j], statuses[i] }
+func (statuses byTimestamp) Less(i, j int) bool {
+	if statuses[i].Timestamp != statuses[j].Timestamp {
+		return statuses[i].Timestamp < statuses[j].Timestamp
+	}
+	left, _ := statuses[i].Hash()
+	right, _ := statuses[j].Hash()
+	return left < right
+}
+
+// ParseAllValid takes collection of git notes and tries to parse a review
+// status change from each one. Any notes that are not valid status changes get ignored.
+//
+// The status changes are returned in timestamp order. Changes with the same
+// timestamp are ordered by their hashes, so that the order does not depend on
+// the order of the notes, which can differ between clones after a merge.
+func ParseAllValid(notes []repository.Note) []Status {
+	var statuses []Status
+	for _, note := range notes {
+		status, err := Parse(note)
+		if err == nil && (status.State == StateAbandoned || status.State == StateOpen) {
+			statuses = append(statuses, status)
+		}
+	}
+	sort.Sort(byTimestamp(statuses))
+	return statuses
+}
+
+// IsAbandoned returns true if the latest of the given status changes abandoned the review.
+//
+// The status changes must be in timestamp order, as returned by ParseAllValid.
+func IsAbandoned(statuses []Status) bool {
+	return len(statuses) > 0 && statuses[len(statuses)-1].State == StateAbandoned
+}
+
+// Hash returns the SHA1 hash of the status change, as written to a git note.
+func (status Status) Hash() (string, error) {
+	note, err := status.Write()
+	return fmt.Sprintf("%x", sha1.Sum(note)), err
+}
+
+// Write writes a review status change as a JSON-formatted git note.
+func (status Status) Write() (repository.Note, error) {
+	bytes, err := json.Marshal(status)
+	return repository.Note(bytes), err
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package status
+
+import (
+	"github.com/google/git-appraise/repository"
+	"testing"
+)
+
+func TestIsAbandoned(t *testing.T) {
+	abandonHash, _ := Status{Timestamp: "0000000002", State: StateAbandoned}.Hash()
+	reopenHash, _ := Status{Timestamp: "0000000002", State: StateOpen}.Hash()
+	sameTimestampAbandoned := abandonHash > reopenHash
+	abandon := `{"timestamp": "0000000002", "state": "abandoned"}`
+	reopen := `{"timestamp": "0000000003", "state": "open"}`
+	abandonAgain := `{"timestamp": "0000000004", "state": "abandoned"}`
+	testCases := []struct {
+		notes    []string
+		expected bool
+	}{
+		{nil, false},
+		{[]string{abandon}, true},
+		{[]string{abandon, reopen}, false},
+		// Later reopens override earlier abandons, regardless of the order of the notes.
+		{[]string{reopen, abandon}, false},
+		{[]string{abandonAgain, reopen, abandon}, true},
+		{[]string{abandon, `{"timestamp": "0000000005", "state": "unknown"}`}, true},
+		{[]string{abandon, `{"timestamp": "0000000005", "state": "open", "v": 1}`}, true},
+		// Changes with the same timestamp are ordered by their hashes, regardless of the order of the notes.
+		{[]string{abandon, `{"timestamp": "0000000002", "state": "open"}`}, sameTimestampAbandoned},
+		{[]string{`{"timestamp": "0000000002", "state": "open"}`, abandon}, sameTimestampAbandoned},
+	}
+	for _, testCase := range testCases {
+		var notes []repository.Note
+		for _, note := range testCase.notes {
+			notes = append(notes, repository.Note(note))
+		}
+		if abandoned := IsAbandoned(ParseAllValid(notes)); abandoned != testCase.expected {
+			t.Errorf("Unexpected abandoned state for %v: %v", testCase.notes, abandoned)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"github.com/google/git-appraise/repository"
+	"github.com/google/git-appraise/review/comment"
+	"github.com/google/git-appraise/review/request"
+	"github.com/google/git-appraise/review/signing"
+)
+
+// collectThreads appends pointers to every thread in the given threads and their descendants.
+func collectThreads(threads []CommentThread, collected []*CommentThread) []*CommentThread {
+	for i := range threads {
+		collected = append(collected, &threads[i])
+		collected = collectThreads(threads[i].Children, collected)
+	}
+	return collected
+}
+
+// verifyComments parses the comments in the given notes, which annotate the given
+// revision, keyed by their hashes, and checks the signature on each of them.
+//
+// Signatures are checked against the notes as they are stored, rather than
+// against the parsed comments. Checking a signature requires running an
+// external program, so the comments are checked concurrently.
+func verifyComments(repo repository.Repo, revision string, notes []repository.Note) (map[string]comment.Comment, map[string]signing.Status) {
+	commentsByHash := make(map[string]comment.Comment)
+	notesByHash := make(map[string]repository.Note)
+	var hashes []string
+	for _, note := range notes {
+		c, hash, err := comment.ParseWithHash(note)
+		if _, ok := commentsByHash[hash]; err != nil || ok {
+			continue
+		}
+		commentsByHash[hash] = c
+		notesByHash[hash] = note
+		hashes = append(hashes, hash)
+	}
+	results := make([]signing.Status, len(hashes))
+	forEachConcurrently(getJobs(repo), len(hashes), func(i int) {
+		results[i] = signing.Verify(repo, revision, notesByHash[hashes[i]], commentsByHash[hashes[i]].Author)
+	})
+	statuses := make(map[string]signing.Status)
+	for i, hash := range hashes {
+		statuses[hash] = results[i]
+	}
+	return commentsByHash, statuses
+}
+
+// recordVerification sets the Verification field of every one of the given
+// threads, and their descendants, using the given statuses of their comments.
+func recordVerification(threads []CommentThread, statuses map[string]signing.Status) {
+	for _, thread := range collectThreads(threads, nil) {
+		if thread.Retracted {
+			continue
+		}
+		// The text of an edited comment comes from the edit, so that is what needs to be signed.
+		signed := &thread.Comment
+		hash := thread.Hash
+		if thread.Edit != nil {
+			signed = thread.Edit
+			hash, _ = thread.Edit.Hash()
+		}
+		status, ok := statuses[hash]
+		switch {
+		case signed.Signature == "":
+			status = signing.StatusUnsigned
+		case !ok:
+			// The comment is not among the notes of the review, so its signature cannot be checked.
+			status = signing.StatusUnverifiable
+		}
+		thread.Verification = status
+	}
+}
+
+// currentRequestNote returns the note holding the current request among the given
+// notes, which is the latest one, as for the Request field of a review summary.
+func currentRequestNote(notes []repository.Note) repository.Note {
+	var current repository.Note
+	var latest string
+	for _, note := range notes {
+		// Requests with the same timestamp are ordered as they appear in the notes.
+		if r, err := request.Parse(note); err == nil && r.TargetRef != "" && (current == nil || r.Timestamp >= latest) {
+			current = note
+			latest = r.Timestamp
+		}
+	}
+	return current
+}
+
+// VerifySignatures checks the signatures on the review request and on every comment
+// in the review, and records the results in the review.
+//
+// It also records the comment threads as they are when only the edits and
+// retractions whose signatures verify as coming from their authors are applied,
+// which are what GetVerifiedResolved and GetVerifiedVotes count. Otherwise,
+// anyone could withdraw a signed vote by writing an unsigned amendment that
+// claims to come from the author of the vote. Likewise, approvals of commits
+// that are not part of the review are not counted.
+func (r *Review) VerifySignatures() {
+	r.RequestVerification = signing.StatusUnsigned
+	if note := currentRequestNote(r.Repo.GetNotes(request.Ref, r.Revision)); note != nil {
+		r.RequestVerification = signing.Verify(r.Repo, r.Revision, note, r.Request.Author())
+	}
+	commentsByHash, statuses := verifyComments(r.Repo, r.Revision, r.Repo.GetNotes(comment.Ref, r.Revision))
+	recordVerification(r.Comments, statuses)
+
+	verifiedComments := make(map[string]comment.Comment)
+	for hash, c := range commentsByHash {
+		if !c.IsAmendment() || statuses[hash] == signing.StatusVerified {
+			verifiedComments[hash] = c
+		}
+	}
+	r.verifiedComments = r.withoutForeignApprovals(buildCommentThreads(verifiedComments))
+	recordVerification(r.verifiedComments, statuses)
+}
+
+// isReviewCommit determines if the given commit is part of the review: either
+// its first revision, the head of one of its recorded revisions, or one of the
+// commits between its current base and head commits.
+func (r *Review) isReviewCommit(commit string) bool {
+	if commit == r.Revision {
+		return true
+	}
+	for _, revision := range r.Revisions {
+		if revision.Commit == commit {
+			return true
+		}
+	}
+	head, err := r.GetHeadCommit()
+	if err != nil {
+		return false
+	}
+	base, err := r.GetBaseCommit()
+	if err != nil {
+		return false
+	}
+	if inHead, err := r.Repo.IsAncestor(commit, head); err != nil || !inHead {
+		return false
+	}
+	inBase, err := r.Repo.IsAncestor(commit, base)
+	return err == nil && !inBase
+}
+
+// withoutForeignApprovals returns a copy of the given threads in which any approval
+// of a commit that is not part of the review is treated as an FYI.
+func (r *Review) withoutForeignApprovals(threads []CommentThread) []CommentThread {
+	var result []CommentThread
+	for _, thread := range threads {
+		thread.Children = r.withoutForeignApprovals(thread.Children)
+		c := thread.Comment
+		if c.Resolved != nil && *c.Resolved && c.Location != nil && c.Location.Commit != "" && !r.isReviewCommit(c.Location.Commit) {
+			thread.Comment.Resolved = nil
+		}
+		result = append(result, thread)
+	}
+	return result
+}
+
+// HasSignatures returns true if the review request or any of the comments in the review are signed.
+func (r *Review) HasSignatures() bool {
+	if r.Request.Signature != "" {
+		return true
+	}
+	for _, thread := range collectThreads(r.Comments, nil) {
+		if thread.Comment.Signature != "" || (thread.Edit != nil && thread.Edit.Signature != "") {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutUnverifiedApprovals returns a copy of the given threads in which any
+// approval that was not verified to come from its author is treated as an FYI.
+func withoutUnverifiedApprovals(threads []CommentThread) []CommentThread {
+	var result []CommentThread
+	for _, thread := range threads {
+		thread.Children = withoutUnverifiedApprovals(thread.Children)
+		if thread.Verification != signing.StatusVerified && thread.Comment.Resolved != nil && *thread.Comment.Resolved {
+			thread.Comment.Resolved = nil
+		}
+		result = append(result, thread)
+	}
+	return result
+}
+
+// verifiedThreads returns the comment threads recorded by VerifySignatures, or
+// the comment threads of the review if it has not been called.
+func (r *Review) verifiedThreads() []CommentThread {
+	if r.verifiedComments != nil {
+		return r.verifiedComments
+	}
+	return r.Comments
+}
+
+// GetVerifiedResolved returns the resolved status of the review, counting only the
+// approvals whose signatures were verified by VerifySignatures.
+//
+// Rejections are counted whether or not they are signed, while edits and
+// retractions are only applied if their signatures were verified.
+func (r *Review) GetVerifiedResolved() *bool {
+	return updateThreadsStatus(withoutUnverifiedApprovals(r.verifiedThreads()))
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package versions handles the format versions of the notes used for code reviews.
+//
+// Every kind of note records the version of its format in the "v" field, which
+// defaults to 0. Notes written in an older version are upgraded to the latest
+// version when they are read, while notes written in a newer version than the
+// tool supports are reported as unsupported rather than being misread.
+package versions
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/google/git-appraise/repository"
+	"strconv"
+)
+
+// versionField is the name of the field that holds the format version of a note.
+const versionField = "v"
+
+// Upgrade converts the fields of a note from one version of a format to the next.
+type Upgrade func(fields map[string]json.RawMessage) error
+
+// Format describes the versions of one kind of note.
+type Format struct {
+	// Latest is the newest version of the format that the tool supports.
+	Latest int
+	// Upgrades holds, at each index i, the upgrade from version i to version i+1.
+	//
+	// A nil upgrade means that the newer version only added optional fields, so
+	// notes written in the older version can be read as-is. Notes are only
+	// rewritten, and have their version changed, when an upgrade changes them.
+	Upgrades []Upgrade
+}
+
+// UnsupportedError is returned for notes written in a newer version of a format than the tool supports.
+type UnsupportedError struct {
+	Version int
+	Latest  int
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("unsupported format version %d (the latest supported version is %d)", e.Version, e.Latest)
+}
+
+// IsUnsupported determines if the given error was caused by a note in an unsupported format version.
+func IsUnsupported(err error) bool {
+	_, ok := err.(*UnsupportedError)
+	return ok
+}
+
+// parseVersion returns the format version recorded in the given note fields.
+func parseVersion(fields map[string]json.RawMessage) (int, error) {
+	raw, ok := fields[versionField]
+	if !ok {
+		return 0, nil
+	}
+	var version int
+	if err := json.Unmarshal(raw, &version); err != nil || version < 0 {
+		return 0, fmt.Errorf("invalid format version %s", raw)
+	}
+	return version, nil
+}
+
+// Version returns the format version of the given note.
+func Version(note repository.Note) (int, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(note, &fields); err != nil {
+		return 0, err
+	}
+	return parseVersion(fields)
+}
+
+// Upgrade returns the given note converted to the latest version of the format.
+//
+// Notes that are not changed by any of the upgrades are returned unchanged.
+// Since upgrading a note changes its contents, upgraded notes lose the validity
+// of any signature they carry.
+func (f Format) Upgrade(note repository.Note) (repository.Note, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(note, &fields); err != nil {
+		return nil, err
+	}
+	version, err := parseVersion(fields)
+	if err != nil {
+		return nil, err
+	}
+	if version > f.Latest {
+		return nil, &UnsupportedError{Version: version, Latest: f.Latest}
+	}
+	var original []byte
+	for ; version < f.Latest && version < len(f.Upgrades); version++ {
+		if upgrade := f.Upgrades[version]; upgrade != nil {
+			if original == nil {
+				if original, err = json.Marshal(fields); err != nil {
+					return nil, err
+				}
+			}
+			if err := upgrade(fields); err != nil {
+				return nil, fmt.Errorf("failed to upgrade from format version %d: %v", version, err)
+			}
+		}
+	}
+	if original == nil {
+		return note, nil
+	}
+	if upgraded, err := json.Marshal(fields); err != nil || bytes.Equal(upgraded, original) {
+		return note, err
+	}
+	fields[versionField] = json.RawMessage(strconv.Itoa(f.Latest))
+	return json.Marshal(fields)
+}
+
+// CountUnsupported returns the number of the given notes that are written in a
+// newer version of the format than the tool supports.
+func (f Format) CountUnsupported(notes []repository.Note) int {
+	count := 0
+	for _, note := range notes {
+		if version, err := Version(note); err == nil && version > f.Latest {
+			count++
+		}
+	}
+	return count
+}
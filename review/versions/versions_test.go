@@ -0,0 +1,82 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package versions
+
+import (
+	"encoding/json"
+	"github.com/google/git-appraise/repository"
+	"testing"
+)
+
+// renameField returns an upgrade that renames the given field.
+func renameField(from, to string) Upgrade {
+	return func(fields map[string]json.RawMessage) error {
+		if value, ok := fields[from]; ok {
+			fields[to] = value
+			delete(fields, from)
+		}
+		return nil
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	format := Format{
+		Latest:   2,
+		Upgrades: []Upgrade{nil, renameField("name", "title")},
+	}
+	for _, test := range []struct {
+		note     string
+		expected string
+	}{
+		{`{"title":"unchanged"}`, `{"title":"unchanged"}`},
+		{`{"name":"renamed"}`, `{"title":"renamed","v":2}`},
+		{`{"name":"renamed","v":1}`, `{"title":"renamed","v":2}`},
+		{`{"name":"latest","v":2}`, `{"name":"latest","v":2}`},
+	} {
+		upgraded, err := format.Upgrade(repository.Note(test.note))
+		if err != nil {
+			t.Fatalf("Unexpected error upgrading %q: %v", test.note, err)
+		}
+		if string(upgraded) != test.expected {
+			t.Errorf("Unexpected upgrade of %q: %q", test.note, upgraded)
+		}
+	}
+
+	_, err := format.Upgrade(repository.Note(`{"v":3}`))
+	if !IsUnsupported(err) {
+		t.Fatalf("Unexpected result for a note in a newer format: %v", err)
+	}
+	for _, note := range []string{`{"v":-1}`, `{"v":"1"}`, `not json`} {
+		if _, err := format.Upgrade(repository.Note(note)); err == nil || IsUnsupported(err) {
+			t.Errorf("Unexpected result for the malformed note %q: %v", note, err)
+		}
+	}
+}
+
+func TestCountUnsupported(t *testing.T) {
+	format := Format{Latest: 1}
+	notes := []repository.Note{
+		repository.Note(`{}`),
+		repository.Note(`{"v":1}`),
+		repository.Note(`{"v":2}`),
+		repository.Note(`{"v":7}`),
+		repository.Note(`not json`),
+	}
+	if count := format.CountUnsupported(notes); count != 2 {
+		t.Fatalf("Unexpected number of unsupported notes: %d", count)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package review
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// computeVotes returns the vote of each author who has approved or rejected the review.
+//
+// Each author's vote comes from the latest of their top-level comments that is
+// either resolved (an approval) or unresolved (a rejection). FYI comments, and
+// replies to other comments (including orphaned replies, whose parent is
+// missing), do not change an author's vote. Comments with the same timestamp
+// are ordered by their hashes, so that the result does not depend on the order
+// of the threads.
+func computeVotes(threads []CommentThread) map[string]bool {
+	type vote struct {
+		timestamp, hash string
+	}
+	latest := make(map[string]vote)
+	votes := make(map[string]bool)
+	for _, thread := range threads {
+		c := thread.Comment
+		if thread.Orphaned || c.Resolved == nil || c.Author == "" {
+			continue
+		}
+		if previous, ok := latest[c.Author]; ok && (previous.timestamp > c.Timestamp ||
+			(previous.timestamp == c.Timestamp && previous.hash > thread.Hash)) {
+			continue
+		}
+		latest[c.Author] = vote{c.Timestamp, thread.Hash}
+		votes[c.Author] = *c.Resolved
+	}
+	if len(votes) == 0 {
+		return nil
+	}
+	return votes
+}
+
+// GetVerifiedVotes returns the vote of each author, counting only the approvals
+// whose signatures were verified by VerifySignatures.
+func (r *Review) GetVerifiedVotes() map[string]bool {
+	return computeVotes(withoutUnverifiedApprovals(r.verifiedThreads()))
+}
+
+// Policy describes the approvals that a review needs before it can be submitted.
+type Policy struct {
+	// RequiredApprovals is the number of people, other than the requester, who must approve.
+	RequiredApprovals int
+	// RequireReviewers means that every reviewer listed in the request must approve.
+	RequireReviewers bool
+}
+
+// Check verifies that the given votes on the given review satisfy the policy.
+//
+// The returned error describes every way in which the policy is not satisfied.
+func (p Policy) Check(r *Summary, votes map[string]bool) error {
+	var problems []string
+	approvals := 0
+	for author, approved := range votes {
+		if approved && author != r.Request.Requester {
+			approvals++
+		}
+	}
+	if approvals < p.RequiredApprovals {
+		problems = append(problems, fmt.Sprintf("%d approval(s) are required, but there are only %d", p.RequiredApprovals, approvals))
+	}
+	if p.RequireReviewers {
+		var missing []string
+		for _, reviewer := range r.Request.Reviewers {
+			if !votes[reviewer] {
+				missing = append(missing, reviewer)
+			}
+		}
+		sort.Strings(missing)
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("not yet approved by the reviewer(s) %s", strings.Join(missing, ", ")))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("The review does not meet the approval policy: %s.", strings.Join(problems, "; "))
+}
@@ -0,0 +1,223 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package schema validates notes against the JSON schemas that document their formats.
+//
+// Only the subset of JSON Schema (draft 4) that is used by the schemas in this
+// directory is supported: "type", "properties", "required", "enum", "pattern",
+// "minLength", "maxLength", "items", "oneOf", and "$ref" to "#/definitions/...".
+// Any other keywords are ignored.
+package schema
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+//go:embed *.json
+var files embed.FS
+
+const definitionsPrefix = "#/definitions/"
+
+// node is a single (sub)schema.
+type node struct {
+	Type        string           `json:"type,omitempty"`
+	Properties  map[string]*node `json:"properties,omitempty"`
+	Required    []string         `json:"required,omitempty"`
+	Enum        []interface{}    `json:"enum,omitempty"`
+	Pattern     string           `json:"pattern,omitempty"`
+	MinLength   *int             `json:"minLength,omitempty"`
+	MaxLength   *int             `json:"maxLength,omitempty"`
+	Items       *node            `json:"items,omitempty"`
+	OneOf       []*node          `json:"oneOf,omitempty"`
+	Ref         string           `json:"$ref,omitempty"`
+	Definitions map[string]*node `json:"definitions,omitempty"`
+}
+
+// Schema is a parsed JSON schema.
+type Schema struct {
+	root *node
+}
+
+// Load reads the schema with the given name, such as "request", from the schemas in this directory.
+func Load(name string) (*Schema, error) {
+	contents, err := files.ReadFile(name + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("Unknown schema %q", name)
+	}
+	var root node
+	if err := json.Unmarshal(contents, &root); err != nil {
+		return nil, fmt.Errorf("Malformed schema %q: %v", name, err)
+	}
+	return &Schema{root: &root}, nil
+}
+
+// Validate checks the given JSON document against the schema.
+func (s *Schema) Validate(document []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(document))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	return s.validate(s.root, value, "")
+}
+
+// describePath returns a readable description of the location of a value within a document.
+func describePath(path string) string {
+	if path == "" {
+		return "the note"
+	}
+	return fmt.Sprintf("%q", path)
+}
+
+// typeOf returns the name of the JSON Schema type of the given decoded value.
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// hasType determines if the given value is of the given JSON Schema type.
+func hasType(value interface{}, typeName string) bool {
+	actual := typeOf(value)
+	return actual == typeName || (typeName == "number" && actual == "integer")
+}
+
+// equalValues determines if a decoded value equals a value listed in a schema enum.
+func equalValues(value, expected interface{}) bool {
+	if n, ok := value.(json.Number); ok {
+		f, err := n.Float64()
+		e, isNumber := expected.(float64)
+		return err == nil && isNumber && f == e
+	}
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		return false
+	}
+	encodedExpected, err := json.Marshal(expected)
+	return err == nil && bytes.Equal(encodedValue, encodedExpected)
+}
+
+func (s *Schema) validate(n *node, value interface{}, path string) error {
+	if n.Ref != "" {
+		if !strings.HasPrefix(n.Ref, definitionsPrefix) {
+			return fmt.Errorf("unsupported schema reference %q", n.Ref)
+		}
+		definition, ok := s.root.Definitions[strings.TrimPrefix(n.Ref, definitionsPrefix)]
+		if !ok {
+			return fmt.Errorf("unknown schema reference %q", n.Ref)
+		}
+		return s.validate(definition, value, path)
+	}
+	if n.Type != "" && !hasType(value, n.Type) {
+		return fmt.Errorf("%s must be of type %s, not %s", describePath(path), n.Type, typeOf(value))
+	}
+	if len(n.Enum) > 0 {
+		found := false
+		for _, expected := range n.Enum {
+			if equalValues(value, expected) {
+				found = true
+			}
+		}
+		if !found {
+			encoded, _ := json.Marshal(value)
+			return fmt.Errorf("%s has the unexpected value %s", describePath(path), encoded)
+		}
+	}
+	if len(n.OneOf) > 0 {
+		matches := 0
+		for _, option := range n.OneOf {
+			if s.validate(option, value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s must match exactly one of its allowed forms", describePath(path))
+		}
+	}
+	switch v := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(v)
+		if n.MinLength != nil && length < *n.MinLength {
+			return fmt.Errorf("%s must be at least %d characters long", describePath(path), *n.MinLength)
+		}
+		if n.MaxLength != nil && length > *n.MaxLength {
+			return fmt.Errorf("%s must be at most %d characters long", describePath(path), *n.MaxLength)
+		}
+		if n.Pattern != "" {
+			pattern, err := regexp.Compile(n.Pattern)
+			if err != nil {
+				return fmt.Errorf("invalid schema pattern %q: %v", n.Pattern, err)
+			}
+			if !pattern.MatchString(v) {
+				return fmt.Errorf("%s does not match the pattern %q", describePath(path), n.Pattern)
+			}
+		}
+	case []interface{}:
+		if n.Items != nil {
+			for i, item := range v {
+				if err := s.validate(n.Items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, field := range n.Required {
+			if _, ok := v[field]; !ok {
+				return fmt.Errorf("%s is missing the required field %q", describePath(path), field)
+			}
+		}
+		var fields []string
+		for field := range v {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			if property, ok := n.Properties[field]; ok {
+				fieldPath := field
+				if path != "" {
+					fieldPath = path + "." + field
+				}
+				if err := s.validate(property, v[field], fieldPath); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
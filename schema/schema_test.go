@@ -0,0 +1,59 @@
+/*
+Copyright 2015 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package schema
+
+import (
+	"testing"
+)
+
+func TestLoadAll(t *testing.T) {
+	for _, name := range []string{"analysis", "ci", "comment", "request", "revision", "status"} {
+		if _, err := Load(name); err != nil {
+			t.Errorf("Failed to load the %q schema: %v", name, err)
+		}
+	}
+	if _, err := Load("missing"); err == nil {
+		t.Error("Unexpectedly loaded a schema that does not exist")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		schema, document string
+		valid            bool
+	}{
+		{"request", `{"timestamp": "0000000001", "requester": "ojarjur", "targetRef": "refs/heads/master", "reviewers": ["ojarjur"]}`, true},
+		{"request", `{"timestamp": "0000000001", "requester": "ojarjur"}`, false},
+		{"request", `{"timestamp": "1", "requester": "ojarjur", "targetRef": "refs/heads/master"}`, false},
+		{"request", `{"timestamp": "0000000001", "requester": "ojarjur", "targetRef": "refs/heads/master", "reviewers": [1]}`, false},
+		{"request", `{"timestamp": "0000000001", "requester": "ojarjur", "targetRef": "refs/heads/master", "v": 1}`, false},
+		{"request", `["not", "an", "object"]`, false},
+		{"request", `not JSON`, false},
+		{"analysis", `{"timestamp": "0000000001", "url": "https://example.com", "status": "lgtm"}`, true},
+		{"analysis", `{"timestamp": "0000000001", "url": "https://example.com", "status": "maybe"}`, false},
+		{"comment", `{"timestamp": "0000000001", "author": "ojarjur", "v": 2}`, true},
+	}
+	for _, c := range cases {
+		s, err := Load(c.schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Validate([]byte(c.document)); (err == nil) != c.valid {
+			t.Errorf("Unexpected result validating %s against the %q schema: %v", c.document, c.schema, err)
+		}
+	}
+}